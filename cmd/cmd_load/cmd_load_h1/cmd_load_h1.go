@@ -120,6 +120,9 @@ func Cmd() *cobra.Command {
 			for i := 0; i < params.Connections.Value(); i++ {
 				var err error
 				clients[i], err = snail_tcp.NewClient(host, port, nil, func(buffer *snail_buffer.Buffer) error {
+					if buffer == nil {
+						return nil // client closed
+					}
 					return respHandlers[i](buffer)
 				})
 				if err != nil {
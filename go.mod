@@ -9,6 +9,7 @@ require (
 
 require (
 	github.com/spf13/cobra v1.10.2
+	golang.org/x/sys v0.41.0
 	golang.org/x/text v0.33.0
 )
 
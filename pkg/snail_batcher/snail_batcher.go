@@ -1,10 +1,14 @@
 package snail_batcher
 
 import (
+	"errors"
 	"fmt"
+	"github.com/GiGurra/snail/pkg/snail_metrics"
 	"log/slog"
 	"runtime"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -47,13 +51,90 @@ import (
 //
 // Why spin at all, you may ask? Because on mac-os/apple silicon, regular lock waiting is atrociously slow.
 
-// TODO: Support error callbacks
+// ErrClosed is returned when adding items to a batcher that has been closed
+var ErrClosed = errors.New("snail batcher closed")
+
+// ErrOutputPanic is the error of a batch whose outputFunc panicked
+var ErrOutputPanic = errors.New("snail batcher outputFunc panicked")
+
+// ErrorPolicy decides what the batcher does once outputFunc has failed (after any retries)
+type ErrorPolicy int
+
+const (
+	// ErrorPolicyContinue reports the error and moves on to the next batch
+	ErrorPolicyContinue ErrorPolicy = iota
+	// ErrorPolicyStop stops calling outputFunc after the first error. Later batches are discarded.
+	ErrorPolicyStop
+	// ErrorPolicyPoison is like ErrorPolicyStop, and additionally makes Submit and SubmitMany return the error
+	ErrorPolicyPoison
+)
+
+// RetryPolicy configures retries of outputFunc for a failed batch
+type RetryPolicy struct {
+	MaxRetries int           // 0 = no retries
+	Backoff    time.Duration // wait between retries
+}
+
+type SnailBatcherOpts[T any] struct {
+	// OnError is called from the worker goroutine when a batch has failed. The batch
+	// is reused by the batcher once OnError returns, so it must not be retained.
+	OnError     func(batch []T, err error)
+	Retry       RetryPolicy
+	ErrorPolicy ErrorPolicy
+	// OnPanic is called from the worker goroutine when outputFunc panics, after the panic has been
+	// recovered and logged with its stack. The batch then fails with an error wrapping ErrOutputPanic,
+	// which poisons the batcher regardless of ErrorPolicy. It is also passed to OnError.
+	OnPanic func(recovered any, stack []byte)
+
+	// Metrics, if set, receives the batch size distribution, flushes by reason and
+	// how long flushed batches wait for the worker. See docs/api/batcher.md for the names.
+	Metrics snail_metrics.Metrics
+	// Name labels the batcher's metrics, to tell batchers apart
+	Name string
+}
+
+// Flush reasons, as reported in the snail_batcher_flushes_total metric
+const (
+	flushReasonFull     = "full"     // the batch reached batchSize
+	flushReasonTimer    = "timer"    // the timeout passed
+	flushReasonExplicit = "explicit" // Flush was called
+	flushReasonClose    = "close"    // Close was called
+)
+
+// queuedBatch is a batch on its way to the worker
+type queuedBatch[T any] struct {
+	items    []T
+	queuedAt time.Time // only set if metrics are enabled
+}
+
+type batcherMetrics struct {
+	enabled   bool
+	batchSize snail_metrics.Histogram
+	queueWait snail_metrics.Histogram
+	flushes   map[string]snail_metrics.Counter
+}
+
+func newBatcherMetrics(m snail_metrics.Metrics, name string) batcherMetrics {
+	enabled := m != nil
+	m = snail_metrics.OrDiscard(m)
+	label := snail_metrics.Label{Name: "batcher", Value: name}
+	res := batcherMetrics{
+		enabled:   enabled,
+		batchSize: m.Histogram("snail_batcher_batch_size", "Number of items in each batch written", snail_metrics.SizeBuckets, label),
+		queueWait: m.Histogram("snail_batcher_queue_wait_seconds", "Time from a batch being flushed until the worker picks it up", snail_metrics.LatencyBuckets, label),
+		flushes:   make(map[string]snail_metrics.Counter),
+	}
+	for _, reason := range []string{flushReasonFull, flushReasonTimer, flushReasonExplicit, flushReasonClose} {
+		res.flushes[reason] = m.Counter("snail_batcher_flushes_total", "Batches flushed, by reason", label, snail_metrics.Label{Name: "reason", Value: reason})
+	}
+	return res
+}
 
 type SnailBatcher[T any] struct {
 	batchSize int
 	queueSize int
 
-	pushChan chan []T
+	pushChan chan queuedBatch[T]
 	pullChan chan []T
 
 	lock              sync.Mutex // We spin on this one as long as there is a buffer available
@@ -63,6 +144,15 @@ type SnailBatcher[T any] struct {
 
 	timeout    time.Duration
 	outputFunc func([]T) error
+	opts       SnailBatcherOpts[T]
+	poison     atomic.Pointer[error] // set once the batcher is poisoned, see ErrorPolicyPoison
+	metrics    batcherMetrics
+
+	closed     bool          // set under the spin lock by Close
+	closeOnce  sync.Once     // Close is idempotent
+	workerDone chan struct{} // closed when the worker has written its last batch and exited
+	stopTicker chan struct{} // closed by the worker to stop the ticker goroutine
+	tickerDone chan struct{} // closed when the ticker goroutine has exited
 }
 
 func NewSnailBatcher[T any](
@@ -71,6 +161,20 @@ func NewSnailBatcher[T any](
 	timeout time.Duration,
 	outputFunc func([]T) error,
 ) *SnailBatcher[T] {
+	return NewSnailBatcherWithOpts(batchSize, queueSize, timeout, outputFunc, nil)
+}
+
+func NewSnailBatcherWithOpts[T any](
+	batchSize int,
+	queueSize int,
+	timeout time.Duration,
+	outputFunc func([]T) error,
+	opts *SnailBatcherOpts[T],
+) *SnailBatcher[T] {
+
+	if opts == nil {
+		opts = &SnailBatcherOpts[T]{}
+	}
 
 	if batchSize <= 0 {
 		panic(fmt.Sprintf("batchSize must be > 0, got %d", batchSize))
@@ -91,12 +195,18 @@ func NewSnailBatcher[T any](
 		batchSize: batchSize,
 		queueSize: queueSize,
 
-		pushChan:          make(chan []T, totalBufferCount),
+		pushChan:          make(chan queuedBatch[T], totalBufferCount),
 		pullChan:          make(chan []T, totalBufferCount),
 		currentBackBuffer: nil,
 
 		timeout:    timeout,
 		outputFunc: outputFunc,
+		opts:       *opts,
+		metrics:    newBatcherMetrics(opts.Metrics, opts.Name),
+
+		workerDone: make(chan struct{}),
+		stopTicker: make(chan struct{}),
+		tickerDone: make(chan struct{}),
 	}
 
 	// add buffers to the pull channel
@@ -109,33 +219,68 @@ func NewSnailBatcher[T any](
 	return res
 }
 
+// Add adds an item to the current batch. Items added after the batcher has been closed or
+// poisoned are dropped, see Submit to find out, or Err.
 func (sb *SnailBatcher[T]) Add(item T) {
+	_ = sb.Submit(item)
+}
+
+// Submit is Add, returning ErrClosed if the batcher has been closed, or the poisoning
+// error if it has been poisoned, see ErrorPolicyPoison.
+func (sb *SnailBatcher[T]) Submit(item T) error {
+	if err := sb.Err(); err != nil {
+		return err
+	}
 	sb.lockSpinLock()
 	defer sb.unlockSpinLock()
-	sb.addInternal(item)
+	return sb.addInternal(item)
+}
+
+// Err returns the error that poisoned the batcher, or nil
+func (sb *SnailBatcher[T]) Err() error {
+	if err := sb.poison.Load(); err != nil {
+		return *err
+	}
+	return nil
 }
 
 // ensureBackBufferInternal makes sure we have a back buffer available. It is a little complicated.
 // The reason is that we want to put all producers/clients to sleep if the worker is overloaded (i.e. back pressure)
-func (sb *SnailBatcher[T]) ensureBackBufferInternal() {
-	for sb.currentBackBuffer == nil { // this is generally only the case if we have just flushed
+// Returns ErrClosed if the batcher is closed, possibly while we were waiting.
+func (sb *SnailBatcher[T]) ensureBackBufferInternal() error {
+	for !sb.closed && sb.currentBackBuffer == nil { // this is generally only the case if we have just flushed
 		sb.unlockSpinLock()         // we do this to stop others from spinning
 		sb.newBackBufferLock.Lock() // here we always want a regular lock, so we don't spin.
-		// Whoever grabbed the lock first will now set the new back buffer
-		if sb.currentBackBuffer == nil {
-			sb.currentBackBuffer = <-sb.pullChan
+		sb.lockSpinLock()
+		// Whoever grabbed the lock first will now fetch the new back buffer. Only the
+		// holder of newBackBufferLock sets it, but it is always set under the spin lock.
+		if !sb.closed && sb.currentBackBuffer == nil {
+			sb.unlockSpinLock()
+			var buffer []T
+			select {
+			case buffer = <-sb.pullChan:
+			case <-sb.workerDone: // no more buffers will come back
+			}
+			sb.lockSpinLock()
+			sb.currentBackBuffer = buffer
 		}
 		sb.newBackBufferLock.Unlock()
-		sb.lockSpinLock()
 	}
+	if sb.closed {
+		return ErrClosed
+	}
+	return nil
 }
 
-func (sb *SnailBatcher[T]) addInternal(item T) {
-	sb.ensureBackBufferInternal()
+func (sb *SnailBatcher[T]) addInternal(item T) error {
+	if err := sb.ensureBackBufferInternal(); err != nil {
+		return err
+	}
 	sb.currentBackBuffer = append(sb.currentBackBuffer, item)
 	if len(sb.currentBackBuffer) >= sb.batchSize {
-		sb.flushInternal()
+		sb.flushInternal(flushReasonFull)
 	}
+	return nil
 }
 
 func (sb *SnailBatcher[T]) lockSpinLock() {
@@ -148,13 +293,25 @@ func (sb *SnailBatcher[T]) unlockSpinLock() {
 	sb.lock.Unlock()
 }
 
+// AddMany adds items to the current batch, flushing as needed. Like Add, it drops
+// them if the batcher has been closed or poisoned.
 func (sb *SnailBatcher[T]) AddMany(newItems []T) {
+	_ = sb.SubmitMany(newItems)
+}
+
+// SubmitMany is AddMany, returning the same errors as Submit
+func (sb *SnailBatcher[T]) SubmitMany(newItems []T) error {
+	if err := sb.Err(); err != nil {
+		return err
+	}
 	sb.lockSpinLock()
 	defer sb.unlockSpinLock()
 
 	for len(newItems) != 0 {
 
-		sb.ensureBackBufferInternal()
+		if err := sb.ensureBackBufferInternal(); err != nil {
+			return err
+		}
 
 		availableForWriteInTrg := sb.batchSize - len(sb.currentBackBuffer)
 		chunk := newItems
@@ -164,55 +321,100 @@ func (sb *SnailBatcher[T]) AddMany(newItems []T) {
 
 		sb.currentBackBuffer = append(sb.currentBackBuffer, chunk...)
 		if len(sb.currentBackBuffer) >= sb.batchSize {
-			sb.flushInternal()
+			sb.flushInternal(flushReasonFull)
 		}
 
 		newItems = newItems[len(chunk):]
 	}
+
+	return nil
 }
 
 func (sb *SnailBatcher[T]) Flush() {
+	sb.flush(flushReasonExplicit)
+}
+
+func (sb *SnailBatcher[T]) flush(reason string) {
 	sb.lockSpinLock()
 	defer sb.unlockSpinLock()
-	sb.flushInternal()
+	sb.flushInternal(reason)
 }
 
-func (sb *SnailBatcher[T]) flushInternal() {
-	if len(sb.currentBackBuffer) == 0 { // never send empty slice, since it's a signal to close the internal worker routine
+func (sb *SnailBatcher[T]) flushInternal(reason string) {
+	if sb.closed || len(sb.currentBackBuffer) == 0 { // never send empty slice, since it's a signal to close the internal worker routine
 		return
 	}
-	sb.pushChan <- sb.currentBackBuffer
+	batch := queuedBatch[T]{items: sb.currentBackBuffer}
+	if sb.metrics.enabled {
+		batch.queuedAt = time.Now()
+		sb.metrics.flushes[reason].Add(1)
+	}
+	sb.pushChan <- batch
 	sb.currentBackBuffer = nil
 }
 
+// Close flushes the remaining items and stops the batcher. It returns once the final
+// batch has been written and all of the batcher's goroutines have exited. Calling Close
+// more than once is fine, but it must not be called from within outputFunc.
 func (sb *SnailBatcher[T]) Close() {
-	sb.lockSpinLock()
-	defer sb.unlockSpinLock()
-	sb.flushInternal()
-	sb.pushChan <- []T{} // indicates a close
+	sb.closeOnce.Do(func() {
+		sb.lockSpinLock()
+		defer sb.unlockSpinLock()
+		sb.flushInternal(flushReasonClose)
+		sb.closed = true
+		sb.pushChan <- queuedBatch[T]{} // no items indicates a close
+	})
+	<-sb.workerDone
+}
+
+// Done returns a channel that is closed once the batcher has been closed
+// and the worker has written the final batch. Useful for closing asynchronously.
+func (sb *SnailBatcher[T]) Done() <-chan struct{} {
+	return sb.workerDone
 }
 
 func (sb *SnailBatcher[T]) workerLoop() {
 
+	defer close(sb.workerDone)
+
 	// Ugly for now, but it works
 	ticker := time.NewTicker(sb.timeout)
 	defer ticker.Stop()
 	go func() {
-		for range ticker.C {
-			sb.Flush()
+		defer close(sb.tickerDone)
+		for {
+			select {
+			case <-ticker.C:
+				sb.flush(flushReasonTimer)
+			case <-sb.stopTicker:
+				return
+			}
 		}
 	}()
+	defer func() {
+		close(sb.stopTicker)
+		<-sb.tickerDone
+	}()
+
+	stopped := false
 
-	for batch := range sb.pushChan {
+	for queued := range sb.pushChan {
+		batch := queued.items
 		for len(batch) == 0 {
 			slog.Debug("batcher received close signal, stopping")
 			return
 		}
 
-		err := sb.outputFunc(batch)
-		if err != nil {
-			slog.Error(fmt.Sprintf("error when flushing batch: %v", err))
-			// TODO: Forward errors, somehow. Or maybe just log them? Or provide retry policy, idk...
+		if sb.metrics.enabled {
+			sb.metrics.queueWait.Observe(time.Since(queued.queuedAt).Seconds())
+			sb.metrics.batchSize.Observe(float64(len(batch)))
+		}
+
+		if !stopped {
+			err := sb.outputWithRetries(batch)
+			if err != nil {
+				stopped = sb.handleError(batch, err)
+			}
 		}
 
 		// zero out the buffer and push it back to the pull channel
@@ -220,3 +422,52 @@ func (sb *SnailBatcher[T]) workerLoop() {
 		sb.pullChan <- batch
 	}
 }
+
+func (sb *SnailBatcher[T]) outputWithRetries(batch []T) error {
+	err := sb.output(batch)
+	for retry := 1; err != nil && !errors.Is(err, ErrOutputPanic) && retry <= sb.opts.Retry.MaxRetries; retry++ {
+		slog.Debug(fmt.Sprintf("retrying batch (%d/%d) after error: %v", retry, sb.opts.Retry.MaxRetries, err))
+		time.Sleep(sb.opts.Retry.Backoff)
+		err = sb.output(batch)
+	}
+	return err
+}
+
+// output calls outputFunc, turning a panic into an error wrapping ErrOutputPanic
+func (sb *SnailBatcher[T]) output(batch []T) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := debug.Stack()
+			slog.Error(
+				"Recovered from panic in batcher outputFunc, poisoning batcher",
+				slog.String("batcher", sb.opts.Name),
+				slog.Int("batch_size", len(batch)),
+				slog.Any("panic", r),
+				slog.String("stack", string(stack)),
+			)
+			if sb.opts.OnPanic != nil {
+				sb.opts.OnPanic(r, stack)
+			}
+			err = fmt.Errorf("%w: %v", ErrOutputPanic, r)
+		}
+	}()
+	return sb.outputFunc(batch)
+}
+
+// handleError applies the error policy and reports a failed batch.
+// Returns true if the worker should stop calling outputFunc.
+func (sb *SnailBatcher[T]) handleError(batch []T, err error) bool {
+	panicked := errors.Is(err, ErrOutputPanic)
+	if sb.opts.ErrorPolicy == ErrorPolicyPoison || panicked {
+		poison := fmt.Errorf("batcher poisoned: %w", err)
+		sb.poison.Store(&poison)
+	}
+
+	if sb.opts.OnError != nil {
+		sb.opts.OnError(batch, err)
+	} else {
+		slog.Error(fmt.Sprintf("error when flushing batch: %v", err))
+	}
+
+	return sb.opts.ErrorPolicy != ErrorPolicyContinue || panicked
+}
@@ -1,8 +1,10 @@
 package snail_batcher
 
 import (
+	"errors"
 	"fmt"
 	"github.com/GiGurra/snail/pkg/snail_logging"
+	"github.com/GiGurra/snail/pkg/snail_metrics"
 	"github.com/GiGurra/snail/pkg/snail_test_util"
 	"github.com/samber/lo"
 	lop "github.com/samber/lo/parallel"
@@ -10,6 +12,7 @@ import (
 	"golang.org/x/text/message"
 	"log/slog"
 	"math/rand"
+	"runtime"
 	"slices"
 	"testing"
 	"time"
@@ -526,6 +529,293 @@ func TestNewSnailBatcher_manualFlush(t *testing.T) {
 
 var prettyPrinter = message.NewPrinter(language.English)
 
+func TestNewSnailBatcherWithOpts_errorPolicies(t *testing.T) {
+
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	errFailed := fmt.Errorf("output failed")
+
+	newFailingBatcher := func(policy ErrorPolicy, retries int, nFailures int) (*SnailBatcher[int], *[]int, chan error) {
+		var written []int
+		errs := make(chan error, 10)
+		attempts := 0
+		batcher := NewSnailBatcherWithOpts[int](
+			1,
+			1,
+			1*time.Minute,
+			func(values []int) error {
+				attempts++
+				if attempts <= nFailures {
+					return errFailed
+				}
+				written = append(written, values...)
+				return nil
+			},
+			&SnailBatcherOpts[int]{
+				OnError:     func(_ []int, err error) { errs <- err },
+				Retry:       RetryPolicy{MaxRetries: retries},
+				ErrorPolicy: policy,
+			},
+		)
+		return batcher, &written, errs
+	}
+
+	t.Run("continue", func(t *testing.T) {
+		batcher, written, errs := newFailingBatcher(ErrorPolicyContinue, 0, 1)
+		for i := 0; i < 3; i++ {
+			if err := batcher.Submit(i); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+		batcher.Close()
+		<-batcher.Done()
+		if err := <-errs; err != errFailed {
+			t.Fatalf("expected errFailed in callback, got %v", err)
+		}
+		if !slices.Equal(*written, []int{1, 2}) {
+			t.Fatalf("expected [1 2] to be written, got %v", *written)
+		}
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		batcher, written, errs := newFailingBatcher(ErrorPolicyContinue, 2, 2)
+		batcher.Add(1)
+		batcher.Close()
+		<-batcher.Done()
+		if len(errs) != 0 {
+			t.Fatalf("expected no errors after retries, got %v", <-errs)
+		}
+		if !slices.Equal(*written, []int{1}) {
+			t.Fatalf("expected [1] to be written, got %v", *written)
+		}
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		batcher, written, _ := newFailingBatcher(ErrorPolicyStop, 0, 1)
+		for i := 0; i < 3; i++ {
+			batcher.Add(i)
+		}
+		batcher.Close()
+		<-batcher.Done()
+		if len(*written) != 0 {
+			t.Fatalf("expected nothing to be written after the first error, got %v", *written)
+		}
+		if batcher.Err() != nil {
+			t.Fatalf("expected batcher not to be poisoned, got %v", batcher.Err())
+		}
+	})
+
+	t.Run("poison", func(t *testing.T) {
+		batcher, _, errs := newFailingBatcher(ErrorPolicyPoison, 0, 1)
+		batcher.Add(0)
+		<-errs
+		if err := batcher.Submit(1); !errors.Is(err, errFailed) {
+			t.Fatalf("expected Add to fail with errFailed, got %v", err)
+		}
+		if err := batcher.SubmitMany([]int{2, 3}); !errors.Is(err, errFailed) {
+			t.Fatalf("expected AddMany to fail with errFailed, got %v", err)
+		}
+		batcher.Close()
+		<-batcher.Done()
+	})
+}
+
+func TestNewSnailBatcher_close(t *testing.T) {
+
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	goroutinesBefore := runtime.NumGoroutine()
+
+	for i := 0; i < 100; i++ {
+		var written []int
+		batcher := NewSnailBatcher[int](
+			10,
+			20,
+			1*time.Millisecond,
+			func(values []int) error {
+				written = append(written, values...)
+				return nil
+			},
+		)
+
+		if err := batcher.SubmitMany([]int{1, 2, 3}); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		batcher.Close()
+
+		// the final batch must have been written once Close returns
+		if !slices.Equal(written, []int{1, 2, 3}) {
+			t.Fatalf("expected [1 2 3] to be written, got %v", written)
+		}
+
+		batcher.Close() // idempotent
+
+		if err := batcher.Submit(4); !errors.Is(err, ErrClosed) {
+			t.Fatalf("expected ErrClosed, got %v", err)
+		}
+		if err := batcher.SubmitMany([]int{5, 6}); !errors.Is(err, ErrClosed) {
+			t.Fatalf("expected ErrClosed, got %v", err)
+		}
+		batcher.Flush() // no-op
+	}
+
+	if n := runtime.NumGoroutine(); n > goroutinesBefore {
+		t.Fatalf("expected no leaked goroutines, had %d before and %d after", goroutinesBefore, n)
+	}
+}
+
+func TestNewSnailBatcher_closeUnblocksWaitingProducers(t *testing.T) {
+
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	release := make(chan struct{})
+	batcher := NewSnailBatcher[int](
+		1,
+		1,
+		1*time.Minute,
+		func(values []int) error {
+			<-release
+			return nil
+		},
+	)
+
+	// Fill both buffers, so that the next producer has to wait for the worker
+	batcher.Add(1)
+	batcher.Add(2)
+
+	addErr := make(chan error)
+	go func() {
+		addErr <- batcher.Submit(3)
+	}()
+
+	closed := make(chan struct{})
+	go func() {
+		batcher.Close()
+		close(closed)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	select {
+	case <-closed:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expected Close to return")
+	}
+
+	select {
+	case err := <-addErr:
+		if err != nil && !errors.Is(err, ErrClosed) {
+			t.Fatalf("expected nil or ErrClosed, got %v", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expected waiting producer to be released")
+	}
+}
+
+func TestNewSnailBatcher_metrics(t *testing.T) {
+
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	registry := snail_metrics.NewRegistry()
+	timerFlushed := make(chan struct{}, 10)
+	batcher := NewSnailBatcherWithOpts[int](
+		3,
+		30,
+		20*time.Millisecond,
+		func(values []int) error {
+			if len(values) == 1 && values[0] == 7 {
+				timerFlushed <- struct{}{}
+			}
+			return nil
+		},
+		&SnailBatcherOpts[int]{Metrics: registry, Name: "test"},
+	)
+
+	batcher.AddMany([]int{1, 2, 3, 4, 5, 6}) // 2 full batches
+	batcher.Add(7)
+
+	select {
+	case <-timerFlushed:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expected the timer to flush the last item")
+	}
+
+	batcher.Add(8)
+	batcher.Flush()
+	batcher.Add(9)
+	batcher.Close()
+
+	label := snail_metrics.Label{Name: "batcher", Value: "test"}
+	expectValue := func(name string, want float64, labels ...snail_metrics.Label) {
+		got, ok := registry.Value(name, labels...)
+		if !ok || got != want {
+			t.Fatalf("expected %s%v = %v, got %v", name, labels, want, got)
+		}
+	}
+
+	for reason, want := range map[string]float64{"full": 2, "timer": 1, "explicit": 1, "close": 1} {
+		expectValue("snail_batcher_flushes_total", want, label, snail_metrics.Label{Name: "reason", Value: reason})
+	}
+	expectValue("snail_batcher_batch_size_count", 5, label)
+	expectValue("snail_batcher_batch_size_sum", 9, label)
+	expectValue("snail_batcher_queue_wait_seconds_count", 5, label)
+}
+
+func TestNewSnailBatcher_outputPanic(t *testing.T) {
+
+	snail_logging.ConfigureDefaultLogger("text", "error", false)
+
+	var panics []any
+	var failed [][]int
+	calls := 0
+	batcher := NewSnailBatcherWithOpts[int](
+		2,
+		2,
+		1*time.Minute,
+		func(values []int) error {
+			calls++
+			panic("bad batch")
+		},
+		&SnailBatcherOpts[int]{
+			Retry:   RetryPolicy{MaxRetries: 3},
+			OnPanic: func(recovered any, _ []byte) { panics = append(panics, recovered) },
+			OnError: func(batch []int, err error) { failed = append(failed, slices.Clone(batch)) },
+		},
+	)
+
+	batcher.AddMany([]int{1, 2})
+	batcher.Flush()
+
+	// The worker survives, and the batcher is poisoned even with ErrorPolicyContinue
+	deadline := time.Now().Add(1 * time.Second)
+	for batcher.Err() == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected batcher to be poisoned")
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+	if !errors.Is(batcher.Err(), ErrOutputPanic) {
+		t.Fatalf("expected ErrOutputPanic, got %v", batcher.Err())
+	}
+	if err := batcher.Submit(3); !errors.Is(err, ErrOutputPanic) {
+		t.Fatalf("expected Add to fail with ErrOutputPanic, got %v", err)
+	}
+
+	batcher.Close()
+
+	if calls != 1 {
+		t.Fatalf("expected panics not to be retried, got %d calls", calls)
+	}
+	if len(panics) != 1 || panics[0] != "bad batch" {
+		t.Fatalf("expected OnPanic to be called once, got %v", panics)
+	}
+	if len(failed) != 1 || !slices.Equal(failed[0], []int{1, 2}) {
+		t.Fatalf("expected OnError with the failed batch, got %v", failed)
+	}
+}
+
 func prettyInt3Digits(n int64) string {
 	return prettyPrinter.Sprintf("%d", n)
 }
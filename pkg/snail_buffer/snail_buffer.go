@@ -74,6 +74,16 @@ func (b *Buffer) WriteInt8(val int8) {
 	b.buf = append(b.buf, byte(val))
 }
 
+func (b *Buffer) ReadInt8() (int8, error) {
+	if !b.CanRead(1) {
+		return 0, fmt.Errorf("not enough data to read int8")
+	}
+
+	val := int8(b.buf[b.readPos])
+	b.readPos++
+	return val, nil
+}
+
 func (b *Buffer) WriteInt16(val int16) {
 	if b.endian == BigEndian {
 		b.buf = binary.BigEndian.AppendUint16(b.buf, uint16(val))
@@ -213,6 +223,15 @@ func (b *Buffer) Reset() {
 	b.readPosMark = 0
 }
 
+// Truncate discards everything written after the first n bytes, e.g. to undo a partial write.
+// Bytes that have already been read can't be discarded.
+func (b *Buffer) Truncate(n int) {
+	if n < b.readPos || n > len(b.buf) {
+		panic(fmt.Sprintf("invalid truncate length: %d", n))
+	}
+	b.buf = b.buf[:n]
+}
+
 func (b *Buffer) ReadPos() int {
 	return b.readPos
 }
@@ -257,6 +276,18 @@ func (b *Buffer) UnderlyingReadableView() *Buffer {
 	}
 }
 
+// UnderlyingReadableViewN is like UnderlyingReadableView, but limited to the next n readable bytes.
+// The view's capacity is capped, so writing to it never overwrites data after those n bytes.
+func (b *Buffer) UnderlyingReadableViewN(n int) *Buffer {
+	end := b.readPos + n
+	return &Buffer{
+		endian:      b.endian,
+		buf:         b.buf[b.readPos:end:end],
+		readPos:     0,
+		readPosMark: 0,
+	}
+}
+
 func (b *Buffer) WriteInt64(value int64) {
 	if b.endian == BigEndian {
 		b.buf = binary.BigEndian.AppendUint64(b.buf, uint64(value))
@@ -117,6 +117,30 @@ func TestByteBuffer_WriteInt32LittleEndian(t *testing.T) {
 	}
 }
 
+func TestByteBuffer_ReadInt8(t *testing.T) {
+	bb := New(BigEndian, 10)
+	bb.WriteInt8(-2)
+	bb.WriteInt8(0x12)
+	val, err := bb.ReadInt8()
+	if err != nil {
+		t.Errorf("Expected nil, got %v", err)
+	}
+	if val != -2 {
+		t.Errorf("Expected %v, got %v", -2, val)
+	}
+	val, err = bb.ReadInt8()
+	if err != nil {
+		t.Errorf("Expected nil, got %v", err)
+	}
+	if val != 0x12 {
+		t.Errorf("Expected %v, got %v", 0x12, val)
+	}
+	_, err = bb.ReadInt8()
+	if err == nil {
+		t.Errorf("Expected error, got nil")
+	}
+}
+
 func TestByteBuffer_ReadInt16BigEndian(t *testing.T) {
 	bb := New(BigEndian, 10)
 	bb.WriteInt16(0x1234)
@@ -464,3 +488,35 @@ func TestBuffer_EnsureSpareBytes(t *testing.T) {
 	}()
 	writeable[10] = 0x12
 }
+
+func TestBuffer_UnderlyingReadableViewN(t *testing.T) {
+	bb := New(BigEndian, 10)
+	bb.WriteInt16(0x1234)
+	bb.WriteInt16(0x5678)
+	bb.WriteInt16(0x7abc)
+	_, _ = bb.ReadInt16()
+
+	view := bb.UnderlyingReadableViewN(2)
+	if view.NumBytesReadable() != 2 {
+		t.Errorf("Expected %v, got %v", 2, view.NumBytesReadable())
+	}
+
+	val, err := view.ReadInt16()
+	if err != nil {
+		t.Errorf("Expected nil, got %v", err)
+	}
+	if val != 0x5678 {
+		t.Errorf("Expected %v, got %v", 0x5678, val)
+	}
+
+	// writing to the view must not touch the bytes after it
+	view.WriteInt16(0x0000)
+	if bb.ReadPos() != 2 {
+		t.Errorf("Expected %v, got %v", 2, bb.ReadPos())
+	}
+	_, _ = bb.ReadInt16()
+	val, _ = bb.ReadInt16()
+	if val != 0x7abc {
+		t.Errorf("Expected %v, got %v", 0x7abc, val)
+	}
+}
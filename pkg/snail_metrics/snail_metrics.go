@@ -0,0 +1,108 @@
+package snail_metrics
+
+// Metrics is how snail reports what it is doing. Components resolve the counters, gauges and
+// histograms they need once, when they are created, and then only update them, so implementations
+// may do the (slower) lookup work in Counter, Gauge and Histogram.
+//
+// Resolving the same name and labels again must return the same underlying metric, since e.g.
+// every connection of a server reports into the same counters. NewRegistry is the in-memory
+// default, and anything else (Prometheus client, OpenTelemetry, ...) can be plugged in by
+// implementing this interface.
+type Metrics interface {
+	Counter(name string, help string, labels ...Label) Counter
+	Gauge(name string, help string, labels ...Label) Gauge
+	// Histogram resolves a histogram with the given upper bucket bounds, in increasing order
+	Histogram(name string, help string, buckets []float64, labels ...Label) Histogram
+}
+
+// Counter is a value that only goes up
+type Counter interface {
+	Add(delta int64)
+}
+
+// Gauge is a value that goes up and down
+type Gauge interface {
+	Add(delta int64)
+	Set(value int64)
+}
+
+// Histogram counts observations into buckets
+type Histogram interface {
+	Observe(value float64)
+}
+
+// Label is a name/value pair distinguishing metrics with the same name
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Discard is a Metrics that drops everything. It is what components use when no Metrics is configured.
+var Discard Metrics = discard{}
+
+// OrDiscard returns m, or Discard if m is nil
+func OrDiscard(m Metrics) Metrics {
+	if m == nil {
+		return Discard
+	}
+	return m
+}
+
+type discard struct{}
+
+func (discard) Counter(string, string, ...Label) Counter                { return discardMetric{} }
+func (discard) Gauge(string, string, ...Label) Gauge                    { return discardMetric{} }
+func (discard) Histogram(string, string, []float64, ...Label) Histogram { return discardMetric{} }
+
+type discardMetric struct{}
+
+func (discardMetric) Add(int64)       {}
+func (discardMetric) Set(int64)       {}
+func (discardMetric) Observe(float64) {}
+
+// WithLabels returns a Metrics that adds labels to everything resolved through it, e.g. to tell
+// several servers in the same process apart.
+func WithLabels(m Metrics, labels ...Label) Metrics {
+	if m == nil || len(labels) == 0 {
+		return m
+	}
+	return &labeled{inner: m, labels: labels}
+}
+
+type labeled struct {
+	inner  Metrics
+	labels []Label
+}
+
+func (l *labeled) with(labels []Label) []Label {
+	return append(append(make([]Label, 0, len(l.labels)+len(labels)), l.labels...), labels...)
+}
+
+func (l *labeled) Counter(name string, help string, labels ...Label) Counter {
+	return l.inner.Counter(name, help, l.with(labels)...)
+}
+
+func (l *labeled) Gauge(name string, help string, labels ...Label) Gauge {
+	return l.inner.Gauge(name, help, l.with(labels)...)
+}
+
+func (l *labeled) Histogram(name string, help string, buckets []float64, labels ...Label) Histogram {
+	return l.inner.Histogram(name, help, buckets, l.with(labels)...)
+}
+
+// ExponentialBuckets returns count bucket bounds, starting at start and growing by factor
+func ExponentialBuckets(start float64, factor float64, count int) []float64 {
+	res := make([]float64, count)
+	for i := range res {
+		res[i] = start
+		start *= factor
+	}
+	return res
+}
+
+var (
+	// SizeBuckets are the default buckets for sizes, such as the number of items in a batch: 1, 2, 4, ... 65536
+	SizeBuckets = ExponentialBuckets(1, 2, 17)
+	// LatencyBuckets are the default buckets for durations in seconds: 1 µs, 4 µs, 16 µs, ... ~4 s
+	LatencyBuckets = ExponentialBuckets(1e-6, 4, 12)
+)
@@ -0,0 +1,136 @@
+package snail_metrics
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRegistry_WritePrometheus(t *testing.T) {
+
+	registry := NewRegistry()
+	m := WithLabels(registry, Label{Name: "server", Value: "a"})
+
+	m.Counter("snail_test_bytes_total", "Bytes seen").Add(3)
+	m.Counter("snail_test_bytes_total", "Bytes seen").Add(4) // same series again
+	registry.Counter("snail_test_bytes_total", "Bytes seen", Label{Name: "server", Value: `b"\`}).Add(1)
+	gauge := m.Gauge("snail_test_active", "Active things")
+	gauge.Add(5)
+	gauge.Add(-2)
+	histogram := m.Histogram("snail_test_size", "Sizes", []float64{1, 10})
+	histogram.Observe(1)
+	histogram.Observe(5)
+	histogram.Observe(100)
+
+	var sb strings.Builder
+	if err := registry.WritePrometheus(&sb); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := `# HELP snail_test_active Active things
+# TYPE snail_test_active gauge
+snail_test_active{server="a"} 3
+# HELP snail_test_bytes_total Bytes seen
+# TYPE snail_test_bytes_total counter
+snail_test_bytes_total{server="a"} 7
+snail_test_bytes_total{server="b\"\\"} 1
+# HELP snail_test_size Sizes
+# TYPE snail_test_size histogram
+snail_test_size_bucket{server="a",le="1"} 1
+snail_test_size_bucket{server="a",le="10"} 2
+snail_test_size_bucket{server="a",le="+Inf"} 3
+snail_test_size_sum{server="a"} 106
+snail_test_size_count{server="a"} 3
+`
+	if diff := cmp.Diff(expected, sb.String()); diff != "" {
+		t.Fatalf("unexpected output (-want +got):\n%s", diff)
+	}
+}
+
+func TestRegistry_Value(t *testing.T) {
+
+	registry := NewRegistry()
+	registry.Counter("c", "").Add(2)
+	registry.Histogram("h", "", SizeBuckets, Label{Name: "x", Value: "y"}).Observe(4)
+
+	check := func(name string, labels []Label, want float64) {
+		got, ok := registry.Value(name, labels...)
+		if !ok || got != want {
+			t.Fatalf("expected %s = %v, got %v (found: %v)", name, want, got, ok)
+		}
+	}
+	check("c", nil, 2)
+	check("h_count", []Label{{Name: "x", Value: "y"}}, 1)
+	check("h_sum", []Label{{Name: "x", Value: "y"}}, 4)
+
+	if _, ok := registry.Value("h_count"); ok {
+		t.Fatalf("expected no histogram without labels")
+	}
+	if _, ok := registry.Value("missing"); ok {
+		t.Fatalf("expected no value for missing metric")
+	}
+}
+
+func TestRegistry_kindMismatchPanics(t *testing.T) {
+	registry := NewRegistry()
+	registry.Counter("c", "")
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected panic when resolving a counter as a gauge")
+		}
+	}()
+	registry.Gauge("c", "")
+}
+
+func TestRegistry_concurrentUpdates(t *testing.T) {
+
+	registry := NewRegistry()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			counter := registry.Counter("c", "")
+			histogram := registry.Histogram("h", "", LatencyBuckets)
+			for j := 0; j < 1000; j++ {
+				counter.Add(1)
+				histogram.Observe(0.5)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if v, _ := registry.Value("c"); v != 8000 {
+		t.Fatalf("expected 8000, got %v", v)
+	}
+	if v, _ := registry.Value("h_sum"); v != 4000 {
+		t.Fatalf("expected 4000, got %v", v)
+	}
+}
+
+func TestRegistry_Handler(t *testing.T) {
+
+	registry := NewRegistry()
+	registry.Counter("snail_test_total", "").Add(1)
+
+	recorder := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	body, _ := io.ReadAll(recorder.Result().Body)
+	if !strings.Contains(string(body), "snail_test_total 1\n") {
+		t.Fatalf("unexpected body: %s", body)
+	}
+	if ct := recorder.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type: %s", ct)
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	m := OrDiscard(nil)
+	m.Counter("c", "").Add(1)
+	m.Gauge("g", "").Set(1)
+	m.Histogram("h", "", SizeBuckets).Observe(1)
+}
@@ -0,0 +1,257 @@
+package snail_metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Registry is the in-memory Metrics implementation. Updates are lock free atomics.
+// WritePrometheus and Handler expose everything in the Prometheus text format.
+type Registry struct {
+	lock     sync.Mutex
+	families map[string]*family
+}
+
+type metricKind string
+
+const (
+	kindCounter   metricKind = "counter"
+	kindGauge     metricKind = "gauge"
+	kindHistogram metricKind = "histogram"
+)
+
+// family is all series with the same name, which share help text, kind and buckets
+type family struct {
+	name    string
+	help    string
+	kind    metricKind
+	buckets []float64
+	series  map[string]any // by rendered labels, *value or *histogram
+}
+
+// NewRegistry creates an empty in-memory registry
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+type value struct {
+	v atomic.Int64
+}
+
+func (v *value) Add(delta int64) { v.v.Add(delta) }
+func (v *value) Set(value int64) { v.v.Store(value) }
+
+type histogram struct {
+	buckets []float64
+	counts  []atomic.Uint64 // per bucket, not cumulative. The last one is +Inf
+	sum     atomic.Uint64   // float64 bits
+}
+
+func (h *histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.buckets, value) // first bucket with bound >= value
+	h.counts[i].Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+value)) {
+			return
+		}
+	}
+}
+
+func (r *Registry) Counter(name string, help string, labels ...Label) Counter {
+	return r.resolve(name, help, kindCounter, nil, labels).(*value)
+}
+
+func (r *Registry) Gauge(name string, help string, labels ...Label) Gauge {
+	return r.resolve(name, help, kindGauge, nil, labels).(*value)
+}
+
+func (r *Registry) Histogram(name string, help string, buckets []float64, labels ...Label) Histogram {
+	return r.resolve(name, help, kindHistogram, buckets, labels).(*histogram)
+}
+
+// resolve returns the series with the given name and labels, creating it if needed.
+// It panics if the name is already used for another kind of metric.
+func (r *Registry) resolve(name string, help string, kind metricKind, buckets []float64, labels []Label) any {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{name: name, help: help, kind: kind, buckets: buckets, series: make(map[string]any)}
+		r.families[name] = f
+	} else if f.kind != kind {
+		panic(fmt.Sprintf("metric %s is a %s, not a %s", name, f.kind, kind))
+	}
+
+	key := renderLabels(labels)
+	if s, ok := f.series[key]; ok {
+		return s
+	}
+
+	var s any
+	if kind == kindHistogram {
+		s = &histogram{buckets: f.buckets, counts: make([]atomic.Uint64, len(f.buckets)+1)}
+	} else {
+		s = &value{}
+	}
+	f.series[key] = s
+	return s
+}
+
+// Value returns the current value of a counter or gauge, or of a histogram's
+// name_count or name_sum, as they are named in the Prometheus format.
+// The labels must be given in the same order as they were resolved with.
+func (r *Registry) Value(name string, labels ...Label) (float64, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := renderLabels(labels)
+	if f, ok := r.families[name]; ok && f.kind != kindHistogram {
+		if s, ok := f.series[key]; ok {
+			return float64(s.(*value).v.Load()), true
+		}
+		return 0, false
+	}
+
+	if base, ok := strings.CutSuffix(name, "_count"); ok {
+		if h := r.histogramLocked(base, key); h != nil {
+			return float64(h.total()), true
+		}
+	}
+	if base, ok := strings.CutSuffix(name, "_sum"); ok {
+		if h := r.histogramLocked(base, key); h != nil {
+			return math.Float64frombits(h.sum.Load()), true
+		}
+	}
+	return 0, false
+}
+
+func (r *Registry) histogramLocked(name string, key string) *histogram {
+	if f, ok := r.families[name]; ok && f.kind == kindHistogram {
+		if s, ok := f.series[key]; ok {
+			return s.(*histogram)
+		}
+	}
+	return nil
+}
+
+// total returns the number of observations
+func (h *histogram) total() uint64 {
+	var res uint64
+	for i := range h.counts {
+		res += h.counts[i].Load()
+	}
+	return res
+}
+
+// WritePrometheus writes all metrics in the Prometheus text exposition format, sorted by name and labels
+func (r *Registry) WritePrometheus(w io.Writer) error {
+
+	type entry struct {
+		key    string
+		series any
+	}
+
+	// Snapshot what exists, and read the values without holding the lock
+	r.lock.Lock()
+	families := make([]*family, 0, len(r.families))
+	entries := make(map[*family][]entry, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+		for key, s := range f.series {
+			entries[f] = append(entries[f], entry{key: key, series: s})
+		}
+	}
+	r.lock.Unlock()
+
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		if f.help != "" {
+			_, _ = fmt.Fprintf(bw, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		}
+		_, _ = fmt.Fprintf(bw, "# TYPE %s %s\n", f.name, f.kind)
+		es := entries[f]
+		sort.Slice(es, func(i, j int) bool { return es[i].key < es[j].key })
+		for _, e := range es {
+			switch s := e.series.(type) {
+			case *value:
+				_, _ = fmt.Fprintf(bw, "%s%s %d\n", f.name, e.key, s.v.Load())
+			case *histogram:
+				writeHistogram(bw, f.name, e.key, s)
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+func writeHistogram(w io.Writer, name string, key string, h *histogram) {
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i].Load()
+		_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(key, "le", formatFloat(bound)), cumulative)
+	}
+	cumulative += h.counts[len(h.buckets)].Load()
+	_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(key, "le", "+Inf"), cumulative)
+	_, _ = fmt.Fprintf(w, "%s_sum%s %s\n", name, key, formatFloat(math.Float64frombits(h.sum.Load())))
+	_, _ = fmt.Fprintf(w, "%s_count%s %d\n", name, key, cumulative)
+}
+
+// Handler returns an http.Handler serving WritePrometheus, e.g. to mount on /metrics
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := r.WritePrometheus(w); err != nil {
+			slog.Debug(fmt.Sprintf("Failed to write metrics: %v", err))
+		}
+	})
+}
+
+func renderLabels(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, l := range labels {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(l.Name)
+		sb.WriteString(`="`)
+		sb.WriteString(escapeLabelValue(l.Value))
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// withLabel adds one more label to already rendered labels
+func withLabel(key string, name string, value string) string {
+	label := renderLabels([]Label{{Name: name, Value: value}})
+	if key == "" {
+		return label
+	}
+	return key[:len(key)-1] + "," + label[1:]
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabelValue(s string) string { return labelValueEscaper.Replace(s) }
+func escapeHelp(s string) string       { return helpEscaper.Replace(s) }
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
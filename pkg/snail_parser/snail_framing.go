@@ -0,0 +1,253 @@
+package snail_parser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/GiGurra/snail/pkg/snail_buffer"
+	"math"
+)
+
+// Length-prefixed framing wraps any codec so that every value is sent as
+//
+//	[magic (optional)][length][payload written by the inner codec]
+//
+// The inner parser only ever sees complete frames, so it doesn't need to handle NEB.
+// It is expected to consume the whole payload; anything left over is treated as a corrupt stream.
+
+// LengthPrefix is the encoding of the frame length
+type LengthPrefix int
+
+const (
+	LengthPrefix8      LengthPrefix = iota // 1 byte, max 255 bytes payload
+	LengthPrefix16                         // 2 bytes, max 64 KB payload
+	LengthPrefix32                         // 4 bytes
+	LengthPrefixVarint                     // unsigned varint (LEB128), 1-10 bytes. Endian is ignored.
+)
+
+// DefaultMaxFrameSize is the max payload size if FramingOpts.MaxFrameSize is not set,
+// and the prefix can express lengths this large.
+const DefaultMaxFrameSize = 16 * 1024 * 1024
+
+type FramingOpts struct {
+	Prefix LengthPrefix
+	Endian snail_buffer.Endian // byte order of fixed size lengths. Default BigEndian
+	// MaxFrameSize is the max payload size, enforced both when writing and parsing.
+	// Default DefaultMaxFrameSize, capped to what the prefix can express.
+	MaxFrameSize int
+	// Magic, if set, is written before every frame and verified when parsing
+	Magic []byte
+}
+
+func (o FramingOpts) WithDefaults() FramingOpts {
+	limit := o.Prefix.maxLength()
+	if o.MaxFrameSize == 0 {
+		o.MaxFrameSize = DefaultMaxFrameSize
+	}
+	if o.MaxFrameSize > limit {
+		o.MaxFrameSize = limit
+	}
+	return o
+}
+
+func (p LengthPrefix) size() int {
+	switch p {
+	case LengthPrefix8:
+		return 1
+	case LengthPrefix16:
+		return 2
+	case LengthPrefix32:
+		return 4
+	default:
+		panic(fmt.Sprintf("length prefix %d has no fixed size", p))
+	}
+}
+
+func (p LengthPrefix) maxLength() int {
+	switch p {
+	case LengthPrefix8:
+		return math.MaxUint8
+	case LengthPrefix16:
+		return math.MaxUint16
+	case LengthPrefix32:
+		return min(math.MaxUint32, math.MaxInt) // lengths are ints, which are 32 bits on some platforms
+	case LengthPrefixVarint:
+		return math.MaxInt
+	default:
+		panic(fmt.Sprintf("unknown length prefix: %d", p))
+	}
+}
+
+func byteOrder(endian snail_buffer.Endian) binary.ByteOrder {
+	if endian == snail_buffer.LittleEndian {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// NewLengthPrefixedCodec wraps both the parser and the writer of a codec, see NewLengthPrefixedParser
+// and NewLengthPrefixedWriter.
+func NewLengthPrefixedCodec[T any](inner Codec[T], opts FramingOpts) Codec[T] {
+	return Codec[T]{
+		Parser: NewLengthPrefixedParser(inner.Parser, opts),
+		Writer: NewLengthPrefixedWriter(inner.Writer, opts),
+	}
+}
+
+// NewLengthPrefixedParser returns a parser that reads one length-prefixed frame at a time,
+// and parses its payload with the inner parser.
+func NewLengthPrefixedParser[T any](inner ParseFunc[T], optsIn FramingOpts) ParseFunc[T] {
+
+	opts := optsIn.WithDefaults()
+	order := byteOrder(opts.Endian)
+
+	return func(buffer *snail_buffer.Buffer) ParseOneResult[T] {
+
+		var res ParseOneResult[T]
+		readable := buffer.UnderlyingReadable()
+
+		if len(opts.Magic) > 0 {
+			if len(readable) < len(opts.Magic) {
+				res.Status = ParseOneStatusNEB
+				return res
+			}
+			if !bytes.Equal(readable[:len(opts.Magic)], opts.Magic) {
+				res.Err = fmt.Errorf("bad frame magic: %x", readable[:len(opts.Magic)])
+				return res
+			}
+			readable = readable[len(opts.Magic):]
+		}
+
+		var length uint64
+		var headerSize int
+		switch opts.Prefix {
+		case LengthPrefixVarint:
+			length, headerSize = binary.Uvarint(readable)
+			if headerSize == 0 {
+				res.Status = ParseOneStatusNEB
+				return res
+			}
+			if headerSize < 0 {
+				res.Err = fmt.Errorf("frame length varint overflows 64 bits")
+				return res
+			}
+		default:
+			headerSize = opts.Prefix.size()
+			if len(readable) < headerSize {
+				res.Status = ParseOneStatusNEB
+				return res
+			}
+			switch opts.Prefix {
+			case LengthPrefix8:
+				length = uint64(readable[0])
+			case LengthPrefix16:
+				length = uint64(order.Uint16(readable))
+			case LengthPrefix32:
+				length = uint64(order.Uint32(readable))
+			}
+		}
+
+		if length > uint64(opts.MaxFrameSize) {
+			res.Err = fmt.Errorf("frame of %d bytes exceeds max frame size %d", length, opts.MaxFrameSize)
+			return res
+		}
+
+		frameLen := int(length)
+		if len(readable)-headerSize < frameLen {
+			res.Status = ParseOneStatusNEB
+			return res
+		}
+
+		buffer.AdvanceReadPos(len(opts.Magic) + headerSize)
+		frame := buffer.UnderlyingReadableViewN(frameLen)
+		buffer.AdvanceReadPos(frameLen)
+
+		res = inner(frame)
+		if res.Err != nil {
+			return res
+		}
+		if res.Status == ParseOneStatusNEB {
+			res.Err = fmt.Errorf("inner parser needs more than the %d bytes of its frame", frameLen)
+			return res
+		}
+		if left := frame.NumBytesReadable(); left != 0 {
+			res.Err = fmt.Errorf("inner parser left %d of %d frame bytes unread", left, frameLen)
+			return res
+		}
+
+		return res
+	}
+}
+
+// NewLengthPrefixedWriter returns a writer that writes every value as a length-prefixed
+// frame, with the payload written by the inner writer.
+func NewLengthPrefixedWriter[T any](inner WriteFunc[T], optsIn FramingOpts) WriteFunc[T] {
+
+	opts := optsIn.WithDefaults()
+	order := byteOrder(opts.Endian)
+
+	return func(buffer *snail_buffer.Buffer, t T) error {
+
+		// On failure, nothing of the frame is left in the buffer
+		framePos := len(buffer.Underlying())
+		buffer.WriteBytes(opts.Magic)
+
+		// Fixed size lengths are patched in after the payload has been written.
+		// A varint's size depends on the length, so there the payload is shifted instead.
+		lengthPos := len(buffer.Underlying())
+		headerSize := 0
+		if opts.Prefix != LengthPrefixVarint {
+			headerSize = opts.Prefix.size()
+			for i := 0; i < headerSize; i++ {
+				buffer.WriteByteNoE(0)
+			}
+		}
+		payloadPos := lengthPos + headerSize
+
+		if err := inner(buffer, t); err != nil {
+			buffer.Truncate(framePos)
+			return err
+		}
+
+		length := len(buffer.Underlying()) - payloadPos
+		if length > opts.MaxFrameSize {
+			buffer.Truncate(framePos)
+			return fmt.Errorf("frame of %d bytes exceeds max frame size %d", length, opts.MaxFrameSize)
+		}
+
+		switch opts.Prefix {
+		case LengthPrefix8:
+			buffer.Underlying()[lengthPos] = byte(length)
+		case LengthPrefix16:
+			order.PutUint16(buffer.Underlying()[lengthPos:], uint16(length))
+		case LengthPrefix32:
+			order.PutUint32(buffer.Underlying()[lengthPos:], uint32(length))
+		case LengthPrefixVarint:
+			var varint [binary.MaxVarintLen64]byte
+			n := binary.PutUvarint(varint[:], uint64(length))
+			buffer.WriteBytes(varint[:n]) // grow by n, then shift the payload up
+			underlying := buffer.Underlying()
+			copy(underlying[payloadPos+n:], underlying[payloadPos:payloadPos+length])
+			copy(underlying[lengthPos:], varint[:n])
+		}
+
+		return nil
+	}
+}
+
+// NewRawBytesCodec returns a codec that passes payloads through as-is. The parser takes all
+// readable bytes, so it only makes sense inside a framing codec, e.g. NewLengthPrefixedCodec.
+func NewRawBytesCodec() Codec[[]byte] {
+
+	return Codec[[]byte]{
+
+		Parser: func(buffer *snail_buffer.Buffer) ParseOneResult[[]byte] {
+			return ParseOneResult[[]byte]{Value: buffer.ReadAll(), Status: ParseOneStatusOK}
+		},
+
+		Writer: func(buffer *snail_buffer.Buffer, t []byte) error {
+			buffer.WriteBytes(t)
+			return nil
+		},
+	}
+}
@@ -0,0 +1,160 @@
+package snail_parser
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/GiGurra/snail/pkg/snail_buffer"
+	"github.com/google/go-cmp/cmp"
+	"strings"
+	"testing"
+)
+
+func TestLengthPrefixedCodec_roundTrip(t *testing.T) {
+
+	prefixes := []LengthPrefix{LengthPrefix8, LengthPrefix16, LengthPrefix32, LengthPrefixVarint}
+	endians := []snail_buffer.Endian{snail_buffer.BigEndian, snail_buffer.LittleEndian}
+	magics := [][]byte{nil, []byte("SN")}
+
+	values := []testStruct{
+		{Type: 1, Text: ""},
+		{Type: 2, Text: "hello"},
+		{Type: 3, Text: strings.Repeat("x", 200)}, // varint needs 2 bytes for this one
+	}
+
+	for _, prefix := range prefixes {
+		for _, endian := range endians {
+			for _, magic := range magics {
+				t.Run(fmt.Sprintf("prefix=%d,endian=%d,magic=%s", prefix, endian, magic), func(t *testing.T) {
+
+					codec := NewLengthPrefixedCodec(
+						NewJsonLinesCodec[testStruct](),
+						FramingOpts{Prefix: prefix, Endian: endian, Magic: magic},
+					)
+
+					buffer := snail_buffer.New(snail_buffer.BigEndian, 1024)
+					for _, v := range values {
+						if err := codec.Writer(buffer, v); err != nil {
+							t.Fatalf("unexpected error: %v", err)
+						}
+					}
+
+					// Feed the stream byte for byte, to exercise NEB handling at every position
+					all := buffer.ReadAll()
+					stream := snail_buffer.New(snail_buffer.BigEndian, 1024)
+					var results []testStruct
+					for _, b := range all {
+						stream.WriteByteNoE(b)
+						parsed, err := ParseAll(stream, codec.Parser)
+						if err != nil {
+							t.Fatalf("unexpected error: %v", err)
+						}
+						results = append(results, parsed...)
+					}
+
+					if diff := cmp.Diff(values, results); diff != "" {
+						t.Fatalf("unexpected results (-want +got):\n%s", diff)
+					}
+					if stream.NumBytesReadable() != 0 {
+						t.Fatalf("expected 0 bytes readable, got %v", stream.NumBytesReadable())
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestLengthPrefixedCodec_wireFormat(t *testing.T) {
+
+	codec := NewLengthPrefixedCodec(NewRawBytesCodec(), FramingOpts{
+		Prefix: LengthPrefix16,
+		Endian: snail_buffer.LittleEndian,
+		Magic:  []byte{0xCA},
+	})
+
+	buffer := snail_buffer.New(snail_buffer.BigEndian, 1024)
+	if err := codec.Writer(buffer, []byte{1, 2, 3}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if diff := cmp.Diff([]byte{0xCA, 3, 0, 1, 2, 3}, buffer.Underlying()); diff != "" {
+		t.Fatalf("unexpected wire format (-want +got):\n%s", diff)
+	}
+}
+
+func TestLengthPrefixedCodec_errors(t *testing.T) {
+
+	t.Run("max frame size when writing", func(t *testing.T) {
+		codec := NewLengthPrefixedCodec(NewRawBytesCodec(), FramingOpts{Prefix: LengthPrefixVarint, MaxFrameSize: 4, Magic: []byte("SN")})
+		buffer := snail_buffer.New(snail_buffer.BigEndian, 1024)
+		if err := codec.Writer(buffer, []byte{1}); err != nil {
+			t.Fatalf("error writing frame: %v", err)
+		}
+		if err := codec.Writer(buffer, []byte{1, 2, 3, 4, 5}); err == nil {
+			t.Fatalf("expected error for too large frame")
+		}
+		if !bytes.Equal(buffer.Underlying(), []byte{'S', 'N', 1, 1}) {
+			t.Fatalf("expected only the first frame in the buffer, got %v", buffer.Underlying())
+		}
+	})
+
+	t.Run("inner writer error", func(t *testing.T) {
+		writer := NewLengthPrefixedWriter(func(buffer *snail_buffer.Buffer, v int32) error {
+			buffer.WriteInt32(v)
+			return fmt.Errorf("failed after writing")
+		}, FramingOpts{Prefix: LengthPrefix32})
+		buffer := snail_buffer.New(snail_buffer.BigEndian, 1024)
+		if err := writer(buffer, 42); err == nil {
+			t.Fatalf("expected the inner writer's error")
+		}
+		if len(buffer.Underlying()) != 0 {
+			t.Fatalf("expected nothing left of the failed frame, got %v", buffer.Underlying())
+		}
+	})
+
+	t.Run("max frame size when parsing", func(t *testing.T) {
+		codec := NewLengthPrefixedCodec(NewRawBytesCodec(), FramingOpts{Prefix: LengthPrefix32, MaxFrameSize: 4})
+		buffer := snail_buffer.New(snail_buffer.BigEndian, 1024)
+		buffer.WriteInt32(1_000_000) // reject right away, without waiting for the payload
+		if _, err := ParseAll(buffer, codec.Parser); err == nil {
+			t.Fatalf("expected error for too large frame")
+		}
+	})
+
+	t.Run("prefix limit", func(t *testing.T) {
+		codec := NewLengthPrefixedCodec(NewRawBytesCodec(), FramingOpts{Prefix: LengthPrefix8})
+		buffer := snail_buffer.New(snail_buffer.BigEndian, 1024)
+		if err := codec.Writer(buffer, make([]byte, 256)); err == nil {
+			t.Fatalf("expected error for frame larger than the prefix can express")
+		}
+	})
+
+	t.Run("bad magic", func(t *testing.T) {
+		codec := NewLengthPrefixedCodec(NewRawBytesCodec(), FramingOpts{Prefix: LengthPrefix8, Magic: []byte("SN")})
+		buffer := snail_buffer.New(snail_buffer.BigEndian, 1024)
+		buffer.WriteBytes([]byte{'X', 'X', 1, 42})
+		if _, err := ParseAll(buffer, codec.Parser); err == nil {
+			t.Fatalf("expected error for bad magic")
+		}
+	})
+
+	t.Run("inner parser leaves bytes", func(t *testing.T) {
+		parser := NewLengthPrefixedParser(NewInt32Codec().Parser, FramingOpts{Prefix: LengthPrefix8})
+		buffer := snail_buffer.New(snail_buffer.BigEndian, 1024)
+		buffer.WriteByteNoE(6)
+		buffer.WriteInt32(42)
+		buffer.WriteInt16(0)
+		if _, err := ParseAll(buffer, parser); err == nil {
+			t.Fatalf("expected error for unread frame bytes")
+		}
+	})
+
+	t.Run("inner parser needs more", func(t *testing.T) {
+		parser := NewLengthPrefixedParser(NewInt32Codec().Parser, FramingOpts{Prefix: LengthPrefix8})
+		buffer := snail_buffer.New(snail_buffer.BigEndian, 1024)
+		buffer.WriteByteNoE(2)
+		buffer.WriteInt16(0)
+		if _, err := ParseAll(buffer, parser); err == nil {
+			t.Fatalf("expected error for truncated frame")
+		}
+	})
+}
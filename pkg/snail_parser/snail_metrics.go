@@ -0,0 +1,52 @@
+package snail_parser
+
+import (
+	"github.com/GiGurra/snail/pkg/snail_buffer"
+	"github.com/GiGurra/snail/pkg/snail_metrics"
+)
+
+// InstrumentCodec wraps both the parser and the writer of a codec, see InstrumentParser and InstrumentWriter
+func InstrumentCodec[T any](codec Codec[T], name string, metrics snail_metrics.Metrics) Codec[T] {
+	return Codec[T]{
+		Parser: InstrumentParser(codec.Parser, name, metrics),
+		Writer: InstrumentWriter(codec.Writer, name, metrics),
+	}
+}
+
+// InstrumentParser counts the messages parsed and the parse errors, i.e. the corrupt streams
+// that make ParseAll fail, labeled with codec=name
+func InstrumentParser[T any](parser ParseFunc[T], name string, metrics snail_metrics.Metrics) ParseFunc[T] {
+
+	metrics = snail_metrics.OrDiscard(metrics)
+	label := snail_metrics.Label{Name: "codec", Value: name}
+	parsed := metrics.Counter("snail_codec_messages_parsed_total", "Messages parsed", label)
+	parseErrors := metrics.Counter("snail_codec_parse_errors_total", "Parse errors, each one a corrupt stream", label)
+
+	return func(buffer *snail_buffer.Buffer) ParseOneResult[T] {
+		res := parser(buffer)
+		if res.Err != nil {
+			parseErrors.Add(1)
+		} else if res.Status == ParseOneStatusOK {
+			parsed.Add(1)
+		}
+		return res
+	}
+}
+
+// InstrumentWriter counts the messages written and the write errors, labeled with codec=name
+func InstrumentWriter[T any](writer WriteFunc[T], name string, metrics snail_metrics.Metrics) WriteFunc[T] {
+
+	metrics = snail_metrics.OrDiscard(metrics)
+	label := snail_metrics.Label{Name: "codec", Value: name}
+	written := metrics.Counter("snail_codec_messages_written_total", "Messages written", label)
+	writeErrors := metrics.Counter("snail_codec_write_errors_total", "Write errors", label)
+
+	return func(buffer *snail_buffer.Buffer, t T) error {
+		if err := writer(buffer, t); err != nil {
+			writeErrors.Add(1)
+			return err
+		}
+		written.Add(1)
+		return nil
+	}
+}
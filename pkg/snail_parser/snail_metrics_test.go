@@ -0,0 +1,49 @@
+package snail_parser
+
+import (
+	"github.com/GiGurra/snail/pkg/snail_buffer"
+	"github.com/GiGurra/snail/pkg/snail_metrics"
+	"testing"
+)
+
+func TestInstrumentCodec(t *testing.T) {
+
+	registry := snail_metrics.NewRegistry()
+	codec := InstrumentCodec(
+		NewLengthPrefixedCodec(NewRawBytesCodec(), FramingOpts{Prefix: LengthPrefix8, MaxFrameSize: 4}),
+		"raw",
+		registry,
+	)
+
+	buffer := snail_buffer.New(snail_buffer.BigEndian, 1024)
+	for _, v := range [][]byte{{1}, {2, 3}} {
+		if err := codec.Writer(buffer, v); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := codec.Writer(snail_buffer.New(snail_buffer.BigEndian, 1024), []byte{1, 2, 3, 4, 5}); err == nil {
+		t.Fatalf("expected error for too large frame")
+	}
+
+	results, err := ParseAll(buffer, codec.Parser)
+	if err != nil || len(results) != 2 {
+		t.Fatalf("expected 2 results and no error, got %v, %v", results, err)
+	}
+
+	buffer.WriteBytes([]byte{100})
+	if _, err := ParseAll(buffer, codec.Parser); err == nil {
+		t.Fatalf("expected error for too large frame")
+	}
+
+	label := snail_metrics.Label{Name: "codec", Value: "raw"}
+	for name, want := range map[string]float64{
+		"snail_codec_messages_written_total": 2,
+		"snail_codec_write_errors_total":     1,
+		"snail_codec_messages_parsed_total":  2,
+		"snail_codec_parse_errors_total":     1,
+	} {
+		if got, _ := registry.Value(name, label); got != want {
+			t.Fatalf("expected %s = %v, got %v", name, want, got)
+		}
+	}
+}
@@ -51,3 +51,26 @@ func ParseAll[T any](
 		}
 	}
 }
+
+// Encode writes one value with the codec's writer, and returns the bytes, e.g. to use as a payload
+func Encode[T any](codec Codec[T], value T) ([]byte, error) {
+	buffer := snail_buffer.New(snail_buffer.BigEndian, 256)
+	if err := codec.Writer(buffer, value); err != nil {
+		return nil, fmt.Errorf("failed to encode: %w", err)
+	}
+	return buffer.Underlying(), nil
+}
+
+// Decode parses one value from bytes written by Encode
+func Decode[T any](codec Codec[T], bytes []byte) (T, error) {
+	buffer := snail_buffer.New(snail_buffer.BigEndian, len(bytes))
+	buffer.WriteBytes(bytes)
+	res := codec.Parser(buffer)
+	if res.Err != nil {
+		return res.Value, fmt.Errorf("failed to decode: %w", res.Err)
+	}
+	if res.Status != ParseOneStatusOK {
+		return res.Value, fmt.Errorf("failed to decode: incomplete value of %d bytes", len(bytes))
+	}
+	return res.Value, nil
+}
@@ -1048,3 +1048,21 @@ func parseOne[T any](
 ) ParseOneResult[T] {
 	return parseFunc(buffer)
 }
+
+func TestEncodeDecode(t *testing.T) {
+	codec := NewJsonLinesCodec[map[string]int]()
+	bytes, err := Encode(codec, map[string]int{"a": 1})
+	if err != nil {
+		t.Fatalf("error encoding: %v", err)
+	}
+	value, err := Decode(codec, bytes)
+	if err != nil {
+		t.Fatalf("error decoding: %v", err)
+	}
+	if value["a"] != 1 {
+		t.Fatalf("expected a=1, got %v", value)
+	}
+	if _, err := Decode(codec, bytes[:len(bytes)-1]); err == nil {
+		t.Fatalf("expected an error decoding an incomplete value")
+	}
+}
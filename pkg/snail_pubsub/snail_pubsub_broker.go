@@ -0,0 +1,309 @@
+package snail_pubsub
+
+import (
+	"context"
+	"fmt"
+	"github.com/GiGurra/snail/pkg/snail_metrics"
+	"github.com/GiGurra/snail/pkg/snail_tcp"
+	"github.com/GiGurra/snail/pkg/snail_tcp_reqrep"
+	"github.com/samber/lo"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// SlowSubscriberPolicy decides what the broker does when a subscriber's queue is full,
+// because it reads messages slower than they are published
+type SlowSubscriberPolicy int
+
+const (
+	// DropMessages drops the messages that don't fit in the subscriber's queue
+	DropMessages SlowSubscriberPolicy = iota
+	// DisconnectSlow closes the subscriber's connection, dropping what is still queued for it
+	DisconnectSlow
+	// BlockPublishers makes publishers wait until there is room in the queue. Since publishes are
+	// handled on the publisher's read loop, TCP flow control then pushes back on the publisher.
+	// One slow subscriber slows down everyone publishing to it.
+	BlockPublishers
+)
+
+// DefaultSubscriberQueueSize is the default of BrokerOpts.SubscriberQueueSize
+const DefaultSubscriberQueueSize = 1024
+
+type BrokerOpts struct {
+	// Batcher batches the messages to each subscriber. Default snail_tcp_reqrep.NewBatcherOpts(256)
+	Batcher snail_tcp_reqrep.BatcherOpts
+	// SubscriberQueueSize is how many messages may wait for each subscriber connection, on top of
+	// what its batcher holds, before SlowSubscribers applies. Default 1024
+	SubscriberQueueSize int
+	// SlowSubscribers decides what happens when a subscriber's queue is full. Default DropMessages
+	SlowSubscribers SlowSubscriberPolicy
+	// Metrics, if set, receives snail_pubsub_published_total, snail_pubsub_delivered_total,
+	// snail_pubsub_dropped_total, snail_pubsub_slow_disconnects_total and snail_pubsub_subscriptions
+	Metrics snail_metrics.Metrics
+}
+
+func (o BrokerOpts) WithDefaults() BrokerOpts {
+	if !o.Batcher.IsEnabled() {
+		o.Batcher = snail_tcp_reqrep.NewBatcherOpts(256)
+	}
+	o.Batcher = o.Batcher.WithDefaults()
+	if o.SubscriberQueueSize == 0 {
+		o.SubscriberQueueSize = DefaultSubscriberQueueSize
+	}
+	return o
+}
+
+func (o BrokerOpts) validate() {
+	if o.SubscriberQueueSize < 0 {
+		panic(fmt.Sprintf("SubscriberQueueSize must be >= 0, got %d", o.SubscriberQueueSize))
+	}
+}
+
+// Broker is a publish/subscribe server. Clients subscribe to topic patterns, and every message
+// published on a topic is sent to all subscriptions matching it. See snail_pubsub_topic.go for
+// the wildcards.
+type Broker struct {
+	server  *snail_tcp_reqrep.SnailServer[Frame, Frame]
+	opts    BrokerOpts
+	metrics brokerMetrics
+
+	lock  sync.RWMutex
+	index *topicIndex[subscription]
+}
+
+// subscription is one subscription of one subscriber
+type subscription struct {
+	subscriber *subscriber
+	sid        int64
+}
+
+// subscriber is the broker's side of one client connection
+type subscriber struct {
+	session      *snail_tcp_reqrep.Session[Frame]
+	queue        chan Frame    // never closed, so publishers can't send on a closed channel
+	closed       chan struct{} // closed when the connection closes
+	patterns     map[int64]string
+	disconnected atomic.Bool
+}
+
+type brokerMetrics struct {
+	published      snail_metrics.Counter
+	delivered      snail_metrics.Counter
+	dropped        snail_metrics.Counter
+	slowDisconnect snail_metrics.Counter
+	subscriptions  snail_metrics.Gauge
+}
+
+func newBrokerMetrics(m snail_metrics.Metrics) brokerMetrics {
+	m = snail_metrics.OrDiscard(m)
+	return brokerMetrics{
+		published:      m.Counter("snail_pubsub_published_total", "Messages published to the broker"),
+		delivered:      m.Counter("snail_pubsub_delivered_total", "Messages queued for matching subscriptions"),
+		dropped:        m.Counter("snail_pubsub_dropped_total", "Messages dropped because a subscriber was too slow"),
+		slowDisconnect: m.Counter("snail_pubsub_slow_disconnects_total", "Subscribers disconnected for being too slow"),
+		subscriptions:  m.Gauge("snail_pubsub_subscriptions", "Current subscriptions"),
+	}
+}
+
+func NewBroker(tcpOpts *snail_tcp.SnailServerOpts, opts *BrokerOpts) (*Broker, error) {
+
+	if opts == nil {
+		opts = &BrokerOpts{}
+	}
+	opts = lo.ToPtr(opts.WithDefaults())
+	opts.validate()
+
+	res := &Broker{
+		opts:    *opts,
+		metrics: newBrokerMetrics(opts.Metrics),
+		index:   newTopicIndex[subscription](),
+	}
+
+	codec := NewFrameCodec()
+	server, err := snail_tcp_reqrep.NewServer[Frame, Frame](
+		nil,
+		tcpOpts,
+		codec.Parser,
+		codec.Writer,
+		&snail_tcp_reqrep.SnailServerOpts[Frame, Frame]{
+			Batcher:           opts.Batcher,
+			Envelope:          true,
+			NewSessionHandler: res.newSessionHandler,
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create broker server: %w", err)
+	}
+	res.server = server
+
+	return res, nil
+}
+
+func (b *Broker) Underlying() *snail_tcp_reqrep.SnailServer[Frame, Frame] {
+	return b.server
+}
+
+func (b *Broker) Port() int {
+	return b.server.Port()
+}
+
+func (b *Broker) Addr() net.Addr {
+	return b.server.Addr()
+}
+
+func (b *Broker) Close() {
+	b.server.Close()
+}
+
+// Shutdown gracefully shuts down the broker, see snail_tcp_reqrep.SnailServer.Shutdown
+func (b *Broker) Shutdown(ctx context.Context) error {
+	return b.server.Shutdown(ctx)
+}
+
+// Publish publishes a message from the broker itself, as if a client had published it
+func (b *Broker) Publish(topic string, payload []byte) error {
+	if err := ValidateTopic(topic); err != nil {
+		return fmt.Errorf("invalid topic: %w", err)
+	}
+	b.publish(topic, payload)
+	return nil
+}
+
+func (b *Broker) publish(topic string, payload []byte) {
+	b.metrics.published.Add(1)
+
+	// Collect the targets first, so that blocking on a slow subscriber doesn't hold the lock
+	var targets []subscription
+	b.lock.RLock()
+	b.index.match(topic, func(sub subscription) { targets = append(targets, sub) })
+	b.lock.RUnlock()
+
+	for _, target := range targets {
+		b.deliver(target, Frame{Kind: FrameKindMessage, Sid: target.sid, Topic: topic, Payload: payload})
+	}
+}
+
+func (b *Broker) deliver(target subscription, msg Frame) {
+	sub := target.subscriber
+	if b.opts.SlowSubscribers == BlockPublishers {
+		select {
+		case sub.queue <- msg:
+			b.metrics.delivered.Add(1)
+		case <-sub.closed:
+		}
+		return
+	}
+
+	select {
+	case sub.queue <- msg:
+		b.metrics.delivered.Add(1)
+		return
+	default:
+	}
+
+	b.metrics.dropped.Add(1)
+	if b.opts.SlowSubscribers == DisconnectSlow && sub.disconnected.CompareAndSwap(false, true) {
+		slog.Warn(
+			"Disconnecting slow subscriber",
+			slog.String("remote_addr", sub.session.RemoteAddr().String()),
+			slog.Int("queue_size", cap(sub.queue)),
+		)
+		b.metrics.slowDisconnect.Add(1)
+		_ = sub.session.Close()
+	}
+}
+
+func (b *Broker) newSessionHandler(session *snail_tcp_reqrep.Session[Frame]) snail_tcp_reqrep.ServerConnHandler[Frame, Frame] {
+
+	sub := &subscriber{
+		session:  session,
+		queue:    make(chan Frame, b.opts.SubscriberQueueSize),
+		closed:   make(chan struct{}),
+		patterns: make(map[int64]string),
+	}
+	go sub.loopWrites()
+
+	return func(req Frame, repFunc func(resp Frame) error) error {
+
+		if repFunc == nil {
+			b.unsubscribeAll(sub)
+			close(sub.closed)
+			return nil
+		}
+
+		switch req.Kind {
+		case FrameKindPublish:
+			if err := ValidateTopic(req.Topic); err != nil {
+				return fmt.Errorf("invalid topic: %w", err)
+			}
+			b.publish(req.Topic, req.Payload)
+			return nil
+		case FrameKindSubscribe:
+			if err := ValidatePattern(req.Topic); err != nil {
+				return fmt.Errorf("invalid pattern: %w", err)
+			}
+			b.subscribe(sub, req.Sid, req.Topic)
+			return repFunc(Frame{Kind: FrameKindAck, Sid: req.Sid})
+		case FrameKindUnsubscribe:
+			b.unsubscribe(sub, req.Sid)
+			return repFunc(Frame{Kind: FrameKindAck, Sid: req.Sid})
+		default:
+			return fmt.Errorf("unexpected frame kind from client: %d", req.Kind)
+		}
+	}
+}
+
+// subscribe adds a subscription, replacing any previous one with the same sid
+func (b *Broker) subscribe(sub *subscriber, sid int64, pattern string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if old, ok := sub.patterns[sid]; ok {
+		b.index.remove(old, subscription{subscriber: sub, sid: sid})
+	} else {
+		b.metrics.subscriptions.Add(1)
+	}
+	sub.patterns[sid] = pattern
+	b.index.add(pattern, subscription{subscriber: sub, sid: sid})
+}
+
+func (b *Broker) unsubscribe(sub *subscriber, sid int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.unsubscribeLocked(sub, sid)
+}
+
+func (b *Broker) unsubscribeAll(sub *subscriber) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for sid := range sub.patterns {
+		b.unsubscribeLocked(sub, sid)
+	}
+}
+
+func (b *Broker) unsubscribeLocked(sub *subscriber, sid int64) {
+	pattern, ok := sub.patterns[sid]
+	if !ok {
+		return
+	}
+	delete(sub.patterns, sid)
+	b.index.remove(pattern, subscription{subscriber: sub, sid: sid})
+	b.metrics.subscriptions.Add(-1)
+}
+
+// loopWrites passes queued messages on to the connection's batcher, until the connection closes
+func (s *subscriber) loopWrites() {
+	for {
+		select {
+		case msg := <-s.queue:
+			if err := s.session.Push(msg); err != nil {
+				slog.Debug(fmt.Sprintf("Failed to send message to subscriber, closing connection: %v", err))
+				_ = s.session.Close()
+				return
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
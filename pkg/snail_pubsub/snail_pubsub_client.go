@@ -0,0 +1,222 @@
+package snail_pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/GiGurra/snail/pkg/snail_tcp"
+	"github.com/GiGurra/snail/pkg/snail_tcp_reqrep"
+	"github.com/samber/lo"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrSubscriptionClosed is returned when unsubscribing twice, or after the client has disconnected
+var ErrSubscriptionClosed = errors.New("snail subscription closed")
+
+type ClientOpts struct {
+	// Batcher batches outgoing publishes. Default disabled, i.e. each Publish is written right away
+	Batcher snail_tcp_reqrep.BatcherOpts
+}
+
+func (o ClientOpts) WithDefaults() ClientOpts {
+	o.Batcher = o.Batcher.WithDefaults()
+	return o
+}
+
+// Client publishes to and subscribes on a Broker. Subscriptions don't survive losing the
+// connection. When it is lost, all subscriptions are closed.
+type Client struct {
+	underlying *snail_tcp_reqrep.SnailClient[Frame, Frame]
+	nextSid    atomic.Int64
+
+	lock sync.Mutex
+	subs map[int64]*Subscription
+}
+
+// Subscription is an active subscription to a topic pattern
+type Subscription struct {
+	client  *Client
+	sid     int64
+	pattern string
+	handler func(topic string, payload []byte)
+	onClose func()        // optional, called once the subscription ends
+	dropped *atomic.Int64 // messages SubscribeChan dropped, nil for handlers
+	closed  sync.Once
+}
+
+func NewClient(
+	ip string,
+	port int,
+	tcpOpts *snail_tcp.SnailClientOpts,
+	opts *ClientOpts,
+) (*Client, error) {
+
+	if opts == nil {
+		opts = &ClientOpts{}
+	}
+	opts = lo.ToPtr(opts.WithDefaults())
+
+	res := &Client{subs: make(map[int64]*Subscription)}
+
+	codec := NewFrameCodec()
+	underlying, err := snail_tcp_reqrep.NewClientWithOpts[Frame, Frame](
+		ip,
+		port,
+		tcpOpts,
+		res.handleFrame,
+		codec.Writer,
+		codec.Parser,
+		&snail_tcp_reqrep.SnailClientOpts[Frame, Frame]{
+			Batcher:  opts.Batcher,
+			Envelope: true,
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pubsub client: %w", err)
+	}
+	res.underlying = underlying
+
+	return res, nil
+}
+
+func (c *Client) Underlying() *snail_tcp_reqrep.SnailClient[Frame, Frame] {
+	return c.underlying
+}
+
+// Close closes the connection, which ends all subscriptions
+func (c *Client) Close() {
+	c.underlying.Close()
+	c.closeAll()
+}
+
+// Publish publishes payload on topic. It doesn't wait for the broker, so if the connection
+// is lost, messages published right before may be lost too.
+func (c *Client) Publish(topic string, payload []byte) error {
+	if err := ValidateTopic(topic); err != nil {
+		return fmt.Errorf("invalid topic: %w", err)
+	}
+	if err := c.underlying.Send(Frame{Kind: FrameKindPublish, Topic: topic, Payload: payload}); err != nil {
+		return fmt.Errorf("failed to publish: %w", err)
+	}
+	return nil
+}
+
+// Subscribe subscribes to the topics matching pattern, and returns once the broker has confirmed
+// it. The handler is called for each message, on the client's read loop, so it should be quick.
+// Waiting for the broker from the handler, e.g. by calling Subscribe, deadlocks the client.
+func (c *Client) Subscribe(ctx context.Context, pattern string, handler func(topic string, payload []byte)) (*Subscription, error) {
+	return c.subscribe(ctx, pattern, handler, nil)
+}
+
+func (c *Client) subscribe(
+	ctx context.Context,
+	pattern string,
+	handler func(topic string, payload []byte),
+	onClose func(),
+) (*Subscription, error) {
+	if err := ValidatePattern(pattern); err != nil {
+		return nil, fmt.Errorf("invalid pattern: %w", err)
+	}
+
+	sub := &Subscription{client: c, sid: c.nextSid.Add(1), pattern: pattern, handler: handler, onClose: onClose}
+
+	// Registered before asking the broker, since messages may arrive before the ack
+	c.lock.Lock()
+	c.subs[sub.sid] = sub
+	c.lock.Unlock()
+
+	if _, err := c.underlying.Call(ctx, Frame{Kind: FrameKindSubscribe, Sid: sub.sid, Topic: pattern}); err != nil {
+		c.remove(sub)
+		return nil, fmt.Errorf("failed to subscribe: %w", err)
+	}
+
+	return sub, nil
+}
+
+// Pattern returns the topic pattern subscribed to
+func (s *Subscription) Pattern() string {
+	return s.pattern
+}
+
+// Unsubscribe ends the subscription. Messages still on their way are dropped. It doesn't wait
+// for the broker, so it is safe to call from the handler.
+func (s *Subscription) Unsubscribe() error {
+	if !s.client.remove(s) {
+		return ErrSubscriptionClosed
+	}
+	// Sent as a call, so that the broker's ack is matched to it, but not awaited
+	ack := s.client.underlying.CallAsync(Frame{Kind: FrameKindUnsubscribe, Sid: s.sid})
+	select {
+	case <-ack.Done():
+		if _, err := ack.Get(); err != nil {
+			return fmt.Errorf("failed to unsubscribe: %w", err)
+		}
+	default:
+	}
+	return nil
+}
+
+// Dropped returns the number of messages dropped because the channel of a SubscribeChan was
+// full. It is always 0 for subscriptions with a handler.
+func (s *Subscription) Dropped() int64 {
+	if s.dropped == nil {
+		return 0
+	}
+	return s.dropped.Load()
+}
+
+func (s *Subscription) close() {
+	s.closed.Do(func() {
+		if s.onClose != nil {
+			s.onClose()
+		}
+	})
+}
+
+// remove removes and closes a subscription, and returns false if it was already removed
+func (c *Client) remove(sub *Subscription) bool {
+	c.lock.Lock()
+	_, ok := c.subs[sub.sid]
+	delete(c.subs, sub.sid)
+	c.lock.Unlock()
+	sub.close()
+	return ok
+}
+
+func (c *Client) closeAll() {
+	c.lock.Lock()
+	subs := c.subs
+	c.subs = make(map[int64]*Subscription)
+	c.lock.Unlock()
+	for _, sub := range subs {
+		sub.close()
+	}
+}
+
+// handleFrame is the response handler of the underlying client, which gets all frames
+// that aren't acks of calls, i.e. the messages, and the acks of calls given up on
+func (c *Client) handleFrame(frame Frame, status snail_tcp_reqrep.ClientStatus) error {
+	if status == snail_tcp_reqrep.ClientStatusDisconnected {
+		c.closeAll()
+		return nil
+	}
+	if frame.Kind == FrameKindAck {
+		return nil // e.g. a Subscribe whose context was done before the broker answered
+	}
+	if frame.Kind != FrameKindMessage {
+		return fmt.Errorf("unexpected frame kind from broker: %d", frame.Kind)
+	}
+
+	c.lock.Lock()
+	sub, ok := c.subs[frame.Sid]
+	c.lock.Unlock()
+	if !ok {
+		slog.Debug(fmt.Sprintf("Dropping message for ended subscription %d", frame.Sid))
+		return nil
+	}
+
+	sub.handler(frame.Topic, frame.Payload)
+	return nil
+}
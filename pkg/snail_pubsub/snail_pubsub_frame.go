@@ -0,0 +1,101 @@
+package snail_pubsub
+
+import (
+	"fmt"
+	"github.com/GiGurra/snail/pkg/snail_buffer"
+	"github.com/GiGurra/snail/pkg/snail_parser"
+	"math"
+)
+
+// FrameKind tells what a Frame is for
+type FrameKind int8
+
+const (
+	// FrameKindSubscribe subscribes the client to Topic, which may contain wildcards, as subscription Sid
+	FrameKindSubscribe FrameKind = iota + 1
+	// FrameKindUnsubscribe ends subscription Sid
+	FrameKindUnsubscribe
+	// FrameKindPublish publishes Payload on Topic
+	FrameKindPublish
+	// FrameKindMessage delivers Payload, published on Topic, to subscription Sid
+	FrameKindMessage
+	// FrameKindAck confirms a subscribe or unsubscribe
+	FrameKindAck
+)
+
+// Frame is what clients and the broker send each other. Clients send subscribe, unsubscribe and
+// publish frames, and the broker sends message and ack frames.
+type Frame struct {
+	Kind    FrameKind
+	Sid     int64 // subscription id, chosen by the client. Unused for publish
+	Topic   string
+	Payload []byte
+}
+
+// Size of the fixed part of a frame: kind, sid, topic length and payload length
+const frameHeaderSize = 1 + 8 + 2 + 4
+
+// MaxTopicLength is the longest topic or pattern, in bytes, that fits in a frame
+const MaxTopicLength = math.MaxInt16
+
+// NewFrameCodec returns the codec the broker and clients use on the wire. A frame is its kind,
+// sid, a 16 bit topic length, the topic, a 32 bit payload length and the payload.
+func NewFrameCodec() snail_parser.Codec[Frame] {
+
+	return snail_parser.Codec[Frame]{
+
+		Parser: func(buffer *snail_buffer.Buffer) snail_parser.ParseOneResult[Frame] {
+
+			if buffer.NumBytesReadable() < frameHeaderSize {
+				return snail_parser.ParseOneResult[Frame]{Status: snail_parser.ParseOneStatusNEB}
+			}
+
+			res := snail_parser.ParseOneResult[Frame]{}
+			start := buffer.ReadPos()
+			kind, _ := buffer.ReadInt8()
+			sid, _ := buffer.ReadInt64()
+			topicLength, _ := buffer.ReadInt16()
+			if topicLength < 0 {
+				res.Err = fmt.Errorf("invalid topic length %d", topicLength)
+				return res
+			}
+			if !buffer.CanRead(int(topicLength) + 4) {
+				buffer.SetReadPos(start)
+				res.Status = snail_parser.ParseOneStatusNEB
+				return res
+			}
+			topic, _ := buffer.ReadString(int(topicLength))
+			payloadLength, _ := buffer.ReadInt32()
+			if payloadLength < 0 {
+				res.Err = fmt.Errorf("invalid payload length %d", payloadLength)
+				return res
+			}
+			if !buffer.CanRead(int(payloadLength)) {
+				buffer.SetReadPos(start)
+				res.Status = snail_parser.ParseOneStatusNEB
+				return res
+			}
+			payload, _ := buffer.ReadBytes(int(payloadLength))
+
+			res.Value = Frame{Kind: FrameKind(kind), Sid: sid, Topic: topic, Payload: payload}
+			res.Status = snail_parser.ParseOneStatusOK
+			return res
+		},
+
+		Writer: func(buffer *snail_buffer.Buffer, frame Frame) error {
+			if len(frame.Topic) > MaxTopicLength {
+				return fmt.Errorf("topic too long: %d bytes, max %d", len(frame.Topic), MaxTopicLength)
+			}
+			if len(frame.Payload) > math.MaxInt32 {
+				return fmt.Errorf("payload too large: %d bytes", len(frame.Payload))
+			}
+			buffer.WriteInt8(int8(frame.Kind))
+			buffer.WriteInt64(frame.Sid)
+			buffer.WriteInt16(int16(len(frame.Topic)))
+			buffer.WriteString(frame.Topic)
+			buffer.WriteInt32(int32(len(frame.Payload)))
+			buffer.WriteBytes(frame.Payload)
+			return nil
+		},
+	}
+}
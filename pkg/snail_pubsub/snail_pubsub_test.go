@@ -0,0 +1,338 @@
+package snail_pubsub
+
+import (
+	"github.com/GiGurra/snail/pkg/snail_logging"
+	"github.com/GiGurra/snail/pkg/snail_metrics"
+	"github.com/GiGurra/snail/pkg/snail_parser"
+	"github.com/GiGurra/snail/pkg/snail_tcp_reqrep"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type order struct {
+	Id     int    `json:"id"`
+	Region string `json:"region"`
+}
+
+func newTestBroker(t *testing.T, opts *BrokerOpts) *Broker {
+	t.Helper()
+	broker, err := NewBroker(nil, opts)
+	if err != nil {
+		t.Fatalf("error creating broker: %v", err)
+	}
+	t.Cleanup(broker.Close)
+	return broker
+}
+
+func newTestClient(t *testing.T, broker *Broker) *Client {
+	t.Helper()
+	client, err := NewClient("localhost", broker.Port(), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	t.Cleanup(client.Close)
+	return client
+}
+
+func awaitMessage[T any](t *testing.T, ch <-chan Message[T]) Message[T] {
+	t.Helper()
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			t.Fatalf("expected a message, but the channel was closed")
+		}
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for message")
+		panic("unreachable")
+	}
+}
+
+func awaitClosed[T any](t *testing.T, ch <-chan Message[T]) {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("timeout waiting for the channel to close")
+		}
+	}
+}
+
+func TestPubSub_wildcardsAndTypedDelivery(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	broker := newTestBroker(t, nil)
+	publisher := NewTyped(newTestClient(t, broker), snail_parser.NewJsonLinesCodec[order]())
+	subscriber := NewTyped(newTestClient(t, broker), snail_parser.NewJsonLinesCodec[order]())
+
+	allOrders, _, err := subscriber.SubscribeChan(t.Context(), "orders.>", 10)
+	if err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+	created, _, err := subscriber.SubscribeChan(t.Context(), "orders.*.created", 10)
+	if err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+	euOrders := make(chan Message[order], 10)
+	if _, err := subscriber.Subscribe(t.Context(), "orders.eu.*", func(msg Message[order]) { euOrders <- msg }); err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+
+	_ = publisher.Publish("orders.eu.created", order{Id: 1, Region: "eu"})
+	_ = publisher.Publish("orders.us.created", order{Id: 2, Region: "us"})
+	_ = publisher.Publish("orders.eu.deleted", order{Id: 3, Region: "eu"})
+	_ = publisher.Publish("payments.eu.created", order{Id: 4, Region: "eu"})
+
+	for _, id := range []int{1, 2, 3} {
+		if msg := awaitMessage(t, allOrders); msg.Value.Id != id {
+			t.Fatalf("expected order %d on orders.>, got %+v", id, msg)
+		}
+	}
+	for _, id := range []int{1, 2} {
+		if msg := awaitMessage(t, created); msg.Value.Id != id {
+			t.Fatalf("expected order %d on orders.*.created, got %+v", id, msg)
+		}
+	}
+	for _, id := range []int{1, 3} {
+		if msg := awaitMessage(t, euOrders); msg.Value.Id != id {
+			t.Fatalf("expected order %d on orders.eu.*, got %+v", id, msg)
+		}
+	}
+	select {
+	case msg := <-allOrders:
+		t.Fatalf("expected payments.eu.created to match no subscription, got %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPubSub_unsubscribe(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	metrics := snail_metrics.NewRegistry()
+	broker := newTestBroker(t, &BrokerOpts{Metrics: metrics})
+	client := NewTyped(newTestClient(t, broker), snail_parser.NewInt32Codec())
+
+	ch, sub, err := client.SubscribeChan(t.Context(), "numbers", 10)
+	if err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+	if n, _ := metrics.Value("snail_pubsub_subscriptions"); n != 1 {
+		t.Fatalf("expected 1 subscription, got %v", n)
+	}
+
+	_ = client.Publish("numbers", 1)
+	if msg := awaitMessage(t, ch); msg.Value != 1 {
+		t.Fatalf("expected 1, got %+v", msg)
+	}
+
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatalf("error unsubscribing: %v", err)
+	}
+	awaitClosed(t, ch)
+	if err := sub.Unsubscribe(); err != ErrSubscriptionClosed {
+		t.Fatalf("expected ErrSubscriptionClosed, got %v", err)
+	}
+
+	deadline := time.Now().Add(1 * time.Second)
+	for n, _ := metrics.Value("snail_pubsub_subscriptions"); n != 0; n, _ = metrics.Value("snail_pubsub_subscriptions") {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the broker to drop the subscription, got %v", n)
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+	// The client stays connected and usable
+	ch, _, err = client.SubscribeChan(t.Context(), "numbers", 10)
+	if err != nil {
+		t.Fatalf("error subscribing again: %v", err)
+	}
+	_ = client.Publish("numbers", 2)
+	if msg := awaitMessage(t, ch); msg.Value != 2 {
+		t.Fatalf("expected 2, got %+v", msg)
+	}
+	if err := client.client.Underlying().Err(); err != nil {
+		t.Fatalf("expected the connection to stay up, got %v", err)
+	}
+}
+
+func TestPubSub_clientCloseEndsSubscriptions(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	broker := newTestBroker(t, nil)
+	client, err := NewClient("localhost", broker.Port(), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	ch, _, err := NewTyped(client, snail_parser.NewInt32Codec()).SubscribeChan(t.Context(), ">", 10)
+	if err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+
+	client.Close()
+	awaitClosed(t, ch)
+}
+
+func TestPubSub_subscribeChanDropsWhenFull(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	broker := newTestBroker(t, nil)
+	client := NewTyped(newTestClient(t, broker), snail_parser.NewInt32Codec())
+
+	ch, sub, err := client.SubscribeChan(t.Context(), "numbers", 2)
+	if err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+	markers := make(chan Message[int32], 1)
+	if _, err := client.Subscribe(t.Context(), "marker", func(msg Message[int32]) { markers <- msg }); err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+
+	// Nobody reads ch, which doesn't hold up the other subscription
+	for i := int32(0); i < 10; i++ {
+		_ = client.Publish("numbers", i)
+	}
+	_ = client.Publish("marker", -1)
+	awaitMessage(t, markers)
+
+	if dropped := sub.Dropped(); dropped != 8 {
+		t.Fatalf("expected 8 dropped messages, got %d", dropped)
+	}
+	for _, expected := range []int32{0, 1} {
+		if msg := awaitMessage(t, ch); msg.Value != expected {
+			t.Fatalf("expected %d, got %+v", expected, msg)
+		}
+	}
+}
+
+// newSlowSubscriber subscribes with a handler that blocks until release is closed,
+// which stops the client from reading, so the broker's queue for it fills up
+func newSlowSubscriber(t *testing.T, broker *Broker, received *atomic.Int64, release chan struct{}) *Subscription {
+	t.Helper()
+	client := newTestClient(t, broker)
+	sub, err := client.Subscribe(t.Context(), "firehose", func(topic string, payload []byte) {
+		<-release
+		received.Add(1)
+	})
+	if err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+	return sub
+}
+
+func slowSubscriberOpts(policy SlowSubscriberPolicy, metrics snail_metrics.Metrics) *BrokerOpts {
+	return &BrokerOpts{
+		Batcher:             snail_tcp_reqrep.NewBatcherOpts(1),
+		SubscriberQueueSize: 1,
+		SlowSubscribers:     policy,
+		Metrics:             metrics,
+	}
+}
+
+// Big enough that a few of them fill the socket buffers
+var bigPayload = make([]byte, 1024*1024)
+
+func TestPubSub_slowSubscriber_drop(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	metrics := snail_metrics.NewRegistry()
+	broker := newTestBroker(t, slowSubscriberOpts(DropMessages, metrics))
+	received := atomic.Int64{}
+	release := make(chan struct{})
+	newSlowSubscriber(t, broker, &received, release)
+
+	for i := 0; ; i++ {
+		if i == 1000 {
+			t.Fatalf("expected messages to be dropped")
+		}
+		_ = broker.Publish("firehose", bigPayload)
+		if n, _ := metrics.Value("snail_pubsub_dropped_total"); n > 0 {
+			break
+		}
+	}
+	close(release)
+
+	// Publishing never blocked, and the subscriber stays connected
+	if n, _ := metrics.Value("snail_pubsub_slow_disconnects_total"); n != 0 {
+		t.Fatalf("expected no disconnects, got %v", n)
+	}
+	_ = broker.Publish("firehose", nil)
+	published, _ := metrics.Value("snail_pubsub_published_total")
+	dropped, _ := metrics.Value("snail_pubsub_dropped_total")
+	deadline := time.Now().Add(5 * time.Second)
+	for float64(received.Load()) != published-dropped {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %v messages to arrive, got %d", published-dropped, received.Load())
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+}
+
+func TestPubSub_slowSubscriber_disconnect(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	metrics := snail_metrics.NewRegistry()
+	broker := newTestBroker(t, slowSubscriberOpts(DisconnectSlow, metrics))
+	received := atomic.Int64{}
+	release := make(chan struct{})
+	defer close(release)
+	newSlowSubscriber(t, broker, &received, release)
+
+	for i := 0; ; i++ {
+		if i == 1000 {
+			t.Fatalf("expected the slow subscriber to be disconnected")
+		}
+		_ = broker.Publish("firehose", bigPayload)
+		if n, _ := metrics.Value("snail_pubsub_slow_disconnects_total"); n > 0 {
+			break
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(broker.Underlying().Sessions()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the slow subscriber's session to close")
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+}
+
+func TestPubSub_slowSubscriber_block(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	metrics := snail_metrics.NewRegistry()
+	broker := newTestBroker(t, slowSubscriberOpts(BlockPublishers, metrics))
+	received := atomic.Int64{}
+	release := make(chan struct{})
+	newSlowSubscriber(t, broker, &received, release)
+
+	n := 100
+	published := atomic.Int64{}
+	go func() {
+		for i := 0; i < n; i++ {
+			_ = broker.Publish("firehose", bigPayload)
+			published.Add(1)
+		}
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	if published.Load() == int64(n) {
+		t.Fatalf("expected the publisher to be blocked by the slow subscriber")
+	}
+
+	close(release)
+	deadline := time.Now().Add(10 * time.Second)
+	for received.Load() != int64(n) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected all %d messages to arrive, got %d", n, received.Load())
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+	if dropped, _ := metrics.Value("snail_pubsub_dropped_total"); dropped != 0 {
+		t.Fatalf("expected no messages to be dropped, got %v", dropped)
+	}
+}
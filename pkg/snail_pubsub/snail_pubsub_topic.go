@@ -0,0 +1,125 @@
+package snail_pubsub
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Topics are made of tokens separated by dots, like "orders.eu.created". Subscription patterns
+// may use two wildcards: "*" matches exactly one token, and ">" as the last token matches one
+// or more tokens. "orders.*.created" matches "orders.eu.created", and "orders.>" matches both
+// "orders.eu" and "orders.eu.created", but not "orders".
+const (
+	tokenSeparator = "."
+	wildcardOne    = "*"
+	wildcardRest   = ">"
+)
+
+// ValidateTopic returns an error if topic can't be published on, e.g. because it is empty,
+// has empty tokens or contains wildcards
+func ValidateTopic(topic string) error {
+	return validate(topic, false)
+}
+
+// ValidatePattern returns an error if pattern can't be subscribed to, e.g. because it has
+// empty tokens or a ">" that isn't the last token
+func ValidatePattern(pattern string) error {
+	return validate(pattern, true)
+}
+
+func validate(topic string, wildcards bool) error {
+	if topic == "" {
+		return fmt.Errorf("empty topic")
+	}
+	if len(topic) > MaxTopicLength {
+		return fmt.Errorf("topic too long: %d bytes, max %d", len(topic), MaxTopicLength)
+	}
+	tokens := strings.Split(topic, tokenSeparator)
+	for i, token := range tokens {
+		switch {
+		case token == "":
+			return fmt.Errorf("empty token in topic %q", topic)
+		case token == wildcardOne || token == wildcardRest:
+			if !wildcards {
+				return fmt.Errorf("wildcard in topic %q, only allowed when subscribing", topic)
+			}
+			if token == wildcardRest && i != len(tokens)-1 {
+				return fmt.Errorf("%q must be the last token, in pattern %q", wildcardRest, topic)
+			}
+		}
+	}
+	return nil
+}
+
+// topicIndex finds the subscriptions matching a topic. It is a tree of pattern tokens, so a
+// lookup costs the length of the topic rather than the number of subscriptions. Not thread safe.
+type topicIndex[S comparable] struct {
+	root *topicNode[S]
+}
+
+type topicNode[S comparable] struct {
+	children map[string]*topicNode[S]
+	subs     map[S]struct{} // subscriptions whose pattern ends here
+}
+
+func newTopicIndex[S comparable]() *topicIndex[S] {
+	return &topicIndex[S]{root: newTopicNode[S]()}
+}
+
+func newTopicNode[S comparable]() *topicNode[S] {
+	return &topicNode[S]{children: make(map[string]*topicNode[S]), subs: make(map[S]struct{})}
+}
+
+// add adds a subscription to a valid pattern
+func (idx *topicIndex[S]) add(pattern string, sub S) {
+	node := idx.root
+	for _, token := range strings.Split(pattern, tokenSeparator) {
+		child, ok := node.children[token]
+		if !ok {
+			child = newTopicNode[S]()
+			node.children[token] = child
+		}
+		node = child
+	}
+	node.subs[sub] = struct{}{}
+}
+
+// remove removes a subscription from the pattern it was added with, pruning nodes left empty
+func (idx *topicIndex[S]) remove(pattern string, sub S) {
+	idx.root.remove(strings.Split(pattern, tokenSeparator), sub)
+}
+
+// remove returns true if the node is left empty
+func (n *topicNode[S]) remove(tokens []string, sub S) bool {
+	if len(tokens) == 0 {
+		delete(n.subs, sub)
+	} else if child, ok := n.children[tokens[0]]; ok && child.remove(tokens[1:], sub) {
+		delete(n.children, tokens[0])
+	}
+	return len(n.subs) == 0 && len(n.children) == 0
+}
+
+// match calls visit for every subscription whose pattern matches the valid topic
+func (idx *topicIndex[S]) match(topic string, visit func(sub S)) {
+	idx.root.match(strings.Split(topic, tokenSeparator), visit)
+}
+
+func (n *topicNode[S]) match(tokens []string, visit func(sub S)) {
+	if len(tokens) == 0 {
+		for sub := range n.subs {
+			visit(sub)
+		}
+		return
+	}
+	if child, ok := n.children[tokens[0]]; ok {
+		child.match(tokens[1:], visit)
+	}
+	if child, ok := n.children[wildcardOne]; ok {
+		child.match(tokens[1:], visit)
+	}
+	if child, ok := n.children[wildcardRest]; ok {
+		for sub := range child.subs {
+			visit(sub)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package snail_pubsub
+
+import (
+	"github.com/GiGurra/snail/pkg/snail_buffer"
+	"github.com/GiGurra/snail/pkg/snail_parser"
+	"slices"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	for _, topic := range []string{"a", "a.b.c", "orders.eu-west.created"} {
+		if err := ValidateTopic(topic); err != nil {
+			t.Fatalf("expected topic %q to be valid, got %v", topic, err)
+		}
+	}
+	for _, topic := range []string{"", "a..b", ".a", "a.", "a.*", "a.>"} {
+		if err := ValidateTopic(topic); err == nil {
+			t.Fatalf("expected topic %q to be invalid", topic)
+		}
+	}
+	for _, pattern := range []string{"a", "a.*", "*.b.>", ">", "*"} {
+		if err := ValidatePattern(pattern); err != nil {
+			t.Fatalf("expected pattern %q to be valid, got %v", pattern, err)
+		}
+	}
+	for _, pattern := range []string{"", "a..b", "a.>.b", ">.a"} {
+		if err := ValidatePattern(pattern); err == nil {
+			t.Fatalf("expected pattern %q to be invalid", pattern)
+		}
+	}
+}
+
+func TestTopicIndex_match(t *testing.T) {
+	idx := newTopicIndex[string]()
+	for _, pattern := range []string{"orders.eu.created", "orders.*.created", "orders.>", "*.eu.*", ">", "payments.>"} {
+		idx.add(pattern, pattern)
+	}
+
+	matches := func(topic string) []string {
+		var res []string
+		idx.match(topic, func(sub string) { res = append(res, sub) })
+		slices.Sort(res)
+		return res
+	}
+
+	expected := map[string][]string{
+		"orders.eu.created": {"*.eu.*", ">", "orders.*.created", "orders.>", "orders.eu.created"},
+		"orders.us.created": {">", "orders.*.created", "orders.>"},
+		"orders.eu":         {">", "orders.>"},
+		"orders":            {">"},
+		"users.eu.deleted":  {"*.eu.*", ">"},
+	}
+	for topic, exp := range expected {
+		if got := matches(topic); !slices.Equal(got, exp) {
+			t.Fatalf("expected %q to match %v, got %v", topic, exp, got)
+		}
+	}
+
+	// Removing prunes the tree, and leaves the other subscriptions alone
+	for _, pattern := range []string{"orders.eu.created", "orders.*.created", "orders.>", "*.eu.*", ">"} {
+		idx.remove(pattern, pattern)
+	}
+	if got := matches("orders.eu.created"); len(got) != 0 {
+		t.Fatalf("expected no matches after removing, got %v", got)
+	}
+	if got := matches("payments.x"); !slices.Equal(got, []string{"payments.>"}) {
+		t.Fatalf("expected payments.> to remain, got %v", got)
+	}
+	if len(idx.root.children) != 1 {
+		t.Fatalf("expected removed branches to be pruned, got %d children", len(idx.root.children))
+	}
+}
+
+func TestFrameCodec(t *testing.T) {
+	codec := NewFrameCodec()
+	frames := []Frame{
+		{Kind: FrameKindSubscribe, Sid: 1, Topic: "orders.>"},
+		{Kind: FrameKindPublish, Topic: "orders.eu", Payload: []byte("hello")},
+		{Kind: FrameKindMessage, Sid: 1, Topic: "orders.eu", Payload: []byte("hello")},
+		{Kind: FrameKindAck, Sid: 1},
+	}
+
+	buffer := snail_buffer.New(snail_buffer.BigEndian, 1024)
+	for _, frame := range frames {
+		if err := codec.Writer(buffer, frame); err != nil {
+			t.Fatalf("error writing frame: %v", err)
+		}
+	}
+
+	// Feed the bytes one at a time, so every frame is first seen incomplete
+	written := buffer.Underlying()
+	readBuffer := snail_buffer.New(snail_buffer.BigEndian, 1024)
+	var parsed []Frame
+	for _, b := range written {
+		readBuffer.WriteByteNoE(b)
+		res, err := snail_parser.ParseAll[Frame](readBuffer, codec.Parser)
+		if err != nil {
+			t.Fatalf("error parsing frames: %v", err)
+		}
+		parsed = append(parsed, res...)
+	}
+
+	if len(parsed) != len(frames) {
+		t.Fatalf("expected %d frames, got %d", len(frames), len(parsed))
+	}
+	for i := range frames {
+		if parsed[i].Kind != frames[i].Kind || parsed[i].Sid != frames[i].Sid ||
+			parsed[i].Topic != frames[i].Topic || string(parsed[i].Payload) != string(frames[i].Payload) {
+			t.Fatalf("expected frame %+v, got %+v", frames[i], parsed[i])
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package snail_pubsub
+
+import (
+	"context"
+	"fmt"
+	"github.com/GiGurra/snail/pkg/snail_parser"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+// Message is a typed message, with the topic it was published on
+type Message[T any] struct {
+	Topic string
+	Value T
+}
+
+// Typed publishes and subscribes values of type T on a Client, encoded as message payloads
+// with a codec, e.g. snail_parser.NewJsonLinesCodec
+type Typed[T any] struct {
+	client *Client
+	codec  snail_parser.Codec[T]
+}
+
+func NewTyped[T any](client *Client, codec snail_parser.Codec[T]) *Typed[T] {
+	return &Typed[T]{client: client, codec: codec}
+}
+
+// Publish encodes value and publishes it on topic, see Client.Publish
+func (t *Typed[T]) Publish(topic string, value T) error {
+	payload, err := snail_parser.Encode(t.codec, value)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+	return t.client.Publish(topic, payload)
+}
+
+// Subscribe passes the decoded messages on the topics matching pattern to handler, see
+// Client.Subscribe. Messages that can't be decoded are logged and skipped.
+func (t *Typed[T]) Subscribe(ctx context.Context, pattern string, handler func(msg Message[T])) (*Subscription, error) {
+	return t.client.subscribe(ctx, pattern, t.decoding(handler), nil)
+}
+
+// SubscribeChan delivers the decoded messages on the topics matching pattern on a channel with
+// room for bufferSize messages. Messages arriving while the channel is full are dropped, since
+// waiting for the reader would stall the client's other subscriptions. Subscription.Dropped
+// counts them. The channel is closed when the subscription ends, by Unsubscribe or by losing
+// the connection.
+func (t *Typed[T]) SubscribeChan(ctx context.Context, pattern string, bufferSize int) (<-chan Message[T], *Subscription, error) {
+	ch := make(chan Message[T], bufferSize)
+	dropped := &atomic.Int64{}
+	lock := sync.Mutex{}
+	closed := false
+
+	send := func(msg Message[T]) {
+		lock.Lock()
+		defer lock.Unlock()
+		if closed {
+			return
+		}
+		select {
+		case ch <- msg:
+		default:
+			dropped.Add(1)
+		}
+	}
+
+	onClose := func() {
+		lock.Lock()
+		defer lock.Unlock()
+		closed = true
+		close(ch)
+	}
+
+	sub, err := t.client.subscribe(ctx, pattern, t.decoding(send), onClose)
+	if err != nil {
+		return nil, nil, err
+	}
+	sub.dropped = dropped
+	return ch, sub, nil
+}
+
+func (t *Typed[T]) decoding(handler func(msg Message[T])) func(topic string, payload []byte) {
+	return func(topic string, payload []byte) {
+		value, err := snail_parser.Decode(t.codec, payload)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Failed to decode message on topic %s, skipping it: %v", topic, err))
+			return
+		}
+		handler(Message[T]{Topic: topic, Value: value})
+	}
+}
@@ -0,0 +1,85 @@
+package snail_rpc
+
+import (
+	"context"
+	"fmt"
+	"github.com/GiGurra/snail/pkg/snail_parser"
+	"github.com/GiGurra/snail/pkg/snail_tcp"
+	"github.com/GiGurra/snail/pkg/snail_tcp_reqrep"
+)
+
+// Client calls the methods of a server serving a Router, see Invoke
+type Client struct {
+	underlying *snail_tcp_reqrep.SnailClient[Request, Response]
+}
+
+// NewClient connects to a server from NewServer. The envelope is always enabled, and all other
+// options, like CallTimeout, are passed on as given.
+func NewClient(
+	ip string,
+	port int,
+	tcpOpts *snail_tcp.SnailClientOpts,
+	opts *snail_tcp_reqrep.SnailClientOpts[Request, Response],
+) (*Client, error) {
+
+	if opts == nil {
+		opts = &snail_tcp_reqrep.SnailClientOpts[Request, Response]{}
+	}
+	ownOpts := opts.WithEnvelope()
+
+	reqCodec := NewRequestCodec()
+	respCodec := NewResponseCodec()
+	underlying, err := snail_tcp_reqrep.NewClientWithOpts[Request, Response](
+		ip,
+		port,
+		tcpOpts,
+		nil,
+		reqCodec.Writer,
+		respCodec.Parser,
+		&ownOpts,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rpc client: %w", err)
+	}
+
+	return &Client{underlying: underlying}, nil
+}
+
+func (c *Client) Underlying() *snail_tcp_reqrep.SnailClient[Request, Response] {
+	return c.underlying
+}
+
+func (c *Client) Close() {
+	c.underlying.Close()
+}
+
+// Invoke calls a method and waits for its response, for at most the client's CallTimeout.
+// Calls the server couldn't handle fail with an *Error.
+func Invoke[Req any, Resp any](client *Client, method Method[Req, Resp], req Req) (Resp, error) {
+	return InvokeContext(context.Background(), client, method, req)
+}
+
+// InvokeContext is Invoke, also giving up when ctx is done
+func InvokeContext[Req any, Resp any](ctx context.Context, client *Client, method Method[Req, Resp], req Req) (Resp, error) {
+	var zero Resp
+
+	payload, err := snail_parser.Encode(method.ReqCodec, req)
+	if err != nil {
+		return zero, fmt.Errorf("failed to encode request to %s: %w", method.Name, err)
+	}
+
+	resp, err := client.underlying.Call(ctx, Request{Method: method.ID, Payload: payload})
+	if err != nil {
+		return zero, fmt.Errorf("failed to call %s: %w", method.Name, err)
+	}
+
+	if resp.Status != StatusOK {
+		return zero, &Error{Method: method.Name, Status: resp.Status, Message: string(resp.Payload)}
+	}
+
+	res, err := snail_parser.Decode(method.RespCodec, resp.Payload)
+	if err != nil {
+		return zero, fmt.Errorf("failed to decode response from %s: %w", method.Name, err)
+	}
+	return res, nil
+}
@@ -0,0 +1,96 @@
+package snail_rpc
+
+import (
+	"fmt"
+	"github.com/GiGurra/snail/pkg/snail_buffer"
+	"github.com/GiGurra/snail/pkg/snail_parser"
+	"math"
+)
+
+// Request is an encoded request on the wire, for the method with id Method
+type Request struct {
+	Method  uint32
+	Payload []byte
+}
+
+// Response is an encoded response on the wire. With StatusOK, Payload is the encoded response,
+// otherwise it is the error message.
+type Response struct {
+	Status  Status
+	Payload []byte
+}
+
+// NewRequestCodec returns the codec for requests: the method id, a 32 bit payload length and the payload
+func NewRequestCodec() snail_parser.Codec[Request] {
+
+	return snail_parser.Codec[Request]{
+
+		Parser: func(buffer *snail_buffer.Buffer) snail_parser.ParseOneResult[Request] {
+			if buffer.NumBytesReadable() < 8 {
+				return snail_parser.ParseOneResult[Request]{Status: snail_parser.ParseOneStatusNEB}
+			}
+			method, _ := buffer.ReadInt32()
+			payload, res := readPayload[Request](buffer)
+			if res.Status == snail_parser.ParseOneStatusOK {
+				res.Value = Request{Method: uint32(method), Payload: payload}
+			}
+			return res
+		},
+
+		Writer: func(buffer *snail_buffer.Buffer, req Request) error {
+			if len(req.Payload) > math.MaxInt32 {
+				return fmt.Errorf("request too large: %d bytes", len(req.Payload))
+			}
+			buffer.WriteInt32(int32(req.Method))
+			buffer.WriteInt32(int32(len(req.Payload)))
+			buffer.WriteBytes(req.Payload)
+			return nil
+		},
+	}
+}
+
+// NewResponseCodec returns the codec for responses: the status, a 32 bit payload length and the payload
+func NewResponseCodec() snail_parser.Codec[Response] {
+
+	return snail_parser.Codec[Response]{
+
+		Parser: func(buffer *snail_buffer.Buffer) snail_parser.ParseOneResult[Response] {
+			if buffer.NumBytesReadable() < 5 {
+				return snail_parser.ParseOneResult[Response]{Status: snail_parser.ParseOneStatusNEB}
+			}
+			status, _ := buffer.ReadInt8()
+			payload, res := readPayload[Response](buffer)
+			if res.Status == snail_parser.ParseOneStatusOK {
+				res.Value = Response{Status: Status(status), Payload: payload}
+			}
+			return res
+		},
+
+		Writer: func(buffer *snail_buffer.Buffer, resp Response) error {
+			if len(resp.Payload) > math.MaxInt32 {
+				return fmt.Errorf("response too large: %d bytes", len(resp.Payload))
+			}
+			buffer.WriteInt8(int8(resp.Status))
+			buffer.WriteInt32(int32(len(resp.Payload)))
+			buffer.WriteBytes(resp.Payload)
+			return nil
+		},
+	}
+}
+
+// readPayload reads a 32 bit length and that many bytes. The caller has checked that the length is readable.
+func readPayload[T any](buffer *snail_buffer.Buffer) ([]byte, snail_parser.ParseOneResult[T]) {
+	res := snail_parser.ParseOneResult[T]{}
+	length, _ := buffer.ReadInt32()
+	if length < 0 {
+		res.Err = fmt.Errorf("invalid payload length %d", length)
+		return nil, res
+	}
+	if !buffer.CanRead(int(length)) {
+		res.Status = snail_parser.ParseOneStatusNEB
+		return nil, res
+	}
+	payload, _ := buffer.ReadBytes(int(length))
+	res.Status = snail_parser.ParseOneStatusOK
+	return payload, res
+}
@@ -0,0 +1,105 @@
+package snail_rpc
+
+import (
+	"errors"
+	"fmt"
+	"github.com/GiGurra/snail/pkg/snail_parser"
+	"hash/fnv"
+)
+
+// Method describes one operation of a service: the id it is called by on the wire, and the codecs
+// of its request and response. Clients and servers must use the same methods.
+type Method[Req any, Resp any] struct {
+	ID        uint32
+	Name      string // for errors and logs
+	ReqCodec  snail_parser.Codec[Req]
+	RespCodec snail_parser.Codec[Resp]
+}
+
+// NewMethod returns a method identified by its name. The id is a hash of the name, see MethodID.
+func NewMethod[Req any, Resp any](
+	name string,
+	reqCodec snail_parser.Codec[Req],
+	respCodec snail_parser.Codec[Resp],
+) Method[Req, Resp] {
+	return Method[Req, Resp]{ID: MethodID(name), Name: name, ReqCodec: reqCodec, RespCodec: respCodec}
+}
+
+// NewNumberedMethod returns a method with an explicit id, e.g. to keep ids stable across renames
+func NewNumberedMethod[Req any, Resp any](
+	id uint32,
+	name string,
+	reqCodec snail_parser.Codec[Req],
+	respCodec snail_parser.Codec[Resp],
+) Method[Req, Resp] {
+	return Method[Req, Resp]{ID: id, Name: name, ReqCodec: reqCodec, RespCodec: respCodec}
+}
+
+// MethodID returns the id NewMethod gives a method name, the 32 bit FNV-1a hash of it
+func MethodID(name string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	return h.Sum32()
+}
+
+// Status tells whether a call succeeded, and if not, why
+type Status int8
+
+const (
+	StatusOK Status = iota
+	// StatusUnknownMethod means the server has no handler for the method id
+	StatusUnknownMethod
+	// StatusBadRequest means the server couldn't decode the request
+	StatusBadRequest
+	// StatusHandlerError means the handler returned an error
+	StatusHandlerError
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusOK:
+		return "ok"
+	case StatusUnknownMethod:
+		return "unknown method"
+	case StatusBadRequest:
+		return "bad request"
+	case StatusHandlerError:
+		return "handler error"
+	default:
+		return fmt.Sprintf("status %d", int8(s))
+	}
+}
+
+var (
+	// ErrUnknownMethod matches the *Error of calls to methods the server doesn't have
+	ErrUnknownMethod = errors.New("snail rpc unknown method")
+	// ErrBadRequest matches the *Error of calls whose request the server couldn't decode
+	ErrBadRequest = errors.New("snail rpc bad request")
+	// ErrHandler matches the *Error of calls whose handler returned an error
+	ErrHandler = errors.New("snail rpc handler error")
+)
+
+// Error is the error a call fails with when the server couldn't handle it. Use errors.Is with
+// ErrUnknownMethod, ErrBadRequest or ErrHandler to tell the cases apart.
+type Error struct {
+	Method  string
+	Status  Status
+	Message string // from the server
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("snail rpc %s failed with %s: %s", e.Method, e.Status, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	switch e.Status {
+	case StatusUnknownMethod:
+		return target == ErrUnknownMethod
+	case StatusBadRequest:
+		return target == ErrBadRequest
+	case StatusHandlerError:
+		return target == ErrHandler
+	default:
+		return false
+	}
+}
@@ -0,0 +1,115 @@
+package snail_rpc
+
+import (
+	"fmt"
+	"github.com/GiGurra/snail/pkg/snail_parser"
+	"github.com/GiGurra/snail/pkg/snail_tcp"
+	"github.com/GiGurra/snail/pkg/snail_tcp_reqrep"
+	"log/slog"
+	"sync"
+)
+
+// Handler handles the requests to one method. A returned error is sent to the client, which
+// gets it as an *Error matching ErrHandler.
+type Handler[Req any, Resp any] func(req Req) (Resp, error)
+
+// Router dispatches requests to the handlers of their methods. Methods can be registered
+// while the server is running.
+type Router struct {
+	lock   sync.RWMutex
+	routes map[uint32]route
+}
+
+// route is a registered method, with the typed handler hidden behind encoded payloads
+type route struct {
+	name   string
+	handle func(payload []byte) Response
+}
+
+func NewRouter() *Router {
+	return &Router{routes: make(map[uint32]route)}
+}
+
+// Register registers the handler of a method. It panics if another method with the same id is
+// already registered, which for methods from NewMethod means that two names hash the same.
+func Register[Req any, Resp any](router *Router, method Method[Req, Resp], handler Handler[Req, Resp]) {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+
+	if existing, ok := router.routes[method.ID]; ok {
+		panic(fmt.Sprintf("method %s has the same id %d as method %s", method.Name, method.ID, existing.name))
+	}
+
+	router.routes[method.ID] = route{
+		name: method.Name,
+		handle: func(payload []byte) Response {
+			req, err := snail_parser.Decode(method.ReqCodec, payload)
+			if err != nil {
+				return errorResponse(StatusBadRequest, fmt.Sprintf("failed to decode request: %v", err))
+			}
+			resp, err := handler(req)
+			if err != nil {
+				return errorResponse(StatusHandlerError, err.Error())
+			}
+			encoded, err := snail_parser.Encode(method.RespCodec, resp)
+			if err != nil {
+				slog.Error(fmt.Sprintf("Failed to encode response of method %s: %v", method.Name, err))
+				return errorResponse(StatusHandlerError, fmt.Sprintf("failed to encode response: %v", err))
+			}
+			return Response{Status: StatusOK, Payload: encoded}
+		},
+	}
+}
+
+func errorResponse(status Status, message string) Response {
+	return Response{Status: status, Payload: []byte(message)}
+}
+
+// Handle handles one encoded request
+func (r *Router) Handle(req Request) Response {
+	r.lock.RLock()
+	route, ok := r.routes[req.Method]
+	r.lock.RUnlock()
+	if !ok {
+		return errorResponse(StatusUnknownMethod, fmt.Sprintf("no method with id %d", req.Method))
+	}
+	return route.handle(req.Payload)
+}
+
+// ConnHandler returns the router as a snail_tcp_reqrep server handler
+func (r *Router) ConnHandler() snail_tcp_reqrep.ServerConnHandler[Request, Response] {
+	return func(req Request, repFunc func(resp Response) error) error {
+		if repFunc == nil {
+			return nil
+		}
+		return repFunc(r.Handle(req))
+	}
+}
+
+// NewServer serves the router. The envelope is always enabled, since the clients correlate
+// responses by it. All other options, like Execution, are passed on as given.
+func NewServer(
+	router *Router,
+	tcpOpts *snail_tcp.SnailServerOpts,
+	opts *snail_tcp_reqrep.SnailServerOpts[Request, Response],
+) (*snail_tcp_reqrep.SnailServer[Request, Response], error) {
+
+	if opts == nil {
+		opts = &snail_tcp_reqrep.SnailServerOpts[Request, Response]{}
+	}
+	ownOpts := opts.WithEnvelope()
+
+	reqCodec := NewRequestCodec()
+	respCodec := NewResponseCodec()
+	server, err := snail_tcp_reqrep.NewServer[Request, Response](
+		router.ConnHandler,
+		tcpOpts,
+		reqCodec.Parser,
+		respCodec.Writer,
+		&ownOpts,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rpc server: %w", err)
+	}
+	return server, nil
+}
@@ -0,0 +1,129 @@
+package snail_rpc
+
+import (
+	"errors"
+	"fmt"
+	"github.com/GiGurra/snail/pkg/snail_logging"
+	"github.com/GiGurra/snail/pkg/snail_parser"
+	"github.com/GiGurra/snail/pkg/snail_tcp_reqrep"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type greetReq struct {
+	Name string `json:"name"`
+}
+
+type greetResp struct {
+	Greeting string `json:"greeting"`
+}
+
+var (
+	greet = NewMethod("greet", snail_parser.NewJsonLinesCodec[greetReq](), snail_parser.NewJsonLinesCodec[greetResp]())
+	add   = NewNumberedMethod(7, "add", snail_parser.NewInt32Codec(), snail_parser.NewInt32Codec())
+	fail  = NewMethod("fail", snail_parser.NewInt32Codec(), snail_parser.NewInt32Codec())
+)
+
+func newTestServer(t *testing.T, router *Router, opts *snail_tcp_reqrep.SnailServerOpts[Request, Response]) *Client {
+	t.Helper()
+	server, err := NewServer(router, nil, opts)
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+	t.Cleanup(server.Close)
+
+	client, err := NewClient("localhost", server.Port(), nil, nil)
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	t.Cleanup(client.Close)
+	return client
+}
+
+func newTestRouter() *Router {
+	router := NewRouter()
+	Register(router, greet, func(req greetReq) (greetResp, error) {
+		return greetResp{Greeting: "hello " + req.Name}, nil
+	})
+	Register(router, add, func(req int32) (int32, error) {
+		return req + 1, nil
+	})
+	Register(router, fail, func(req int32) (int32, error) {
+		return 0, fmt.Errorf("no luck with %d", req)
+	})
+	return router
+}
+
+func TestRouter_dispatchesByMethod(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	client := newTestServer(t, newTestRouter(), &snail_tcp_reqrep.SnailServerOpts[Request, Response]{
+		Execution: snail_tcp_reqrep.ExecutionOpts{Mode: snail_tcp_reqrep.ExecuteSharedPool},
+	})
+
+	// Concurrent calls to different methods, each correlated to its own response
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 200)
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			resp, err := Invoke(client, greet, greetReq{Name: fmt.Sprintf("snail %d", i)})
+			if err != nil || resp.Greeting != fmt.Sprintf("hello snail %d", i) {
+				errs <- fmt.Errorf("greet %d: got %+v, %v", i, resp, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			resp, err := Invoke(client, add, int32(i))
+			if err != nil || resp != int32(i+1) {
+				errs <- fmt.Errorf("add %d: got %d, %v", i, resp, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestRouter_errors(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	client := newTestServer(t, newTestRouter(), nil)
+
+	_, err := Invoke(client, NewMethod("missing", snail_parser.NewInt32Codec(), snail_parser.NewInt32Codec()), 1)
+	var rpcErr *Error
+	if !errors.As(err, &rpcErr) || !errors.Is(err, ErrUnknownMethod) || rpcErr.Method != "missing" {
+		t.Fatalf("expected an unknown method error, got %v", err)
+	}
+
+	_, err = Invoke(client, fail, 42)
+	if !errors.Is(err, ErrHandler) || !strings.Contains(err.Error(), "no luck with 42") {
+		t.Fatalf("expected the handler's error, got %v", err)
+	}
+
+	// Same id as add, but a request add's codec can't decode
+	badAdd := NewNumberedMethod(7, "add", snail_parser.NewRawBytesCodec(), snail_parser.NewInt32Codec())
+	_, err = Invoke(client, badAdd, []byte{1})
+	if !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected a bad request error, got %v", err)
+	}
+
+	// The connection survives failed calls
+	if resp, err := Invoke(client, add, 1); err != nil || resp != 2 {
+		t.Fatalf("expected 2, got %d, %v", resp, err)
+	}
+}
+
+func TestRegister_duplicateIdPanics(t *testing.T) {
+	router := newTestRouter()
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected registering a duplicate id to panic")
+		}
+	}()
+	Register(router, NewNumberedMethod(7, "other", snail_parser.NewInt32Codec(), snail_parser.NewInt32Codec()), nil)
+}
@@ -0,0 +1,280 @@
+package snail_tcp
+
+import (
+	"context"
+	"errors"
+	"github.com/GiGurra/snail/pkg/snail_buffer"
+	"github.com/GiGurra/snail/pkg/snail_logging"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReconnectPolicy_Backoff(t *testing.T) {
+
+	policy := ReconnectPolicy{
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+		Multiplier:     2,
+	}
+
+	expected := []time.Duration{
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		40 * time.Millisecond,
+		50 * time.Millisecond,
+		50 * time.Millisecond,
+	}
+	for i, exp := range expected {
+		if got := policy.Backoff(i + 1); got != exp {
+			t.Fatalf("attempt %d: expected backoff %v, got %v", i+1, exp, got)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for attempt := 1; attempt < 10; attempt++ {
+		got := policy.Backoff(attempt)
+		if got > 50*time.Millisecond || got < 5*time.Millisecond {
+			t.Fatalf("attempt %d: jittered backoff out of range: %v", attempt, got)
+		}
+	}
+}
+
+func newRecordingServer(t *testing.T, port int) (*SnailServer, chan string) {
+	return newRecordingServerWith(t, func(handler func(conn net.Conn) ServerConnHandler) (*SnailServer, error) {
+		return NewServer(handler, &SnailServerOpts{Port: port})
+	})
+}
+
+func newRecordingServerWith(
+	t *testing.T,
+	newServer func(handler func(conn net.Conn) ServerConnHandler) (*SnailServer, error),
+) (*SnailServer, chan string) {
+	recvCh := make(chan string, 10)
+	server, err := newServer(func(_ net.Conn) ServerConnHandler {
+		return func(buffer *snail_buffer.Buffer) error {
+			if buffer == nil {
+				return nil
+			}
+			recvCh <- string(buffer.ReadAll())
+			return nil
+		}
+	})
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+	return server, recvCh
+}
+
+func killServer(t *testing.T, server *SnailServer) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // force close all connections right away
+	err := server.Shutdown(ctx)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		t.Fatalf("error shutting down server: %v", err)
+	}
+}
+
+func TestClient_Reconnect(t *testing.T) {
+
+	snail_logging.ConfigureDefaultLogger("json", "info", false)
+
+	server, recvCh := newRecordingServer(t, 0)
+	port := server.Port()
+
+	connectCh := make(chan struct{}, 1)
+	disconnectCh := make(chan error, 1)
+	reconnectCh := make(chan int, 1)
+
+	client, err := NewClient("localhost", port, &SnailClientOpts{
+		Reconnect:    &ReconnectPolicy{InitialBackoff: 10 * time.Millisecond},
+		OnConnect:    func(_ net.Conn) { connectCh <- struct{}{} },
+		OnDisconnect: func(err error) { disconnectCh <- err },
+		OnReconnect:  func(_ net.Conn, attempt int) { reconnectCh <- attempt },
+	}, func(buffer *snail_buffer.Buffer) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	defer client.Close()
+
+	<-connectCh
+	if err := client.SendBytes([]byte("first")); err != nil {
+		t.Fatalf("error sending msg: %v", err)
+	}
+	if msg := <-recvCh; msg != "first" {
+		t.Fatalf("expected 'first', got '%s'", msg)
+	}
+
+	killServer(t, server)
+
+	select {
+	case <-disconnectCh:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expected disconnect to be reported")
+	}
+
+	if err := client.SendBytes([]byte("lost")); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("expected ErrNotConnected while disconnected, got %v", err)
+	}
+
+	server, recvCh = newRecordingServer(t, port)
+	defer server.Close()
+
+	select {
+	case attempt := <-reconnectCh:
+		if attempt < 1 {
+			t.Fatalf("expected attempt >= 1, got %d", attempt)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected client to reconnect")
+	}
+
+	waitFor(t, client.IsConnected)
+	if err := client.SendBytes([]byte("second")); err != nil {
+		t.Fatalf("error sending msg after reconnect: %v", err)
+	}
+	if msg := <-recvCh; msg != "second" {
+		t.Fatalf("expected 'second', got '%s'", msg)
+	}
+}
+
+func TestClient_Disconnect(t *testing.T) {
+
+	snail_logging.ConfigureDefaultLogger("json", "info", false)
+
+	server, _ := newRecordingServer(t, 0)
+	defer server.Close()
+
+	reason := errors.New("peer looks dead")
+	disconnectCh := make(chan error, 1)
+	reconnectCh := make(chan int, 1)
+
+	client, err := NewClient("localhost", server.Port(), &SnailClientOpts{
+		Reconnect:    &ReconnectPolicy{InitialBackoff: 10 * time.Millisecond},
+		OnDisconnect: func(err error) { disconnectCh <- err },
+		OnReconnect:  func(_ net.Conn, attempt int) { reconnectCh <- attempt },
+	}, func(buffer *snail_buffer.Buffer) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	defer client.Close()
+
+	client.Disconnect(reason)
+
+	if err := <-disconnectCh; !errors.Is(err, reason) {
+		t.Fatalf("expected disconnect reason %v, got %v", reason, err)
+	}
+	select {
+	case <-reconnectCh:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected client to reconnect")
+	}
+	if client.Err() != nil {
+		t.Fatalf("expected client to still be running, got %v", client.Err())
+	}
+}
+
+func TestClient_Reconnect_givesUp(t *testing.T) {
+
+	snail_logging.ConfigureDefaultLogger("json", "info", false)
+
+	server, _ := newRecordingServer(t, 0)
+
+	closedCh := make(chan struct{})
+	client, err := NewClient("localhost", server.Port(), &SnailClientOpts{
+		Reconnect: &ReconnectPolicy{InitialBackoff: 5 * time.Millisecond, MaxAttempts: 2},
+	}, func(buffer *snail_buffer.Buffer) error {
+		if buffer == nil {
+			close(closedCh)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	defer client.Close()
+
+	killServer(t, server)
+
+	select {
+	case <-closedCh:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected client to give up reconnecting")
+	}
+
+	if client.IsConnected() {
+		t.Fatalf("expected client to be disconnected")
+	}
+}
+
+func TestClient_Lifecycle(t *testing.T) {
+
+	snail_logging.ConfigureDefaultLogger("json", "info", false)
+
+	newCountingClient := func(port int) (*SnailClient, *atomic.Int32) {
+		nilCalls := &atomic.Int32{}
+		client, err := NewClient("localhost", port, nil, func(buffer *snail_buffer.Buffer) error {
+			if buffer == nil {
+				nilCalls.Add(1)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("error creating client: %v", err)
+		}
+		return client, nilCalls
+	}
+
+	awaitDone := func(client *SnailClient) {
+		select {
+		case <-client.Done():
+		case <-time.After(1 * time.Second):
+			t.Fatalf("expected client to be done")
+		}
+	}
+
+	t.Run("closed by client", func(t *testing.T) {
+		server, _ := newRecordingServer(t, 0)
+		defer server.Close()
+
+		client, nilCalls := newCountingClient(server.Port())
+		if client.Err() != nil {
+			t.Fatalf("expected no error while running, got %v", client.Err())
+		}
+
+		client.Close()
+		client.Close()
+		awaitDone(client)
+
+		if !errors.Is(client.Err(), ErrClientClosed) {
+			t.Fatalf("expected ErrClientClosed, got %v", client.Err())
+		}
+		if n := nilCalls.Load(); n != 1 {
+			t.Fatalf("expected handler to be called with nil once, got %d", n)
+		}
+	})
+
+	t.Run("closed by server", func(t *testing.T) {
+		server, _ := newRecordingServer(t, 0)
+
+		client, nilCalls := newCountingClient(server.Port())
+		defer client.Close()
+
+		killServer(t, server)
+		awaitDone(client)
+
+		if client.Err() == nil || errors.Is(client.Err(), ErrClientClosed) {
+			t.Fatalf("expected a connection error, got %v", client.Err())
+		}
+
+		client.Close()
+		if n := nilCalls.Load(); n != 1 {
+			t.Fatalf("expected handler to be called with nil once, got %d", n)
+		}
+	})
+}
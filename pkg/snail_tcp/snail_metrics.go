@@ -0,0 +1,78 @@
+package snail_tcp
+
+import (
+	"github.com/GiGurra/snail/pkg/snail_metrics"
+	"net"
+)
+
+type serverMetrics struct {
+	enabled  bool
+	accepted snail_metrics.Counter
+	rejected snail_metrics.Counter
+	active   snail_metrics.Gauge
+	bytes    byteMetrics
+}
+
+func newServerMetrics(m snail_metrics.Metrics) serverMetrics {
+	enabled := m != nil
+	m = snail_metrics.OrDiscard(m)
+	return serverMetrics{
+		enabled:  enabled,
+		accepted: m.Counter("snail_server_connections_accepted_total", "Connections accepted"),
+		rejected: m.Counter("snail_server_connections_rejected_total", "Connections closed right away because of MaxConnections"),
+		active:   m.Gauge("snail_server_connections_active", "Connections currently open"),
+		bytes: byteMetrics{
+			read:    m.Counter("snail_server_bytes_read_total", "Bytes received, including any TLS overhead"),
+			written: m.Counter("snail_server_bytes_written_total", "Bytes sent, including any TLS overhead"),
+		},
+	}
+}
+
+type clientMetrics struct {
+	enabled     bool
+	connects    snail_metrics.Counter
+	disconnects snail_metrics.Counter
+	bytes       byteMetrics
+}
+
+func newClientMetrics(m snail_metrics.Metrics) clientMetrics {
+	enabled := m != nil
+	m = snail_metrics.OrDiscard(m)
+	return clientMetrics{
+		enabled:     enabled,
+		connects:    m.Counter("snail_client_connects_total", "Connections established, including reconnects"),
+		disconnects: m.Counter("snail_client_disconnects_total", "Connections lost"),
+		bytes: byteMetrics{
+			read:    m.Counter("snail_client_bytes_read_total", "Bytes received, including any TLS overhead"),
+			written: m.Counter("snail_client_bytes_written_total", "Bytes sent, including any TLS overhead"),
+		},
+	}
+}
+
+type byteMetrics struct {
+	read    snail_metrics.Counter
+	written snail_metrics.Counter
+}
+
+// countingConn counts the bytes going through a connection. It sits below TLS, if any.
+type countingConn struct {
+	net.Conn
+	metrics *byteMetrics
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.metrics.read.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.metrics.written.Add(int64(n))
+	return n, err
+}
+
+// NetConn returns the wrapped connection, like tls.Conn.NetConn
+func (c *countingConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,71 @@
+package snail_tcp
+
+import (
+	"github.com/GiGurra/snail/pkg/snail_buffer"
+	"github.com/GiGurra/snail/pkg/snail_logging"
+	"github.com/GiGurra/snail/pkg/snail_metrics"
+	"net"
+	"testing"
+)
+
+func TestMetrics_serverAndClient(t *testing.T) {
+
+	snail_logging.ConfigureDefaultLogger("json", "info", false)
+
+	registry := snail_metrics.NewRegistry()
+	value := func(name string) float64 {
+		v, _ := registry.Value(name, snail_metrics.Label{Name: "side", Value: "test"})
+		return v
+	}
+
+	server, err := NewServer(func(conn net.Conn) ServerConnHandler {
+		return func(buffer *snail_buffer.Buffer) error {
+			if buffer != nil {
+				return SendAll(conn, buffer.ReadAll()) // echo
+			}
+			return nil
+		}
+	}, &SnailServerOpts{Metrics: snail_metrics.WithLabels(registry, snail_metrics.Label{Name: "side", Value: "test"})})
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+	defer server.Close()
+
+	echoed := make(chan int, 10)
+	client, err := NewClient("localhost", server.Port(), &SnailClientOpts{
+		Metrics: snail_metrics.WithLabels(registry, snail_metrics.Label{Name: "side", Value: "test"}),
+	}, func(buffer *snail_buffer.Buffer) error {
+		if buffer != nil {
+			echoed <- len(buffer.ReadAll())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+
+	if err := client.SendBytes([]byte("hello")); err != nil {
+		t.Fatalf("error sending: %v", err)
+	}
+	received := 0
+	for received < 5 {
+		received += <-echoed
+	}
+
+	waitFor(t, func() bool { return value("snail_server_connections_active") == 1 })
+	for name, want := range map[string]float64{
+		"snail_server_connections_accepted_total": 1,
+		"snail_server_bytes_read_total":           5,
+		"snail_server_bytes_written_total":        5,
+		"snail_client_connects_total":             1,
+		"snail_client_bytes_read_total":           5,
+		"snail_client_bytes_written_total":        5,
+	} {
+		if got := value(name); got != want {
+			t.Fatalf("expected %s = %v, got %v", name, want, got)
+		}
+	}
+
+	client.Close()
+	waitFor(t, func() bool { return value("snail_server_connections_active") == 0 })
+}
@@ -1,30 +1,113 @@
 package snail_tcp
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/GiGurra/snail/pkg/snail_buffer"
+	"github.com/GiGurra/snail/pkg/snail_metrics"
 	"io"
 	"log/slog"
 	"net"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	// ErrServerShutdown is the close reason of connections closed by Shutdown
+	ErrServerShutdown = errors.New("snail server shutting down")
+	// ErrReadBufferFull is the close reason of connections that exceeded MaxReadBufSize
+	ErrReadBufferFull = errors.New("max read buffer size exceeded")
+	// ErrHandlerPanic is the close reason of connections whose handler panicked
+	ErrHandlerPanic = errors.New("snail handler panicked")
 )
 
 // ServerConnHandler is the custom handler for a server connection. If the socket is closed, nil, nil is called
 type ServerConnHandler func(*snail_buffer.Buffer) error
 
 type SnailServer struct {
-	socket         net.Listener
+	sockets        []net.Listener // one per accept loop with ReusePort, otherwise shared by all loops
 	newHandlerFunc func(conn net.Conn) ServerConnHandler
 	opts           SnailServerOpts
+	tlsConfig      *tls.Config // nil if TLS is disabled
+	metrics        serverMetrics
+
+	connsLock sync.Mutex
+	conns     map[net.Conn]struct{}
+	connsWg   sync.WaitGroup
+	draining  atomic.Bool // set under connsLock when Shutdown is called, read without it on every read
+
+	connSlots chan struct{} // semaphore for MaxConnections, nil if unlimited
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
+// ConnLimitPolicy decides what happens to new connections once MaxConnections is reached
+type ConnLimitPolicy int
+
+const (
+	// ConnLimitReject accepts and immediately closes connections above the limit
+	ConnLimitReject ConnLimitPolicy = iota
+	// ConnLimitQueue stops accepting until a slot frees up. Pending connections
+	// wait in the OS listen backlog.
+	ConnLimitQueue
+)
+
 type SnailServerOpts struct {
-	//MaxConnections int // TODO: implement support for this
-	Optimization       OptimizationType
-	ReadBufSize        int // this=initial size. TODO: implement max-grow-size
-	Port               int
+	Optimization   OptimizationType
+	ReadBufSize    int    // initial size of each connection's read buffer
+	MaxReadBufSize int    // max bytes a connection may have buffered but not consumed. 0 = unlimited
+	Host           string // address to bind to. "" = all interfaces
+	Port           int
+	// Network is "tcp" (default) to accept both IPv4 and IPv6 when binding all interfaces,
+	// "tcp4" for IPv4 only, or "tcp6" for IPv6 only.
+	Network            string
 	TcpReadWindowSize  int
 	TcpWriteWindowSize int
+	MaxConnections     int // max concurrent connections. 0 = unlimited
+	ConnLimitPolicy    ConnLimitPolicy
+
+	// ReuseAddr sets SO_REUSEADDR on the listening socket, so the address can be bound again right
+	// away after a restart. ReusePort sets SO_REUSEPORT, letting several sockets bind the same address.
+	// Both are only supported on unix-like platforms.
+	ReuseAddr bool
+	ReusePort bool
+	// AcceptLoops is the number of goroutines accepting connections. Default 1. With ReusePort,
+	// each loop gets its own listening socket and the kernel spreads new connections over them,
+	// which scales better on many-core machines than loops sharing one socket.
+	AcceptLoops int
+
+	// IdleTimeout closes connections that receive nothing for this long. 0 = never
+	IdleTimeout time.Duration
+	// WriteTimeout is the deadline for each write to a connection, including the writes made
+	// by handlers. Writes that time out fail with ErrWriteTimeout. 0 = no deadline
+	WriteTimeout time.Duration
+	// KeepAlive configures TCP keepalive probes. They detect half-open connections, where the peer
+	// went away without closing, without closing connections that are just quiet. nil = Go's defaults
+	KeepAlive *net.KeepAliveConfig
+	// OnConnClose is called when a connection closes, before its handler is called with nil.
+	// The reason tells e.g. ErrIdleTimeout, ErrServerShutdown and io.EOF apart.
+	OnConnClose func(conn net.Conn, reason error)
+	// OnPanic is called when a connection's handler (or the handler factory) panics, after the panic
+	// has been recovered and logged with its stack. Only that connection is closed, with a reason
+	// wrapping ErrHandlerPanic.
+	OnPanic func(conn net.Conn, recovered any, stack []byte)
+
+	// TLSConfig enables TLS when set. For mutual TLS, set ClientAuth and ClientCAs.
+	// The handshake completes before the handler factory is called, see PeerCertificates.
+	TLSConfig *tls.Config
+	// TLSHandshakeTimeout bounds the TLS handshake of each connection. Default DefaultTLSHandshakeTimeout
+	TLSHandshakeTimeout time.Duration
+
+	// Metrics, if set, receives connection counts and bytes read and written. Use
+	// snail_metrics.WithLabels to tell several servers apart.
+	Metrics snail_metrics.Metrics
 }
 
 func (s SnailServerOpts) WithDefaults() SnailServerOpts {
@@ -32,46 +115,183 @@ func (s SnailServerOpts) WithDefaults() SnailServerOpts {
 	if res.ReadBufSize == 0 {
 		res.ReadBufSize = 64 * 1024
 	}
+	if res.Network == "" {
+		res.Network = "tcp"
+	}
+	if res.AcceptLoops == 0 {
+		res.AcceptLoops = 1
+	}
+	if res.TLSHandshakeTimeout == 0 {
+		res.TLSHandshakeTimeout = DefaultTLSHandshakeTimeout
+	}
 	return res
 }
 
+// NewServer listens on opts.Host and opts.Port, see NewServerWithAddress
 func NewServer(
 	newHandlerFunc func(conn net.Conn) ServerConnHandler,
 	optsPtr *SnailServerOpts,
 ) (*SnailServer, error) {
+	opts := SnailServerOpts{}
+	if optsPtr != nil {
+		opts = *optsPtr
+	}
+	opts = opts.WithDefaults()
+	return NewServerWithAddress(opts.Network, net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port)), newHandlerFunc, &opts)
+}
 
-	opts := func() SnailServerOpts {
-		if optsPtr == nil {
-			return SnailServerOpts{}
-		}
-		return *optsPtr
-	}().WithDefaults()
+// NewServerWithAddress listens on the given network and address, as in net.Listen,
+// e.g. ("unix", "/run/snail.sock"). opts.Host, opts.Port and opts.Network are ignored.
+func NewServerWithAddress(
+	network string,
+	address string,
+	newHandlerFunc func(conn net.Conn) ServerConnHandler,
+	optsPtr *SnailServerOpts,
+) (*SnailServer, error) {
+	opts := SnailServerOpts{}
+	if optsPtr != nil {
+		opts = *optsPtr
+	}
+	opts = opts.WithDefaults()
 
-	socket, err := net.Listen("tcp", fmt.Sprintf(":%d", opts.Port))
+	sockets, err := listen(network, address, opts)
 	if err != nil {
 		return nil, err
 	}
+	return newServer(sockets, newHandlerFunc, opts), nil
+}
+
+// NewServerWithListener serves connections accepted from socket, which the server takes
+// ownership of. The socket options in SnailServerOpts are applied when the accepted
+// connection supports them. The options for binding, such as opts.Port, are ignored.
+func NewServerWithListener(
+	socket net.Listener,
+	newHandlerFunc func(conn net.Conn) ServerConnHandler,
+	optsPtr *SnailServerOpts,
+) (*SnailServer, error) {
+	opts := SnailServerOpts{}
+	if optsPtr != nil {
+		opts = *optsPtr
+	}
+	return newServer([]net.Listener{socket}, newHandlerFunc, opts.WithDefaults()), nil
+}
+
+// listen opens the listening sockets. With ReusePort, every accept loop gets its own socket
+// bound to the same address.
+func listen(network string, address string, opts SnailServerOpts) ([]net.Listener, error) {
+
+	config := net.ListenConfig{Control: listenControl(opts)}
+
+	first, err := config.Listen(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	sockets := []net.Listener{first}
+
+	if opts.ReusePort {
+		address = first.Addr().String() // the port actually bound, if port 0 was requested
+		for len(sockets) < opts.AcceptLoops {
+			socket, err := config.Listen(context.Background(), network, address)
+			if err != nil {
+				for _, s := range sockets {
+					_ = s.Close()
+				}
+				return nil, fmt.Errorf("failed to open listening socket %d of %d: %w", len(sockets)+1, opts.AcceptLoops, err)
+			}
+			sockets = append(sockets, socket)
+		}
+	}
+
+	return sockets, nil
+}
+
+// listenControl returns the ListenConfig.Control function setting the socket options in opts
+func listenControl(opts SnailServerOpts) func(network, address string, c syscall.RawConn) error {
+	if !opts.ReuseAddr && !opts.ReusePort {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			if opts.ReuseAddr {
+				if sockErr = setReuseAddr(fd); sockErr != nil {
+					sockErr = fmt.Errorf("failed to set SO_REUSEADDR: %w", sockErr)
+					return
+				}
+			}
+			if opts.ReusePort {
+				if sockErr = setReusePort(fd); sockErr != nil {
+					sockErr = fmt.Errorf("failed to set SO_REUSEPORT: %w", sockErr)
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
+func newServer(
+	sockets []net.Listener,
+	newHandlerFunc func(conn net.Conn) ServerConnHandler,
+	opts SnailServerOpts,
+) *SnailServer {
 
 	res := &SnailServer{
-		socket:         socket,
+		sockets:        sockets,
 		newHandlerFunc: newHandlerFunc,
 		opts:           opts,
+		conns:          make(map[net.Conn]struct{}),
+		closed:         make(chan struct{}),
+		metrics:        newServerMetrics(opts.Metrics),
+	}
+
+	if opts.TLSConfig != nil {
+		res.tlsConfig = tlsConfigFor(opts.TLSConfig, opts.Optimization)
 	}
 
-	go res.loopConnections()
+	if opts.MaxConnections > 0 {
+		res.connSlots = make(chan struct{}, opts.MaxConnections)
+	}
 
-	return res, nil
+	for i := 0; i < opts.AcceptLoops; i++ {
+		go res.loopConnections(sockets[i%len(sockets)])
+	}
+
+	return res
 }
 
+// Addr returns the address the server listens on
+func (s *SnailServer) Addr() net.Addr {
+	return s.sockets[0].Addr()
+}
+
+// Port returns the port the server listens on, or 0 if it isn't listening on TCP
 func (s *SnailServer) Port() int {
-	return s.socket.Addr().(*net.TCPAddr).Port
+	if addr, ok := s.Addr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
 }
 
-func (s *SnailServer) loopConnections() {
+func (s *SnailServer) loopConnections(socket net.Listener) {
 
 	for {
-		conn, err := s.socket.Accept()
+		if s.connSlots != nil && s.opts.ConnLimitPolicy == ConnLimitQueue {
+			select {
+			case s.connSlots <- struct{}{}:
+			case <-s.closed:
+				slog.Debug("Server socket is closed, shutting down server")
+				return
+			}
+		}
+
+		conn, err := socket.Accept()
 		if err != nil {
+			if s.connSlots != nil && s.opts.ConnLimitPolicy == ConnLimitQueue {
+				<-s.connSlots
+			}
 			// if is socket closed, exit
 			if errors.Is(err, net.ErrClosed) {
 				slog.Debug("Server socket is closed, shutting down server")
@@ -81,30 +301,35 @@ func (s *SnailServer) loopConnections() {
 			continue
 		}
 
-		if s.opts.Optimization == OptimizeForThroughput {
-			err = conn.(*net.TCPConn).SetNoDelay(false) // we favor latency over throughput here.
-			if err != nil {
-				slog.Error(fmt.Sprintf("Failed to set TCP_NODELAY=false: %v. Proceeding anyway :S", err))
-			}
-		} else {
-			err = conn.(*net.TCPConn).SetNoDelay(true) // we favor latency over throughput here.
-			if err != nil {
-				slog.Error(fmt.Sprintf("Failed to set TCP_NODELAY=true: %v. Proceeding anyway :S", err))
+		if s.connSlots != nil && s.opts.ConnLimitPolicy == ConnLimitReject {
+			select {
+			case s.connSlots <- struct{}{}:
+			default:
+				slog.Warn(
+					"Max connections reached, rejecting connection",
+					slog.String("remote_addr", conn.RemoteAddr().String()),
+					slog.Int("max_connections", s.opts.MaxConnections),
+				)
+				_ = conn.Close()
+				s.metrics.rejected.Add(1)
+				continue
 			}
 		}
+		s.metrics.accepted.Add(1)
 
-		if s.opts.TcpReadWindowSize > 0 {
-			err = conn.(*net.TCPConn).SetReadBuffer(s.opts.TcpReadWindowSize)
-			if err != nil {
-				slog.Error(fmt.Sprintf("Failed to set TCP read buffer size: %v. Proceeding anyway :S", err))
-			}
+		configureConn(conn, s.opts.Optimization, s.opts.TcpReadWindowSize, s.opts.TcpWriteWindowSize, s.opts.KeepAlive)
+		if s.metrics.enabled {
+			conn = &countingConn{Conn: conn, metrics: &s.metrics.bytes}
+		}
+		if s.tlsConfig != nil {
+			conn = tls.Server(conn, s.tlsConfig)
 		}
 
-		if s.opts.TcpWriteWindowSize > 0 {
-			err = conn.(*net.TCPConn).SetWriteBuffer(s.opts.TcpWriteWindowSize)
-			if err != nil {
-				slog.Error(fmt.Sprintf("Failed to set TCP write buffer size: %v. Proceeding anyway :S", err))
-			}
+		if !s.trackConn(conn) {
+			slog.Debug("Server is shutting down, rejecting connection", slog.String("remote_addr", conn.RemoteAddr().String()))
+			_ = conn.Close()
+			s.releaseConnSlot()
+			continue
 		}
 
 		slog.Debug("Accepted connection", slog.String("remote_addr", conn.RemoteAddr().String()))
@@ -112,47 +337,223 @@ func (s *SnailServer) loopConnections() {
 	}
 }
 
+func (s *SnailServer) trackConn(conn net.Conn) bool {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+	if s.draining.Load() {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.connsWg.Add(1)
+	s.metrics.active.Add(1)
+	return true
+}
+
+func (s *SnailServer) untrackConn(conn net.Conn) {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+	delete(s.conns, conn)
+	s.metrics.active.Add(-1)
+	s.releaseConnSlot()
+	s.connsWg.Done()
+}
+
+func (s *SnailServer) releaseConnSlot() {
+	if s.connSlots != nil {
+		<-s.connSlots
+	}
+}
+
+// ActiveConnections returns the number of currently open connections
+func (s *SnailServer) ActiveConnections() int {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+	return len(s.conns)
+}
+
+// Close closes the listening sockets. Connections that are already established are left running,
+// see Shutdown for closing those too.
 func (s *SnailServer) Close() {
-	err := s.socket.Close()
-	if err != nil {
-		slog.Error(fmt.Sprintf("Failed to close socket: %v", err))
+	s.closeOnce.Do(func() { close(s.closed) })
+	for _, socket := range s.sockets {
+		err := socket.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			slog.Error(fmt.Sprintf("Failed to close socket: %v", err))
+		}
+	}
+}
+
+// Shutdown gracefully shuts down the server. It stops accepting new connections and stops reading
+// from the existing ones. Each connection's handler is then called with nil, so it can finish
+// in-flight work and flush pending writes, after which the connection is closed.
+//
+// Shutdown returns nil once all connections are closed. If the context is done first, the
+// remaining connections are closed forcefully and the context's error is returned.
+func (s *SnailServer) Shutdown(ctx context.Context) error {
+
+	s.connsLock.Lock()
+	s.draining.Store(true)
+	conns := make([]net.Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.connsLock.Unlock()
+
+	s.Close()
+
+	// Wake up all connections blocked in Read. They see that we are draining and stop reading.
+	for _, conn := range conns {
+		if err := conn.SetReadDeadline(time.Now()); err != nil {
+			slog.Debug(fmt.Sprintf("Failed to set read deadline during shutdown: %v", err))
+		}
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.connsWg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		s.connsLock.Lock()
+		for conn := range s.conns {
+			_ = conn.Close()
+		}
+		s.connsLock.Unlock()
+		return ctx.Err()
 	}
 }
 
 func (s *SnailServer) loopConnection(conn net.Conn) {
+	defer s.untrackConn(conn)
+
+	// Handshake here rather than in the accept loop, so that slow clients don't hold up others
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := handshake(tlsConn, s.opts.TLSHandshakeTimeout); err != nil {
+			slog.Warn(
+				"Closing connection",
+				slog.String("remote_addr", conn.RemoteAddr().String()),
+				slog.String("error", err.Error()),
+			)
+			if s.opts.OnConnClose != nil {
+				s.opts.OnConnClose(conn, err)
+			}
+			_ = conn.Close()
+			return
+		}
+	}
+
+	// Handlers write through this one, so that their writes get the write deadline
+	handlerConn := withWriteTimeout(conn, s.opts.WriteTimeout)
+
 	// read all messages see https://stackoverflow.com/questions/51046139/reading-data-from-socket-golang
 	accumBuf := snail_buffer.New(snail_buffer.BigEndian, s.opts.ReadBufSize)
-	handler := s.newHandlerFunc(conn)
+	var handler ServerConnHandler
+	err := s.recoverPanic(conn, func() error {
+		handler = s.newHandlerFunc(handlerConn)
+		return nil
+	})
+	if err != nil {
+		if s.opts.OnConnClose != nil {
+			s.opts.OnConnClose(handlerConn, err)
+		}
+		_ = conn.Close()
+		return
+	}
 
-	defer func() {
-		err := conn.Close()
+	reason := s.readUntilClosed(conn, handler, accumBuf)
+	if s.opts.OnConnClose != nil {
+		s.opts.OnConnClose(handlerConn, reason)
+	}
+
+	// The handler is notified before the socket is closed, so that it still
+	// gets a chance to flush any pending writes
+	err = s.recoverPanic(conn, func() error { return handler(nil) })
+	if err != nil {
+		slog.Error(fmt.Sprintf("Failed to handle connection after close: %v", err))
+	}
+	err = conn.Close()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		slog.Error(fmt.Sprintf("Failed to close connection: %v", err))
+	}
+}
+
+// readUntilClosed passes data from the connection to the handler until the connection
+// should be closed. The reason is returned.
+func (s *SnailServer) readUntilClosed(conn net.Conn, handler ServerConnHandler, accumBuf *snail_buffer.Buffer) error {
+
+	for {
+
+		err := setIdleDeadline(conn, s.opts.IdleTimeout)
 		if err != nil {
-			slog.Error(fmt.Sprintf("Failed to close connection: %v", err))
+			slog.Error(fmt.Sprintf("Failed to set idle deadline: %v", err))
+			return err
 		}
-		err = handler(nil)
-		if err != nil {
-			slog.Error(fmt.Sprintf("Failed to handle connection after close: %v", err))
+		// Shutdown wakes up readers with a deadline in the past, which we may just have overwritten
+		if s.draining.Load() {
+			slog.Debug("Server is shutting down, closing connection")
+			return ErrServerShutdown
 		}
-	}()
-
-	for {
 
-		err := ReadToBuffer(s.opts.ReadBufSize/5, conn, accumBuf)
+		err = ReadToBuffer(s.opts.ReadBufSize/5, conn, accumBuf)
 		if err != nil {
-			if errors.Is(err, io.EOF) {
+			if s.draining.Load() {
+				slog.Debug("Server is shutting down, closing connection")
+				return ErrServerShutdown
+			} else if errors.Is(err, io.EOF) {
 				slog.Debug("EOF, closing connection")
-				return
+				return err
+			} else if s.opts.IdleTimeout > 0 && errors.Is(err, os.ErrDeadlineExceeded) {
+				slog.Debug("Connection idle timeout, closing connection", slog.String("remote_addr", conn.RemoteAddr().String()))
+				return idleTimeoutReason(err)
 			} else {
 				slog.Error(fmt.Sprintf("Failed to read from connection: %v", err))
-				return
+				return err
 			}
 		}
 
-		err = handler(accumBuf)
-		if err != nil {
+		err = s.recoverPanic(conn, func() error { return handler(accumBuf) })
+		if errors.Is(err, ErrHandlerPanic) {
+			return err
+		} else if err != nil {
 			slog.Error(fmt.Sprintf("Failed to handle connection data: %v", err))
-			return
+			return fmt.Errorf("failed to handle connection data: %w", err)
 		}
 		accumBuf.DiscardReadBytes()
+
+		if s.opts.MaxReadBufSize > 0 && accumBuf.NumBytesReadable() > s.opts.MaxReadBufSize {
+			slog.Warn(
+				"Connection exceeded max read buffer size without its data being consumed, closing it",
+				slog.String("remote_addr", conn.RemoteAddr().String()),
+				slog.Int("buffered_bytes", accumBuf.NumBytesReadable()),
+				slog.Int("max_read_buf_size", s.opts.MaxReadBufSize),
+			)
+			return ErrReadBufferFull
+		}
 	}
 }
+
+// recoverPanic calls f, turning a panic into an error wrapping ErrHandlerPanic. Panics are
+// logged with their stack and the connection's addresses, and reported to OnPanic.
+func (s *SnailServer) recoverPanic(conn net.Conn, f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := debug.Stack()
+			slog.Error(
+				"Recovered from panic in connection handler, closing connection",
+				slog.String("remote_addr", conn.RemoteAddr().String()),
+				slog.String("local_addr", conn.LocalAddr().String()),
+				slog.Any("panic", r),
+				slog.String("stack", string(stack)),
+			)
+			if s.opts.OnPanic != nil {
+				s.opts.OnPanic(conn, r, stack)
+			}
+			err = fmt.Errorf("%w: %v", ErrHandlerPanic, r)
+		}
+	}()
+	return f()
+}
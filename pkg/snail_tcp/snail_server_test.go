@@ -1,6 +1,7 @@
 package snail_tcp
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/GiGurra/snail/pkg/snail_buffer"
@@ -13,6 +14,7 @@ import (
 	"io"
 	"log/slog"
 	"net"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -732,3 +734,535 @@ func TestTcpRefReqRespRate_routines(t *testing.T) {
 	}
 
 }
+
+func TestServer_Shutdown(t *testing.T) {
+
+	snail_logging.ConfigureDefaultLogger("json", "info", false)
+
+	recvCh := make(chan []byte, 1)
+	closedCh := make(chan struct{})
+
+	newHandlerFunc := func(_ net.Conn) ServerConnHandler {
+		return func(buffer *snail_buffer.Buffer) error {
+			if buffer == nil {
+				close(closedCh)
+				return nil
+			}
+			recvCh <- buffer.ReadAll()
+			return nil
+		}
+	}
+
+	server, err := NewServer(newHandlerFunc, nil)
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+
+	client, err := NewClient("localhost", server.Port(), nil, func(buffer *snail_buffer.Buffer) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	defer client.Close()
+
+	err = client.SendBytes([]byte("Hello World!"))
+	if err != nil {
+		t.Fatalf("error sending msg: %v", err)
+	}
+	<-recvCh
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("error shutting down server: %v", err)
+	}
+
+	select {
+	case <-closedCh:
+	default:
+		t.Fatalf("expected handler to have been notified of the close")
+	}
+}
+
+func TestServer_Shutdown_contextExpires(t *testing.T) {
+
+	snail_logging.ConfigureDefaultLogger("json", "info", false)
+
+	handling := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+
+	newHandlerFunc := func(_ net.Conn) ServerConnHandler {
+		return func(buffer *snail_buffer.Buffer) error {
+			if buffer == nil {
+				return nil
+			}
+			close(handling)
+			<-release // a handler that never finishes in time
+			return nil
+		}
+	}
+
+	server, err := NewServer(newHandlerFunc, nil)
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+
+	client, err := NewClient("localhost", server.Port(), nil, func(buffer *snail_buffer.Buffer) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	defer client.Close()
+
+	err = client.SendBytes([]byte("Hello World!"))
+	if err != nil {
+		t.Fatalf("error sending msg: %v", err)
+	}
+	<-handling
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestServer_MaxConnections_reject(t *testing.T) {
+
+	snail_logging.ConfigureDefaultLogger("json", "info", false)
+
+	server, err := NewServer(func(_ net.Conn) ServerConnHandler {
+		return func(buffer *snail_buffer.Buffer) error { return nil }
+	}, &SnailServerOpts{MaxConnections: 1})
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+	defer server.Close()
+
+	first, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", server.Port()))
+	if err != nil {
+		t.Fatalf("error dialing server: %v", err)
+	}
+	defer func() { _ = first.Close() }()
+
+	waitFor(t, func() bool { return server.ActiveConnections() == 1 })
+
+	second, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", server.Port()))
+	if err != nil {
+		t.Fatalf("error dialing server: %v", err)
+	}
+	defer func() { _ = second.Close() }()
+
+	// The server closes the second connection right away
+	_ = second.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, err = second.Read(make([]byte, 1))
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("expected EOF on rejected connection, got %v", err)
+	}
+	if server.ActiveConnections() != 1 {
+		t.Fatalf("expected 1 active connection, got %d", server.ActiveConnections())
+	}
+}
+
+func TestServer_MaxConnections_queue(t *testing.T) {
+
+	snail_logging.ConfigureDefaultLogger("json", "info", false)
+
+	recvCh := make(chan []byte, 10)
+	server, err := NewServer(func(_ net.Conn) ServerConnHandler {
+		return func(buffer *snail_buffer.Buffer) error {
+			if buffer != nil {
+				recvCh <- buffer.ReadAll()
+			}
+			return nil
+		}
+	}, &SnailServerOpts{MaxConnections: 1, ConnLimitPolicy: ConnLimitQueue})
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+	defer server.Close()
+
+	first, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", server.Port()))
+	if err != nil {
+		t.Fatalf("error dialing server: %v", err)
+	}
+	waitFor(t, func() bool { return server.ActiveConnections() == 1 })
+
+	second, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", server.Port()))
+	if err != nil {
+		t.Fatalf("error dialing server: %v", err)
+	}
+	defer func() { _ = second.Close() }()
+	_, err = second.Write([]byte("queued"))
+	if err != nil {
+		t.Fatalf("error writing: %v", err)
+	}
+
+	select {
+	case <-recvCh:
+		t.Fatalf("expected second connection to be queued")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	_ = first.Close()
+
+	select {
+	case msg := <-recvCh:
+		if string(msg) != "queued" {
+			t.Fatalf("expected 'queued', got '%s'", string(msg))
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("timeout waiting for queued connection to be served")
+	}
+}
+
+func TestServer_MaxReadBufSize(t *testing.T) {
+
+	snail_logging.ConfigureDefaultLogger("json", "info", false)
+
+	closedCh := make(chan struct{})
+	server, err := NewServer(func(_ net.Conn) ServerConnHandler {
+		return func(buffer *snail_buffer.Buffer) error {
+			if buffer == nil {
+				close(closedCh)
+			}
+			return nil // never consumes anything, like a parser waiting for a newline
+		}
+	}, &SnailServerOpts{ReadBufSize: 1024, MaxReadBufSize: 64 * 1024})
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", server.Port()))
+	if err != nil {
+		t.Fatalf("error dialing server: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	go func() {
+		chunk := make([]byte, 16*1024)
+		for i := 0; i < 64; i++ {
+			if _, err := conn.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-closedCh:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expected connection to be closed")
+	}
+}
+
+func TestServer_unixSocket(t *testing.T) {
+
+	snail_logging.ConfigureDefaultLogger("json", "info", false)
+
+	path := filepath.Join(t.TempDir(), "snail.sock")
+	server, recvCh := newRecordingServerWith(t, func(handler func(conn net.Conn) ServerConnHandler) (*SnailServer, error) {
+		return NewServerWithAddress("unix", path, handler, &SnailServerOpts{TcpReadWindowSize: 64 * 1024})
+	})
+	defer server.Close()
+
+	if server.Addr().Network() != "unix" || server.Addr().String() != path {
+		t.Fatalf("expected unix address %s, got %v", path, server.Addr())
+	}
+	if server.Port() != 0 {
+		t.Fatalf("expected port 0 for a unix socket, got %d", server.Port())
+	}
+
+	client, err := NewClientWithAddress("unix", path, &SnailClientOpts{TcpSendWindowSize: 64 * 1024}, func(buffer *snail_buffer.Buffer) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.SendBytes([]byte("Hello Unix!")); err != nil {
+		t.Fatalf("error sending msg: %v", err)
+	}
+
+	select {
+	case msg := <-recvCh:
+		if msg != "Hello Unix!" {
+			t.Fatalf("expected msg 'Hello Unix!', got '%s'", msg)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("timeout waiting for message")
+	}
+}
+
+func TestServer_bindHost(t *testing.T) {
+
+	snail_logging.ConfigureDefaultLogger("json", "info", false)
+
+	cases := []struct {
+		network string
+		host    string
+	}{
+		{network: "tcp", host: "127.0.0.1"},
+		{network: "tcp4", host: ""},
+		{network: "tcp6", host: "::1"},
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%s/%s", c.network, c.host), func(t *testing.T) {
+			server, recvCh := newRecordingServerWith(t, func(handler func(conn net.Conn) ServerConnHandler) (*SnailServer, error) {
+				return NewServer(handler, &SnailServerOpts{Network: c.network, Host: c.host})
+			})
+			defer server.Close()
+
+			addr := server.Addr().(*net.TCPAddr)
+			if c.host != "" && addr.IP.String() != c.host {
+				t.Fatalf("expected server bound to %s, got %v", c.host, addr)
+			}
+
+			dialHost := c.host
+			if dialHost == "" {
+				dialHost = "127.0.0.1"
+			}
+			client, err := NewClient(dialHost, server.Port(), nil, func(buffer *snail_buffer.Buffer) error {
+				return nil
+			})
+			if err != nil {
+				if c.network == "tcp6" {
+					t.Skipf("IPv6 loopback not available: %v", err)
+				}
+				t.Fatalf("error creating client: %v", err)
+			}
+			defer client.Close()
+
+			if err := client.SendBytes([]byte("Hello")); err != nil {
+				t.Fatalf("error sending msg: %v", err)
+			}
+			select {
+			case <-recvCh:
+			case <-time.After(1 * time.Second):
+				t.Fatalf("timeout waiting for message")
+			}
+		})
+	}
+}
+
+func TestServer_acceptLoops(t *testing.T) {
+
+	snail_logging.ConfigureDefaultLogger("json", "info", false)
+
+	for _, reusePort := range []bool{false, true} {
+		t.Run(fmt.Sprintf("reusePort=%v", reusePort), func(t *testing.T) {
+			server, recvCh := newRecordingServerWith(t, func(handler func(conn net.Conn) ServerConnHandler) (*SnailServer, error) {
+				return NewServer(handler, &SnailServerOpts{
+					Host:        "127.0.0.1",
+					ReuseAddr:   true,
+					ReusePort:   reusePort,
+					AcceptLoops: 4,
+				})
+			})
+			defer server.Close()
+
+			if reusePort && len(server.sockets) != 4 {
+				t.Fatalf("expected 4 listening sockets, got %d", len(server.sockets))
+			}
+
+			nClients := 20
+			for i := 0; i < nClients; i++ {
+				client, err := NewClient("127.0.0.1", server.Port(), nil, func(buffer *snail_buffer.Buffer) error {
+					return nil
+				})
+				if err != nil {
+					t.Fatalf("error creating client: %v", err)
+				}
+				defer client.Close()
+				if err := client.SendBytes([]byte("Hello")); err != nil {
+					t.Fatalf("error sending msg: %v", err)
+				}
+			}
+
+			for i := 0; i < nClients; i++ {
+				select {
+				case <-recvCh:
+				case <-time.After(1 * time.Second):
+					t.Fatalf("timeout waiting for message %d", i)
+				}
+			}
+
+			server.Close()
+			_, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", server.Port()), 100*time.Millisecond)
+			if err == nil {
+				t.Fatalf("expected all listening sockets to be closed")
+			}
+		})
+	}
+}
+
+// pipeListener is an in-memory net.Listener, whose connections support none of the socket options
+type pipeListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+func (l *pipeListener) Dial() (net.Conn, error) {
+	serverSide, clientSide := net.Pipe()
+	select {
+	case l.conns <- serverSide:
+		return clientSide, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+func TestServer_customListenerAndDialer(t *testing.T) {
+
+	snail_logging.ConfigureDefaultLogger("json", "info", false)
+
+	listener := newPipeListener()
+	server, recvCh := newRecordingServerWith(t, func(handler func(conn net.Conn) ServerConnHandler) (*SnailServer, error) {
+		return NewServerWithListener(listener, handler, &SnailServerOpts{
+			Optimization:       OptimizeForThroughput,
+			TcpReadWindowSize:  64 * 1024,
+			TcpWriteWindowSize: 64 * 1024,
+		})
+	})
+	defer server.Close()
+
+	client, err := NewClientWithDialer(listener.Dial, &SnailClientOpts{TcpSendWindowSize: 64 * 1024}, func(buffer *snail_buffer.Buffer) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.SendBytes([]byte("Hello Pipe!")); err != nil {
+		t.Fatalf("error sending msg: %v", err)
+	}
+
+	select {
+	case msg := <-recvCh:
+		if msg != "Hello Pipe!" {
+			t.Fatalf("expected msg 'Hello Pipe!', got '%s'", msg)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("timeout waiting for message")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("error shutting down server: %v", err)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(1 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for condition")
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+}
+
+func TestServer_handlerPanic(t *testing.T) {
+
+	snail_logging.ConfigureDefaultLogger("json", "error", false)
+
+	panics := make(chan any, 10)
+	reasons := make(chan error, 10)
+	server, err := NewServer(func(conn net.Conn) ServerConnHandler {
+		return func(buffer *snail_buffer.Buffer) error {
+			if buffer == nil {
+				return nil
+			}
+			data := buffer.ReadAll()
+			if string(data) == "boom" {
+				panic("malformed request")
+			}
+			return SendAll(conn, data)
+		}
+	}, &SnailServerOpts{
+		OnPanic:     func(_ net.Conn, recovered any, _ []byte) { panics <- recovered },
+		OnConnClose: func(_ net.Conn, reason error) { reasons <- reason },
+	})
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+	defer server.Close()
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", server.Port()))
+		if err != nil {
+			t.Fatalf("error dialing server: %v", err)
+		}
+		return conn
+	}
+
+	healthy := dial()
+	defer func() { _ = healthy.Close() }()
+	bad := dial()
+	defer func() { _ = bad.Close() }()
+
+	if _, err := bad.Write([]byte("boom")); err != nil {
+		t.Fatalf("error writing: %v", err)
+	}
+
+	select {
+	case recovered := <-panics:
+		if recovered != "malformed request" {
+			t.Fatalf("unexpected panic value: %v", recovered)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expected OnPanic to be called")
+	}
+	if reason := awaitReason(t, reasons); !errors.Is(reason, ErrHandlerPanic) {
+		t.Fatalf("expected ErrHandlerPanic, got %v", reason)
+	}
+	if _, err := bad.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected the panicking connection to be closed, got %v", err)
+	}
+
+	// The other connection is unaffected
+	if _, err := healthy.Write([]byte("ok")); err != nil {
+		t.Fatalf("error writing: %v", err)
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(healthy, buf); err != nil || string(buf) != "ok" {
+		t.Fatalf("expected echo on the healthy connection, got %q, %v", buf, err)
+	}
+}
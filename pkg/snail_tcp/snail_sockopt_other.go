@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package snail_tcp
+
+import "errors"
+
+var errSockoptNotSupported = errors.New("not supported on this platform")
+
+func setReuseAddr(_ uintptr) error {
+	return errSockoptNotSupported
+}
+
+func setReusePort(_ uintptr) error {
+	return errSockoptNotSupported
+}
@@ -0,0 +1,65 @@
+package snail_tcp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+var (
+	// ErrIdleTimeout is the close reason of a connection that received nothing for IdleTimeout
+	ErrIdleTimeout = errors.New("connection idle timeout")
+	// ErrWriteTimeout is returned by writes that did not complete within WriteTimeout
+	ErrWriteTimeout = errors.New("connection write timeout")
+)
+
+// writeTimeoutConn sets a new write deadline before every write, so that a peer that
+// stops reading can't block writers forever
+type writeTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func withWriteTimeout(conn net.Conn, timeout time.Duration) net.Conn {
+	if timeout <= 0 {
+		return conn
+	}
+	return &writeTimeoutConn{Conn: conn, timeout: timeout}
+}
+
+func (c *writeTimeoutConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, fmt.Errorf("failed to set write deadline: %w", err)
+	}
+	n, err := c.Conn.Write(b)
+	if err != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+		return n, fmt.Errorf("%w: %w", ErrWriteTimeout, err)
+	}
+	return n, err
+}
+
+// NetConn returns the wrapped connection, like tls.Conn.NetConn
+func (c *writeTimeoutConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// setIdleDeadline makes the next read fail if nothing arrives within timeout. 0 disables it.
+func setIdleDeadline(conn net.Conn, timeout time.Duration) error {
+	if timeout <= 0 {
+		return nil
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return fmt.Errorf("failed to set read deadline: %w", err)
+	}
+	return nil
+}
+
+// idleTimeoutReason turns the error of a read that hit its idle deadline into ErrIdleTimeout
+func idleTimeoutReason(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrIdleTimeout, err)
+	}
+	return err
+}
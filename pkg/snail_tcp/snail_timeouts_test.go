@@ -0,0 +1,184 @@
+package snail_tcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/GiGurra/snail/pkg/snail_buffer"
+	"github.com/GiGurra/snail/pkg/snail_logging"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newCloseReasonServer records the close reason of every connection
+func newCloseReasonServer(t *testing.T, opts SnailServerOpts) (*SnailServer, chan error) {
+	reasons := make(chan error, 10)
+	opts.OnConnClose = func(_ net.Conn, reason error) { reasons <- reason }
+	server, err := NewServer(func(_ net.Conn) ServerConnHandler {
+		return func(buffer *snail_buffer.Buffer) error {
+			if buffer != nil {
+				buffer.ReadAll()
+			}
+			return nil
+		}
+	}, &opts)
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+	return server, reasons
+}
+
+func awaitReason(t *testing.T, reasons chan error) error {
+	t.Helper()
+	select {
+	case reason := <-reasons:
+		return reason
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for connection to close")
+		return nil
+	}
+}
+
+func TestServer_closeReasons(t *testing.T) {
+
+	snail_logging.ConfigureDefaultLogger("json", "info", false)
+
+	t.Run("idle timeout", func(t *testing.T) {
+		server, reasons := newCloseReasonServer(t, SnailServerOpts{
+			IdleTimeout: 50 * time.Millisecond,
+			KeepAlive:   &net.KeepAliveConfig{Enable: true, Idle: 1 * time.Second, Interval: 1 * time.Second, Count: 3},
+		})
+		defer server.Close()
+
+		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", server.Port()))
+		if err != nil {
+			t.Fatalf("error dialing server: %v", err)
+		}
+		defer func() { _ = conn.Close() }()
+
+		// Traffic keeps the connection open
+		for i := 0; i < 5; i++ {
+			time.Sleep(25 * time.Millisecond)
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatalf("error writing: %v", err)
+			}
+		}
+		if server.ActiveConnections() != 1 {
+			t.Fatalf("expected the connection to stay open while active")
+		}
+
+		if reason := awaitReason(t, reasons); !errors.Is(reason, ErrIdleTimeout) {
+			t.Fatalf("expected ErrIdleTimeout, got %v", reason)
+		}
+	})
+
+	t.Run("eof", func(t *testing.T) {
+		server, reasons := newCloseReasonServer(t, SnailServerOpts{IdleTimeout: 1 * time.Minute})
+		defer server.Close()
+
+		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", server.Port()))
+		if err != nil {
+			t.Fatalf("error dialing server: %v", err)
+		}
+		_ = conn.Close()
+
+		if reason := awaitReason(t, reasons); !errors.Is(reason, io.EOF) {
+			t.Fatalf("expected io.EOF, got %v", reason)
+		}
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		server, reasons := newCloseReasonServer(t, SnailServerOpts{IdleTimeout: 1 * time.Minute})
+
+		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", server.Port()))
+		if err != nil {
+			t.Fatalf("error dialing server: %v", err)
+		}
+		defer func() { _ = conn.Close() }()
+		waitFor(t, func() bool { return server.ActiveConnections() == 1 })
+
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			t.Fatalf("error shutting down server: %v", err)
+		}
+
+		if reason := awaitReason(t, reasons); !errors.Is(reason, ErrServerShutdown) {
+			t.Fatalf("expected ErrServerShutdown, got %v", reason)
+		}
+	})
+}
+
+func TestServer_WriteTimeout(t *testing.T) {
+
+	snail_logging.ConfigureDefaultLogger("json", "info", false)
+
+	writeErrs := make(chan error, 1)
+	server, err := NewServer(func(conn net.Conn) ServerConnHandler {
+		go func() {
+			// Write until the client, which never reads, has filled up all buffers
+			chunk := make([]byte, 1024*1024)
+			for {
+				if err := SendAll(conn, chunk); err != nil {
+					writeErrs <- err
+					return
+				}
+			}
+		}()
+		return func(buffer *snail_buffer.Buffer) error { return nil }
+	}, &SnailServerOpts{WriteTimeout: 100 * time.Millisecond, TcpWriteWindowSize: 64 * 1024})
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", server.Port()))
+	if err != nil {
+		t.Fatalf("error dialing server: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	select {
+	case err := <-writeErrs:
+		if !errors.Is(err, ErrWriteTimeout) {
+			t.Fatalf("expected ErrWriteTimeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for write to time out")
+	}
+}
+
+func TestClient_IdleTimeout(t *testing.T) {
+
+	snail_logging.ConfigureDefaultLogger("json", "info", false)
+
+	server, _ := newRecordingServer(t, 0) // never replies
+	defer server.Close()
+
+	disconnects := make(chan error, 1)
+	client, err := NewClient("localhost", server.Port(), &SnailClientOpts{
+		IdleTimeout:  50 * time.Millisecond,
+		OnDisconnect: func(err error) { disconnects <- err },
+	}, func(buffer *snail_buffer.Buffer) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	defer client.Close()
+
+	select {
+	case <-client.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected client to stop after idle timeout")
+	}
+
+	if !errors.Is(client.Err(), ErrIdleTimeout) {
+		t.Fatalf("expected ErrIdleTimeout, got %v", client.Err())
+	}
+	if err := <-disconnects; !errors.Is(err, ErrIdleTimeout) {
+		t.Fatalf("expected OnDisconnect with ErrIdleTimeout, got %v", err)
+	}
+}
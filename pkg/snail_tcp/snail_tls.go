@@ -0,0 +1,53 @@
+package snail_tcp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DefaultTLSHandshakeTimeout is used when TLS is enabled and no handshake timeout is set
+const DefaultTLSHandshakeTimeout = 10 * time.Second
+
+// PeerCertificates returns the certificates presented by the other side of a TLS connection,
+// leaf first. It returns nil if the connection is not TLS, or the peer sent no certificate.
+//
+// On the server, the connection passed to the handler factory has already completed its
+// handshake, so with mutual TLS this is where the client's identity can be checked.
+func PeerCertificates(conn net.Conn) []*x509.Certificate {
+	for conn != nil {
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			return tlsConn.ConnectionState().PeerCertificates
+		}
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		conn = wrapper.NetConn()
+	}
+	return nil
+}
+
+// tlsConfigFor returns a copy of cfg adjusted for the optimization type. When optimizing for
+// throughput, records always use the max size instead of starting small, so the cost of each
+// record is amortised over as many bytes as possible.
+func tlsConfigFor(cfg *tls.Config, optimization OptimizationType) *tls.Config {
+	res := cfg.Clone()
+	if optimization == OptimizeForThroughput {
+		res.DynamicRecordSizingDisabled = true
+	}
+	return res
+}
+
+// handshake runs the TLS handshake on conn, giving up after timeout
+func handshake(conn *tls.Conn, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return fmt.Errorf("failed tls handshake: %w", err)
+	}
+	return nil
+}
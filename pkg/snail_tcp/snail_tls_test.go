@@ -0,0 +1,161 @@
+package snail_tcp
+
+import (
+	"github.com/GiGurra/snail/pkg/snail_buffer"
+	"github.com/GiGurra/snail/pkg/snail_logging"
+	"github.com/GiGurra/snail/pkg/snail_test_util/snail_tls"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTlsEchoServer echoes everything back, and reports the common name of each client certificate
+func newTlsEchoServer(t *testing.T, pki *snail_tls.TestPKI, mutual bool, optimization OptimizationType) (*SnailServer, chan string) {
+	peers := make(chan string, 10)
+	server, err := NewServer(func(conn net.Conn) ServerConnHandler {
+		certs := PeerCertificates(conn)
+		if len(certs) > 0 {
+			peers <- certs[0].Subject.CommonName
+		} else {
+			peers <- ""
+		}
+		return func(buffer *snail_buffer.Buffer) error {
+			if buffer == nil {
+				return nil
+			}
+			return SendAll(conn, buffer.ReadAll())
+		}
+	}, &SnailServerOpts{TLSConfig: pki.ServerConfig(mutual), Optimization: optimization})
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+	return server, peers
+}
+
+func TestTLS_echo(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	pki, err := snail_tls.NewTestPKI("snail-client")
+	if err != nil {
+		t.Fatalf("error creating pki: %v", err)
+	}
+
+	for _, optimization := range []OptimizationType{OptimizeForLatency, OptimizeForThroughput} {
+		server, peers := newTlsEchoServer(t, pki, false, optimization)
+
+		recvCh := make(chan []byte, 10)
+		client, err := NewClient("localhost", server.Port(), &SnailClientOpts{
+			TLSConfig:    pki.ClientConfig(false),
+			Optimization: optimization,
+		}, func(buffer *snail_buffer.Buffer) error {
+			if buffer != nil {
+				recvCh <- buffer.ReadAll()
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("error creating client: %v", err)
+		}
+
+		// Large enough to span several TLS records
+		msg := make([]byte, 100*1024)
+		for i := range msg {
+			msg[i] = byte(i)
+		}
+		if err := client.SendBytes(msg); err != nil {
+			t.Fatalf("error sending: %v", err)
+		}
+
+		var received []byte
+		for len(received) < len(msg) {
+			select {
+			case data := <-recvCh:
+				received = append(received, data...)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timeout waiting for echo, got %d of %d bytes", len(received), len(msg))
+			}
+		}
+		if string(received) != string(msg) {
+			t.Fatalf("echoed data does not match what was sent")
+		}
+
+		if peer := <-peers; peer != "" {
+			t.Fatalf("expected no client certificate, got %q", peer)
+		}
+
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestTLS_mutual(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	pki, err := snail_tls.NewTestPKI("snail-client")
+	if err != nil {
+		t.Fatalf("error creating pki: %v", err)
+	}
+
+	server, peers := newTlsEchoServer(t, pki, true, OptimizeForLatency)
+	defer server.Close()
+
+	client, err := NewClient("localhost", server.Port(), &SnailClientOpts{TLSConfig: pki.ClientConfig(true)}, func(buffer *snail_buffer.Buffer) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	defer client.Close()
+
+	select {
+	case peer := <-peers:
+		if peer != "snail-client" {
+			t.Fatalf("expected client certificate for snail-client, got %q", peer)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for handler factory")
+	}
+
+	// Without a client certificate, the handshake fails and the handler factory is never called
+	noCert, err := NewClient("localhost", server.Port(), &SnailClientOpts{TLSConfig: pki.ClientConfig(false)}, func(buffer *snail_buffer.Buffer) error {
+		return nil
+	})
+	if err == nil {
+		// With TLS 1.3 the client may finish its side of the handshake before the server rejects it
+		select {
+		case <-noCert.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected connection without client certificate to be closed")
+		}
+	}
+
+	select {
+	case peer := <-peers:
+		t.Fatalf("expected handler factory not to be called, got peer %q", peer)
+	case <-time.After(100 * time.Millisecond):
+	}
+	waitFor(t, func() bool { return server.ActiveConnections() == 1 })
+}
+
+func TestTLS_untrustedServer(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	serverPki, err := snail_tls.NewTestPKI("snail-client")
+	if err != nil {
+		t.Fatalf("error creating pki: %v", err)
+	}
+	clientPki, err := snail_tls.NewTestPKI("snail-client")
+	if err != nil {
+		t.Fatalf("error creating pki: %v", err)
+	}
+
+	server, _ := newTlsEchoServer(t, serverPki, false, OptimizeForLatency)
+	defer server.Close()
+
+	_, err = NewClient("localhost", server.Port(), &SnailClientOpts{TLSConfig: clientPki.ClientConfig(false)}, func(buffer *snail_buffer.Buffer) error {
+		return nil
+	})
+	if err == nil {
+		t.Fatalf("expected handshake with an untrusted server to fail")
+	}
+}
@@ -0,0 +1,631 @@
+package snail_tcp_reqrep
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/GiGurra/snail/pkg/snail_buffer"
+	"github.com/GiGurra/snail/pkg/snail_logging"
+	"github.com/GiGurra/snail/pkg/snail_parser"
+	"github.com/GiGurra/snail/pkg/snail_tcp"
+	"github.com/GiGurra/snail/pkg/snail_test_util"
+	"github.com/samber/lo"
+	lop "github.com/samber/lo/parallel"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// echoServerOpts configures newEchoServer. The zero value echoes every request on a random port
+type echoServerOpts[T any] struct {
+	Port    int                     // default: random
+	Handler ServerConnHandler[T, T] // default: echoes every request
+	Server  *SnailServerOpts[T, T]
+}
+
+func newEchoServer[T any](
+	t *testing.T,
+	codec snail_parser.Codec[T],
+	opts echoServerOpts[T],
+) *SnailServer[T, T] {
+	t.Helper()
+	handler := opts.Handler
+	if handler == nil {
+		handler = func(req T, repFunc func(resp T) error) error {
+			if repFunc == nil {
+				return nil
+			}
+			return repFunc(req)
+		}
+	}
+	server, err := NewServer[T, T](
+		func() ServerConnHandler[T, T] { return handler },
+		&snail_tcp.SnailServerOpts{Port: opts.Port},
+		codec.Parser,
+		codec.Writer,
+		opts.Server,
+	)
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+	return server
+}
+
+// newEchoClient connects a client to a server started by newEchoServer
+func newEchoClient[T any](
+	t *testing.T,
+	codec snail_parser.Codec[T],
+	server *SnailServer[T, T],
+	respHandler func(resp T, status ClientStatus) error,
+	opts *SnailClientOpts[T, T],
+) *SnailClient[T, T] {
+	t.Helper()
+	client, err := NewClientWithOpts[T, T]("localhost", server.Port(), nil, respHandler, codec.Writer, codec.Parser, opts)
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	return client
+}
+
+func TestEnvelope_WriteAndParse(t *testing.T) {
+	codec := snail_parser.NewJsonLinesCodec[requestStruct]()
+	writer := newEnvelopeWriter(codec.Writer)
+	parser := newEnvelopeParser(codec.Parser)
+
+	buffer := snail_buffer.New(snail_buffer.BigEndian, 1024)
+	for i := 0; i < 3; i++ {
+		err := writer(buffer, envelope[requestStruct]{kind: frameKindRequest, id: uint64(i + 100), value: requestStruct{Msg: fmt.Sprintf("msg %d", i)}})
+		if err != nil {
+			t.Fatalf("error writing envelope: %v", err)
+		}
+	}
+
+	// cut the last message in half, and check that the envelope waits for more data
+	full := buffer.ReadAll()
+	buffer.Reset()
+	buffer.WriteBytes(full[:len(full)-5])
+
+	frames, err := snail_parser.ParseAll(buffer, parser)
+	if err != nil {
+		t.Fatalf("error parsing envelopes: %v", err)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("expected 2 frames, got %d", len(frames))
+	}
+
+	buffer.WriteBytes(full[len(full)-5:])
+	rest, err := snail_parser.ParseAll(buffer, parser)
+	if err != nil {
+		t.Fatalf("error parsing envelopes: %v", err)
+	}
+	frames = append(frames, rest...)
+
+	if len(frames) != 3 {
+		t.Fatalf("expected 3 frames, got %d", len(frames))
+	}
+	for i, frame := range frames {
+		if frame.kind != frameKindRequest {
+			t.Fatalf("expected kind %d, got %d", frameKindRequest, frame.kind)
+		}
+		if frame.id != uint64(i+100) {
+			t.Fatalf("expected id %d, got %d", i+100, frame.id)
+		}
+		if frame.value.Msg != fmt.Sprintf("msg %d", i) {
+			t.Fatalf("unexpected msg '%s'", frame.value.Msg)
+		}
+	}
+}
+
+func TestClient_Call_fifo(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	codec := snail_parser.NewJsonLinesCodec[requestStruct]()
+	server := newEchoServer(t, codec, echoServerOpts[requestStruct]{})
+	defer server.Close()
+
+	client, err := NewClient[requestStruct, requestStruct](
+		"localhost",
+		server.Port(),
+		nil,
+		nil,
+		codec.Writer,
+		codec.Parser,
+	)
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	for i := 0; i < 100; i++ {
+		msg := fmt.Sprintf("Hello %d", i)
+		resp, err := client.Call(ctx, requestStruct{Msg: msg})
+		if err != nil {
+			t.Fatalf("error calling server: %v", err)
+		}
+		if resp.Msg != msg {
+			t.Fatalf("expected response '%s', got '%s'", msg, resp.Msg)
+		}
+	}
+}
+
+func TestClient_CallAsync_envelope_outOfOrderReplies(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	codec := snail_parser.NewInt32Codec()
+
+	// The server replies from random goroutines after random delays, so replies
+	// arrive in a different order than the requests were sent.
+	server, err := NewServer[int32, int32](
+		func() ServerConnHandler[int32, int32] {
+			return func(req int32, repFunc func(resp int32) error) error {
+				if repFunc == nil {
+					return nil
+				}
+				go func() {
+					time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+					_ = repFunc(req * 2)
+				}()
+				return nil
+			}
+		},
+		nil,
+		codec.Parser,
+		codec.Writer,
+		lo.ToPtr(SnailServerOpts[int32, int32]{}.WithEnvelope().WidthBatching(NewBatcherOpts(64))),
+	)
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+	defer server.Close()
+
+	client, err := NewClientWithOpts[int32, int32](
+		"localhost",
+		server.Port(),
+		nil,
+		nil,
+		codec.Writer,
+		codec.Parser,
+		lo.ToPtr(SnailClientOpts[int32, int32]{}.WithEnvelope().WithBatching(NewBatcherOpts(64))),
+	)
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	defer client.Close()
+
+	futures := make([]*Future[int32], 1000)
+	for i := range futures {
+		futures[i] = client.CallAsync(int32(i))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	for i, f := range futures {
+		resp, err := f.Await(ctx)
+		if err != nil {
+			t.Fatalf("error awaiting response %d: %v", i, err)
+		}
+		if resp != int32(i*2) {
+			t.Fatalf("expected response %d, got %d", i*2, resp)
+		}
+	}
+}
+
+func TestClient_Call_failsPendingOnClose(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	codec := snail_parser.NewInt32Codec()
+
+	// Never replies
+	server, err := NewServer[int32, int32](
+		func() ServerConnHandler[int32, int32] {
+			return func(req int32, repFunc func(resp int32) error) error {
+				return nil
+			}
+		},
+		nil,
+		codec.Parser,
+		codec.Writer,
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+	defer server.Close()
+
+	client, err := NewClient[int32, int32]("localhost", server.Port(), nil, nil, codec.Writer, codec.Parser)
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+
+	future := client.CallAsync(1)
+	client.Close()
+
+	select {
+	case <-future.Done():
+		_, err := future.Get()
+		if err != ErrClientClosed {
+			t.Fatalf("expected ErrClientClosed, got %v", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("timeout waiting for future to fail")
+	}
+}
+
+func TestClient_Close_wedgedServer(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	// Accepts the connection, but never reads from it
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			t.Cleanup(func() { _ = conn.Close() })
+		}
+	}()
+
+	codec := snail_parser.NewInt32Codec()
+	client, err := NewClientWithOpts[int32, int32](
+		"localhost",
+		listener.Addr().(*net.TCPAddr).Port,
+		&snail_tcp.SnailClientOpts{TcpSendWindowSize: 4096},
+		nil,
+		codec.Writer,
+		codec.Parser,
+		&SnailClientOpts[int32, int32]{Batcher: NewBatcherOpts(1024), CloseTimeout: 100 * time.Millisecond},
+	)
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+
+	// Fills the socket buffers, until the batcher's worker is stuck writing
+	go func() {
+		batch := make([]int32, 1024)
+		for client.SendBatch(batch) == nil {
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		client.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected Close to give up on the final writes after CloseTimeout")
+	}
+}
+
+func TestClient_CallAsync_1s_batched_performance_multiple_goroutines(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	testLength := 1 * time.Second
+	nGoRoutines := 64
+	batchSize := 5 * 1024
+	codec := snail_parser.NewInt32Codec()
+
+	server := newEchoServer(t, codec, echoServerOpts[int32]{
+		Server: lo.ToPtr(SnailServerOpts[int32, int32]{}.WithEnvelope().WidthBatching(NewBatcherOpts(batchSize))),
+	})
+	defer server.Close()
+
+	client, err := NewClientWithOpts[int32, int32](
+		"localhost",
+		server.Port(),
+		&snail_tcp.SnailClientOpts{Optimization: snail_tcp.OptimizeForThroughput},
+		nil,
+		codec.Writer,
+		codec.Parser,
+		lo.ToPtr(SnailClientOpts[int32, int32]{}.WithEnvelope().WithBatching(NewBatcherOpts(batchSize))),
+	)
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	defer client.Close()
+
+	withinTestWindow := snail_test_util.TrueForTimeout(testLength)
+	nCalls := atomic.Int64{}
+	t0 := time.Now()
+
+	lop.ForEach(lo.Range(nGoRoutines), func(i int, _ int) {
+		// keep a window of calls in flight per goroutine
+		window := make([]*Future[int32], 0, 1024)
+		for withinTestWindow.Load() {
+			for len(window) < cap(window) {
+				window = append(window, client.CallAsync(int32(i)))
+			}
+			for _, f := range window {
+				resp, err := f.Get()
+				if err != nil {
+					panic(fmt.Errorf("error awaiting response: %w", err))
+				}
+				if resp != int32(i) {
+					panic(fmt.Errorf("expected response %d, got %d", i, resp))
+				}
+			}
+			nCalls.Add(int64(len(window)))
+			window = window[:0]
+		}
+	})
+
+	elapsed := time.Since(t0)
+	rate := float64(nCalls.Load()) / elapsed.Seconds()
+	slog.Info(fmt.Sprintf("Completed %v calls in %v", prettyInt3Digits(nCalls.Load()), elapsed))
+	slog.Info(fmt.Sprintf("Call rate: %s calls/sec", prettyInt3Digits(int64(rate))))
+}
+
+func newSilentServer(t *testing.T, opts *SnailServerOpts[int32, int32]) *SnailServer[int32, int32] {
+	codec := snail_parser.NewInt32Codec()
+	server, err := NewServer[int32, int32](
+		func() ServerConnHandler[int32, int32] {
+			return func(req int32, repFunc func(resp int32) error) error {
+				return nil // never replies
+			}
+		},
+		nil,
+		codec.Parser,
+		codec.Writer,
+		opts,
+	)
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+	return server
+}
+
+func TestClient_CallAsync_timeout(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	for _, useEnvelope := range []bool{false, true} {
+		t.Run(fmt.Sprintf("envelope=%v", useEnvelope), func(t *testing.T) {
+			server := newSilentServer(t, &SnailServerOpts[int32, int32]{Envelope: useEnvelope})
+			defer server.Close()
+
+			codec := snail_parser.NewInt32Codec()
+			client, err := NewClientWithOpts[int32, int32](
+				"localhost",
+				server.Port(),
+				nil,
+				nil,
+				codec.Writer,
+				codec.Parser,
+				&SnailClientOpts[int32, int32]{Envelope: useEnvelope, CallTimeout: 20 * time.Millisecond},
+			)
+			if err != nil {
+				t.Fatalf("error creating client: %v", err)
+			}
+			defer client.Close()
+
+			futures := make([]*Future[int32], 10)
+			for i := range futures {
+				futures[i] = client.CallAsync(int32(i))
+			}
+
+			for _, f := range futures {
+				_, err := f.Get()
+				var timeoutErr *CallTimeoutError
+				if !errors.As(err, &timeoutErr) {
+					t.Fatalf("expected CallTimeoutError, got %v", err)
+				}
+				if !errors.Is(err, context.DeadlineExceeded) {
+					t.Fatalf("expected error to match context.DeadlineExceeded")
+				}
+			}
+
+			if client.TimedOutCalls() != int64(len(futures)) {
+				t.Fatalf("expected %d timed out calls, got %d", len(futures), client.TimedOutCalls())
+			}
+
+			if useEnvelope && client.ids.len() != 0 {
+				t.Fatalf("expected no pending calls, got %d", client.ids.len())
+			}
+		})
+	}
+}
+
+func TestClient_Call_contextCancellation(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	server := newSilentServer(t, &SnailServerOpts[int32, int32]{Envelope: true})
+	defer server.Close()
+
+	codec := snail_parser.NewInt32Codec()
+	client, err := NewClientWithOpts[int32, int32](
+		"localhost",
+		server.Port(),
+		nil,
+		nil,
+		codec.Writer,
+		codec.Parser,
+		&SnailClientOpts[int32, int32]{Envelope: true},
+	)
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	defer client.Close()
+
+	// deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = client.Call(ctx, 1)
+	var timeoutErr *CallTimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("expected CallTimeoutError, got %v", err)
+	}
+
+	// explicit cancel
+	ctx, cancel = context.WithCancel(context.Background())
+	snail_test_util.Schedule(20*time.Millisecond, cancel)
+	_, err = client.Call(ctx, 2)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	if client.TimedOutCalls() != 1 {
+		t.Fatalf("expected 1 timed out call, got %d", client.TimedOutCalls())
+	}
+	if client.ids.len() != 0 {
+		t.Fatalf("expected no pending calls, got %d", client.ids.len())
+	}
+}
+
+func killServer(server *SnailServer[int32, int32]) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // force close all connections right away
+	_ = server.Underlying().Shutdown(ctx)
+}
+
+func TestClient_Reconnect_pendingCallPolicies(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	for _, useEnvelope := range []bool{false, true} {
+		for _, policy := range []PendingCallPolicy{FailPendingCalls, ResendPendingCalls} {
+			t.Run(fmt.Sprintf("envelope=%v,policy=%d", useEnvelope, policy), func(t *testing.T) {
+				silent := newSilentServer(t, &SnailServerOpts[int32, int32]{Envelope: useEnvelope})
+				port := silent.Port()
+
+				reconnected := make(chan struct{}, 1)
+				codec := snail_parser.NewInt32Codec()
+				client, err := NewClientWithOpts[int32, int32](
+					"localhost",
+					port,
+					&snail_tcp.SnailClientOpts{
+						Reconnect:   &snail_tcp.ReconnectPolicy{InitialBackoff: 10 * time.Millisecond},
+						OnReconnect: func(_ net.Conn, _ int) { reconnected <- struct{}{} },
+					},
+					nil,
+					codec.Writer,
+					codec.Parser,
+					&SnailClientOpts[int32, int32]{Envelope: useEnvelope, PendingCalls: policy},
+				)
+				if err != nil {
+					t.Fatalf("error creating client: %v", err)
+				}
+				defer client.Close()
+
+				futures := make([]*Future[int32], 5)
+				for i := range futures {
+					futures[i] = client.CallAsync(int32(i))
+				}
+				waitForPending(t, client, len(futures))
+
+				killServer(silent)
+				echo := newEchoServer(t, codec, echoServerOpts[int32]{Port: port, Server: &SnailServerOpts[int32, int32]{Envelope: useEnvelope}})
+				defer echo.Close()
+
+				for i, f := range futures {
+					select {
+					case <-f.Done():
+					case <-time.After(2 * time.Second):
+						t.Fatalf("timeout waiting for call %d", i)
+					}
+					resp, err := f.Get()
+					switch policy {
+					case FailPendingCalls:
+						if !errors.Is(err, ErrDisconnected) {
+							t.Fatalf("expected ErrDisconnected, got %v", err)
+						}
+					case ResendPendingCalls:
+						if err != nil {
+							t.Fatalf("expected call to be resent, got %v", err)
+						}
+						if resp != int32(i) {
+							t.Fatalf("expected response %d, got %d", i, resp)
+						}
+					}
+				}
+
+				<-reconnected
+				waitFor(t, client.Underlying().IsConnected)
+				resp, err := client.Call(context.Background(), 42)
+				if err != nil {
+					t.Fatalf("error calling after reconnect: %v", err)
+				}
+				if resp != 42 {
+					t.Fatalf("expected 42, got %d", resp)
+				}
+			})
+		}
+	}
+}
+
+func waitForPending(t *testing.T, client *SnailClient[int32, int32], n int) {
+	t.Helper()
+	waitFor(t, func() bool {
+		if client.ids != nil {
+			return client.ids.len() == n
+		}
+		return client.fifo.len() == n
+	})
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(1 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for condition")
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+}
+
+func TestClient_Disconnected_deliveredOnce(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	server := newSilentServer(t, nil)
+
+	disconnects := atomic.Int32{}
+	codec := snail_parser.NewInt32Codec()
+	client, err := NewClient[int32, int32](
+		"localhost",
+		server.Port(),
+		nil,
+		func(resp int32, status ClientStatus) error {
+			if status == ClientStatusDisconnected {
+				disconnects.Add(1)
+			}
+			return nil
+		},
+		codec.Writer,
+		codec.Parser,
+	)
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	defer client.Close()
+
+	future := client.CallAsync(1)
+	waitForPending(t, client, 1)
+	killServer(server)
+
+	select {
+	case <-client.Done():
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expected client to be done")
+	}
+
+	if _, err := future.Get(); !errors.Is(err, ErrDisconnected) {
+		t.Fatalf("expected ErrDisconnected, got %v", err)
+	}
+	if client.Err() == nil {
+		t.Fatalf("expected client to have a close reason")
+	}
+
+	client.Close()
+	if n := disconnects.Load(); n != 1 {
+		t.Fatalf("expected exactly one disconnect, got %d", n)
+	}
+}
@@ -1,11 +1,21 @@
 package snail_tcp_reqrep
 
 import (
+	"cmp"
+	"context"
+	"errors"
 	"fmt"
+	"github.com/GiGurra/snail/pkg/snail_batcher"
 	"github.com/GiGurra/snail/pkg/snail_buffer"
+	"github.com/GiGurra/snail/pkg/snail_metrics"
 	"github.com/GiGurra/snail/pkg/snail_parser"
 	"github.com/GiGurra/snail/pkg/snail_tcp"
+	"log/slog"
+	"net"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type ClientStatus int
@@ -15,15 +25,133 @@ const (
 	ClientStatusDisconnected ClientStatus = iota
 )
 
+var (
+	// ErrClientClosed is the error pending calls are failed with when the client is closed
+	ErrClientClosed = errors.New("snail client closed")
+	// ErrDisconnected is the error pending calls are failed with when the connection is lost
+	ErrDisconnected = errors.New("snail client disconnected")
+)
+
+// CallTimeoutError is the error a call fails with when no response arrived in time,
+// either because its timeout expired or because its context deadline was exceeded.
+// It matches context.DeadlineExceeded with errors.Is.
+type CallTimeoutError struct {
+	Timeout time.Duration // the configured timeout, or 0 if the call ran out of context deadline
+}
+
+func (e *CallTimeoutError) Error() string {
+	if e.Timeout > 0 {
+		return fmt.Sprintf("snail call timed out after %v", e.Timeout)
+	}
+	return "snail call timed out: context deadline exceeded"
+}
+
+func (e *CallTimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// PendingCallPolicy decides what happens to calls waiting for responses when the
+// connection is lost, see snail_tcp.SnailClientOpts.Reconnect.
+type PendingCallPolicy int
+
+const (
+	// FailPendingCalls fails waiting calls with ErrDisconnected as soon as the connection is lost
+	FailPendingCalls PendingCallPolicy = iota
+	// ResendPendingCalls keeps waiting calls across a disconnect and sends them again, in
+	// their original order, once the underlying client has reconnected. Only use this with
+	// requests that are safe to process twice. Calls are failed if reconnecting fails, and
+	// new calls made while disconnected fail right away with snail_tcp.ErrNotConnected.
+	ResendPendingCalls
+)
+
 // ClientRespHandler is the custom response handler for a client connection.
+// Responses that complete a call made with Call/CallAsync are not passed to it.
 type ClientRespHandler[Resp any] func(resp Resp, tpe ClientStatus) error
 
+type SnailClientOpts[Req any, Resp any] struct {
+	// Batcher enables client side batching of outgoing requests. When enabled, Send,
+	// SendBatch and CallAsync all go through one batcher per client.
+	Batcher BatcherOpts
+	// Envelope prefixes every message with a small header carrying a correlation id,
+	// see snail_reqrep_envelope.go. The server must be configured with the same setting.
+	// Without the envelope, calls are correlated in FIFO order, which requires the
+	// server to reply to every request, in order, and the client to not mix
+	// Send and Call.
+	Envelope bool
+	// CallTimeout is the default timeout for calls made with CallAsync and Call.
+	// 0 means calls never time out on their own.
+	CallTimeout time.Duration
+	// PendingCalls decides what happens to waiting calls when the connection is lost
+	PendingCalls PendingCallPolicy
+	// Heartbeat enables pings to the server, see HeartbeatOpts. Requires Envelope. nil = disabled
+	Heartbeat *HeartbeatOpts
+	// StreamBuffer is the number of responses buffered per streaming call. The server only sends
+	// as many as there is room for, and is given more as they are read, so a slow reader only
+	// slows down its own stream. Default 64
+	StreamBuffer int
+	// Metrics, if set, counts the frames parsed and written, and the parse errors that close
+	// connections, labeled codec="client". Default Batcher.Metrics
+	Metrics snail_metrics.Metrics
+	// CloseTimeout bounds how long Close waits for the batcher to write what it holds, e.g. when
+	// the server has stopped reading. The socket is closed after it, dropping the rest. Default 5s
+	CloseTimeout time.Duration
+}
+
+// DefaultStreamBuffer is the default of SnailClientOpts.StreamBuffer
+const DefaultStreamBuffer = 64
+
+// DefaultCloseTimeout is the default of SnailClientOpts.CloseTimeout
+const DefaultCloseTimeout = 5 * time.Second
+
+func (o SnailClientOpts[Req, Resp]) WithDefaults() SnailClientOpts[Req, Resp] {
+	o.Batcher = o.Batcher.WithDefaults()
+	if o.StreamBuffer == 0 {
+		o.StreamBuffer = DefaultStreamBuffer
+	}
+	if o.CloseTimeout == 0 {
+		o.CloseTimeout = DefaultCloseTimeout
+	}
+	if o.Metrics == nil {
+		o.Metrics = o.Batcher.Metrics
+	}
+	return o
+}
+
+func (o SnailClientOpts[Req, Resp]) WithBatching(opts BatcherOpts) SnailClientOpts[Req, Resp] {
+	o.Batcher = opts
+	return o
+}
+
+func (o SnailClientOpts[Req, Resp]) WithEnvelope() SnailClientOpts[Req, Resp] {
+	o.Envelope = true
+	return o
+}
+
+// outgoing is a request on its way to the socket, together with the call
+// waiting for its response (if any).
+type outgoing[Req any, Resp any] struct {
+	frame  envelope[Req]
+	future *Future[Resp]
+}
+
 type SnailClient[Req any, Resp any] struct {
-	underlying *snail_tcp.SnailClient
-	writeFunc  snail_parser.WriteFunc[Req]
-	parseFunc  snail_parser.ParseFunc[Resp]
-	writeMutex sync.Mutex
-	convertBuf *snail_buffer.Buffer
+	underlying  *snail_tcp.SnailClient
+	created     chan struct{} // closed once underlying is set
+	writeFunc   snail_parser.WriteFunc[envelope[Req]]
+	parseFunc   snail_parser.ParseFunc[envelope[Resp]]
+	respHandler ClientRespHandler[Resp]
+	opts        SnailClientOpts[Req, Resp]
+	writeMutex  sync.Mutex
+	convertBuf  *snail_buffer.Buffer
+	scratch     []outgoing[Req, Resp] // only used under writeMutex
+	batcher     *snail_batcher.SnailBatcher[outgoing[Req, Resp]]
+	fifo        *fifoTracker[Req, Resp] // set if correlating in order
+	ids         *idTracker[Req, Resp]   // set if correlating by envelope id
+	nextId      atomic.Uint64
+	timedOut    atomic.Int64
+	heartbeat   *heartbeat // nil if heartbeats are disabled
+	streamsLock sync.Mutex
+	streams     map[uint64]*ResponseStream[Resp] // open streaming calls by id, set with the envelope
 }
 
 func NewClient[Req any, Resp any](
@@ -34,42 +162,189 @@ func NewClient[Req any, Resp any](
 	writeFunc snail_parser.WriteFunc[Req],
 	parseFunc snail_parser.ParseFunc[Resp],
 ) (*SnailClient[Req, Resp], error) {
+	return NewClientWithOpts(ip, port, tcpOpts, handlerFunc, writeFunc, parseFunc, nil)
+}
+
+func NewClientWithOpts[Req any, Resp any](
+	ip string,
+	port int,
+	tcpOpts *snail_tcp.SnailClientOpts,
+	handlerFunc ClientRespHandler[Resp],
+	writeFunc snail_parser.WriteFunc[Req],
+	parseFunc snail_parser.ParseFunc[Resp],
+	opts *SnailClientOpts[Req, Resp],
+) (*SnailClient[Req, Resp], error) {
+	return newClient(func(tcpOpts *snail_tcp.SnailClientOpts, handler snail_tcp.ClientRespHandler) (*snail_tcp.SnailClient, error) {
+		return snail_tcp.NewClient(ip, port, tcpOpts, handler)
+	}, tcpOpts, handlerFunc, writeFunc, parseFunc, opts)
+}
+
+// NewClientWithDialer is NewClientWithOpts on connections opened by dial, e.g. to a Unix socket.
+// See snail_tcp.NewClientWithDialer.
+func NewClientWithDialer[Req any, Resp any](
+	dial snail_tcp.Dialer,
+	tcpOpts *snail_tcp.SnailClientOpts,
+	handlerFunc ClientRespHandler[Resp],
+	writeFunc snail_parser.WriteFunc[Req],
+	parseFunc snail_parser.ParseFunc[Resp],
+	opts *SnailClientOpts[Req, Resp],
+) (*SnailClient[Req, Resp], error) {
+	return newClient(func(tcpOpts *snail_tcp.SnailClientOpts, handler snail_tcp.ClientRespHandler) (*snail_tcp.SnailClient, error) {
+		return snail_tcp.NewClientWithDialer(dial, tcpOpts, handler)
+	}, tcpOpts, handlerFunc, writeFunc, parseFunc, opts)
+}
+
+func newClient[Req any, Resp any](
+	newUnderlying func(tcpOpts *snail_tcp.SnailClientOpts, handler snail_tcp.ClientRespHandler) (*snail_tcp.SnailClient, error),
+	tcpOpts *snail_tcp.SnailClientOpts,
+	handlerFunc ClientRespHandler[Resp],
+	writeFunc snail_parser.WriteFunc[Req],
+	parseFunc snail_parser.ParseFunc[Resp],
+	opts *SnailClientOpts[Req, Resp],
+) (*SnailClient[Req, Resp], error) {
+
+	if opts == nil {
+		opts = &SnailClientOpts[Req, Resp]{}
+	}
+	resolvedOpts := opts.WithDefaults()
+
+	if resolvedOpts.Heartbeat != nil && !resolvedOpts.Envelope {
+		return nil, fmt.Errorf("heartbeats require the envelope to be enabled")
+	}
+
+	res := &SnailClient[Req, Resp]{
+		writeFunc:   newFrameWriter(writeFunc, resolvedOpts.Envelope),
+		parseFunc:   newFrameParser(parseFunc, resolvedOpts.Envelope, frameKindResponse),
+		respHandler: handlerFunc,
+		opts:        resolvedOpts,
+		writeMutex:  sync.Mutex{},
+		convertBuf:  snail_buffer.New(snail_buffer.BigEndian, 64*1024),
+		created:     make(chan struct{}),
+	}
+
+	if resolvedOpts.Metrics != nil {
+		res.writeFunc = snail_parser.InstrumentWriter(res.writeFunc, "client", resolvedOpts.Metrics)
+		res.parseFunc = snail_parser.InstrumentParser(res.parseFunc, "client", resolvedOpts.Metrics)
+	}
+
+	if resolvedOpts.Envelope {
+		res.ids = newIdTracker[Req, Resp]()
+		res.streams = make(map[uint64]*ResponseStream[Resp])
+	} else {
+		res.fifo = &fifoTracker[Req, Resp]{}
+	}
 
-	underlying, err := snail_tcp.NewClient(ip, port, tcpOpts, newTcpClientRespHandler(handlerFunc, parseFunc))
+	if resolvedOpts.Heartbeat != nil {
+		res.heartbeat = newHeartbeat(*resolvedOpts.Heartbeat)
+	}
+
+	underlying, err := newUnderlying(res.hookTcpOpts(tcpOpts), res.newTcpClientRespHandler())
 	if err != nil {
-		return nil, fmt.Errorf("failed to create underlying server: %w", err)
+		return nil, fmt.Errorf("failed to create underlying client: %w", err)
+	}
+	res.underlying = underlying
+	close(res.created)
+
+	if resolvedOpts.Batcher.IsEnabled() {
+		res.batcher = snail_batcher.NewSnailBatcherWithOpts[outgoing[Req, Resp]](
+			resolvedOpts.Batcher.BatchSize,
+			resolvedOpts.Batcher.QueueSize,
+			resolvedOpts.Batcher.WindowSize,
+			func(items []outgoing[Req, Resp]) error {
+				res.writeMutex.Lock()
+				defer res.writeMutex.Unlock()
+				return res.writeUnsafe(items)
+			},
+			&snail_batcher.SnailBatcherOpts[outgoing[Req, Resp]]{
+				Metrics: resolvedOpts.Batcher.Metrics,
+				Name:    "client",
+			},
+		)
 	}
 
-	return &SnailClient[Req, Resp]{
-		underlying: underlying,
-		writeFunc:  writeFunc,
-		parseFunc:  parseFunc,
-		writeMutex: sync.Mutex{},
-		convertBuf: snail_buffer.New(snail_buffer.BigEndian, 64*1024),
-	}, nil
+	if res.heartbeat != nil {
+		go res.loopHeartbeats()
+	}
+
+	return res, nil
 }
 
 func (s *SnailClient[Req, Resp]) Underlying() *snail_tcp.SnailClient {
 	return s.underlying
 }
 
+// Close writes what the batcher holds, waiting at most CloseTimeout, and then closes the
+// connection. Waiting calls fail with ErrClientClosed.
 func (s *SnailClient[Req, Resp]) Close() {
+	if s.batcher != nil {
+		go s.batcher.Close()
+		timer := time.NewTimer(s.opts.CloseTimeout)
+		select {
+		case <-s.batcher.Done():
+		case <-timer.C:
+			slog.Warn(fmt.Sprintf("Timed out after %v writing the last requests, closing the connection", s.opts.CloseTimeout))
+		}
+		timer.Stop()
+	}
 	s.underlying.Close()
+	s.failPending(ErrClientClosed)
+	if s.batcher != nil {
+		<-s.batcher.Done() // the write in progress fails once the socket is closed
+	}
+}
+
+// Done returns a channel that is closed once the client has stopped for good,
+// and the response handler has been called with ClientStatusDisconnected.
+func (s *SnailClient[Req, Resp]) Done() <-chan struct{} {
+	return s.underlying.Done()
+}
+
+// Err returns the reason the client stopped, or nil if it is still running.
+// It matches snail_tcp.ErrClientClosed if the client was closed with Close.
+func (s *SnailClient[Req, Resp]) Err() error {
+	return s.underlying.Err()
 }
 
 func (s *SnailClient[Req, Resp]) Send(r Req) error {
+	frame := envelope[Req]{kind: frameKindRequest, value: r}
+	if s.batcher != nil {
+		return s.batcher.Submit(outgoing[Req, Resp]{frame: frame})
+	}
 	s.writeMutex.Lock()
 	defer s.writeMutex.Unlock()
-	return s.SendUnsafe(r)
+	return s.writeOneUnsafe(outgoing[Req, Resp]{frame: frame})
 }
 
 // SendUnsafe sends a request without locking the write mutex. This should only
 // be used if the caller is sure that no other goroutine is using this client.
+// It bypasses the client side batcher, if one is configured.
 func (s *SnailClient[Req, Resp]) SendUnsafe(r Req) error {
+	return s.writeOneUnsafe(outgoing[Req, Resp]{frame: envelope[Req]{kind: frameKindRequest, value: r}})
+}
+
+func (s *SnailClient[Req, Resp]) SendBatch(rs []Req) error {
+	if s.batcher != nil {
+		items := make([]outgoing[Req, Resp], len(rs))
+		for i, r := range rs {
+			items[i].frame = envelope[Req]{kind: frameKindRequest, value: r}
+		}
+		return s.batcher.SubmitMany(items)
+	}
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	return s.SendBatchUnsafe(rs)
+}
+
+// SendBatchUnsafe sends a batch of requests without locking the write mutex.
+// This should only be used if the caller is sure that no other goroutine is
+// using this client. It bypasses the client side batcher, if one is configured.
+func (s *SnailClient[Req, Resp]) SendBatchUnsafe(rs []Req) error {
 	defer s.convertBuf.Reset()
 
-	if err := s.writeFunc(s.convertBuf, r); err != nil {
-		return fmt.Errorf("failed to serialize request: %w", err)
+	for _, r := range rs {
+		if err := s.writeFunc(s.convertBuf, envelope[Req]{kind: frameKindRequest, value: r}); err != nil {
+			return fmt.Errorf("failed to serialize request: %w", err)
+		}
 	}
 
 	if err := s.underlying.SendBytes(s.convertBuf.UnderlyingReadable()); err != nil {
@@ -79,50 +354,489 @@ func (s *SnailClient[Req, Resp]) SendUnsafe(r Req) error {
 	return nil
 }
 
-func (s *SnailClient[Req, Resp]) SendBatch(rs []Req) error {
+// CallAsync sends a request and returns a Future that is completed with the
+// matching response. It goes through the client side batcher if one is configured.
+// The call fails with a *CallTimeoutError if SnailClientOpts.CallTimeout expires first.
+func (s *SnailClient[Req, Resp]) CallAsync(r Req) *Future[Resp] {
+	return s.CallAsyncWithTimeout(r, s.opts.CallTimeout)
+}
+
+// CallAsyncWithTimeout is like CallAsync, but with an explicit timeout. 0 means no timeout.
+func (s *SnailClient[Req, Resp]) CallAsyncWithTimeout(r Req, timeout time.Duration) *Future[Resp] {
+	item := outgoing[Req, Resp]{
+		frame:  envelope[Req]{kind: frameKindRequest, value: r},
+		future: newFuture[Resp](),
+	}
+
+	if s.ids != nil {
+		item.frame.id = s.nextId.Add(1)
+		item.future.id = item.frame.id
+		s.ids.put(s.tracked(item))
+	}
+
+	if timeout > 0 {
+		f := item.future
+		f.timer.Store(time.AfterFunc(timeout, func() {
+			if s.cancelCall(f, &CallTimeoutError{Timeout: timeout}) {
+				s.timedOut.Add(1)
+			}
+		}))
+	}
+
+	if s.batcher != nil {
+		if err := s.batcher.Submit(item); err != nil {
+			s.failItems([]outgoing[Req, Resp]{item}, err)
+		}
+	} else {
+		s.writeMutex.Lock()
+		_ = s.writeOneUnsafe(item) // any error is delivered through the future
+		s.writeMutex.Unlock()
+	}
+
+	return item.future
+}
+
+// Call sends a request and waits for the matching response. If the context is
+// done first, the call is abandoned and fails with a *CallTimeoutError if the
+// deadline was exceeded, or with the context's error otherwise.
+func (s *SnailClient[Req, Resp]) Call(ctx context.Context, r Req) (Resp, error) {
+	f := s.CallAsync(r)
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		err := ctx.Err()
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = &CallTimeoutError{}
+			if s.cancelCall(f, err) {
+				s.timedOut.Add(1)
+			}
+		} else {
+			s.cancelCall(f, err)
+		}
+	}
+	return f.Get()
+}
+
+// Stream starts a streaming call, whose responses arrive on the returned ResponseStream until
+// the server ends it, see StreamHandler. It goes through the client side batcher if one is
+// configured. The stream is canceled when ctx is done, ending with the context's error, and
+// fails with ErrDisconnected if the connection is lost. Streams are never resent. Requires the envelope.
+func (s *SnailClient[Req, Resp]) Stream(ctx context.Context, r Req) *ResponseStream[Resp] {
+	if s.ids == nil {
+		return newFailedResponseStream[Resp](fmt.Errorf("streaming calls require the envelope"))
+	}
+
+	id := s.nextId.Add(1)
+	stream := newResponseStream[Resp](s.opts.StreamBuffer)
+	stream.cancelFn = func() { s.cancelStream(id) }
+	stream.creditFn = func(n uint32) {
+		credit := envelope[Req]{kind: frameKindStreamCredit, id: id, credits: n}
+		if err := s.sendControlFrame(credit); err != nil {
+			slog.Debug(fmt.Sprintf("Failed to grant stream credits: %v", err))
+		}
+	}
+	s.streamsLock.Lock()
+	s.streams[id] = stream
+	s.streamsLock.Unlock()
+
+	// The request is followed by credits for a full buffer, see StreamWriter.Send. Those go the same
+	// way, to arrive after it, while later ones can skip the batcher.
+	err := s.sendItem(outgoing[Req, Resp]{frame: envelope[Req]{kind: frameKindStreamRequest, id: id, value: r}})
+	if err == nil {
+		credit := envelope[Req]{kind: frameKindStreamCredit, id: id, credits: uint32(s.opts.StreamBuffer)}
+		err = s.sendItem(outgoing[Req, Resp]{frame: credit})
+	}
+	if err != nil {
+		if stream := s.takeStream(id); stream != nil {
+			stream.end(err)
+		}
+		return stream
+	}
+
+	stream.watch(ctx)
+	return stream
+}
+
+// OpenStreams returns the number of streaming calls that have not ended yet
+func (s *SnailClient[Req, Resp]) OpenStreams() int {
+	s.streamsLock.Lock()
+	defer s.streamsLock.Unlock()
+	return len(s.streams)
+}
+
+// Outstanding returns the number of calls waiting for responses. Requests sent with
+// Send are not tracked. In FIFO mode, calls that have timed out are still counted
+// until the server replies to them, since they keep their place in the queue.
+func (s *SnailClient[Req, Resp]) Outstanding() int {
+	if s.ids != nil {
+		return s.ids.len()
+	}
+	return s.fifo.len()
+}
+
+// TimedOutCalls returns the number of calls that have failed with a *CallTimeoutError
+func (s *SnailClient[Req, Resp]) TimedOutCalls() int64 {
+	return s.timedOut.Load()
+}
+
+// sendItem sends a request without a call waiting for its response
+func (s *SnailClient[Req, Resp]) sendItem(item outgoing[Req, Resp]) error {
+	if s.batcher != nil {
+		return s.batcher.Submit(item)
+	}
 	s.writeMutex.Lock()
 	defer s.writeMutex.Unlock()
-	return s.SendBatchUnsafe(rs)
+	return s.writeOneUnsafe(item)
 }
 
-// SendBatchUnsafe sends a batch of requests without locking the write mutex.
-// This should only be used if the caller is sure that no other goroutine is
-// using this client.
-func (s *SnailClient[Req, Resp]) SendBatchUnsafe(rs []Req) error {
+// cancelStream forgets a stream canceled by the caller, and tells the server to stop it
+func (s *SnailClient[Req, Resp]) cancelStream(id uint64) {
+	if s.takeStream(id) == nil {
+		return // already ended by the server
+	}
+	if err := s.sendItem(outgoing[Req, Resp]{frame: envelope[Req]{kind: frameKindStreamCancel, id: id}}); err != nil {
+		slog.Debug(fmt.Sprintf("Failed to cancel stream: %v", err))
+	}
+}
+
+// takeStream forgets the stream with the given id, returning it if it was still open
+func (s *SnailClient[Req, Resp]) takeStream(id uint64) *ResponseStream[Resp] {
+	if s.streams == nil || id == 0 {
+		return nil
+	}
+	s.streamsLock.Lock()
+	defer s.streamsLock.Unlock()
+	res := s.streams[id]
+	delete(s.streams, id)
+	return res
+}
+
+func (s *SnailClient[Req, Resp]) findStream(id uint64) *ResponseStream[Resp] {
+	if s.streams == nil || id == 0 {
+		return nil
+	}
+	s.streamsLock.Lock()
+	defer s.streamsLock.Unlock()
+	return s.streams[id]
+}
+
+// cancelCall fails a pending call and forgets its correlation state. In FIFO mode the
+// call must keep its place in the queue, so its response is simply discarded on arrival.
+// Returns true if this was what completed the call.
+func (s *SnailClient[Req, Resp]) cancelCall(f *Future[Resp], err error) bool {
+	if s.ids != nil && f.id != 0 {
+		s.ids.remove(f.id)
+	}
+	var zero Resp
+	return f.complete(zero, err)
+}
+
+func (s *SnailClient[Req, Resp]) writeOneUnsafe(item outgoing[Req, Resp]) error {
+	s.scratch = append(s.scratch[:0], item)
+	defer func() { s.scratch[0] = outgoing[Req, Resp]{} }()
+	return s.writeUnsafe(s.scratch)
+}
+
+// writeUnsafe serializes and sends the given items. Calls are registered for
+// correlation before any bytes are written, so that a fast response can never
+// arrive before its call is known. Must be called with the writeMutex held.
+func (s *SnailClient[Req, Resp]) writeUnsafe(items []outgoing[Req, Resp]) error {
 	defer s.convertBuf.Reset()
 
-	for _, r := range rs {
-		if err := s.writeFunc(s.convertBuf, r); err != nil {
-			return fmt.Errorf("failed to serialize request: %w", err)
+	for i := range items {
+		if err := s.writeFunc(s.convertBuf, items[i].frame); err != nil {
+			err = fmt.Errorf("failed to serialize request: %w", err)
+			s.failItems(items, err)
+			return err
+		}
+	}
+
+	if s.fifo != nil {
+		for i := range items {
+			if items[i].future != nil {
+				s.fifo.push(s.tracked(items[i]))
+			}
 		}
 	}
 
 	if err := s.underlying.SendBytes(s.convertBuf.UnderlyingReadable()); err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
+		err = fmt.Errorf("failed to send request: %w", err)
+		s.failItems(items, err)
+		return err
 	}
 
 	return nil
 }
 
-func newTcpClientRespHandler[Resp any](
-	respHandler ClientRespHandler[Resp],
-	parseFunc snail_parser.ParseFunc[Resp],
-) snail_tcp.ClientRespHandler {
+// tracked returns what is kept of an item while its call waits for a response. The request
+// is only needed to resend it, see ResendPendingCalls.
+func (s *SnailClient[Req, Resp]) tracked(item outgoing[Req, Resp]) outgoing[Req, Resp] {
+	if s.opts.PendingCalls != ResendPendingCalls {
+		var zero Req
+		item.frame.value = zero
+	}
+	return item
+}
+
+func (s *SnailClient[Req, Resp]) failItems(items []outgoing[Req, Resp], err error) {
+	var zero Resp
+	for i := range items {
+		if items[i].future == nil {
+			continue
+		}
+		if s.ids != nil {
+			s.ids.remove(items[i].frame.id)
+		}
+		items[i].future.complete(zero, err)
+	}
+}
+
+func (s *SnailClient[Req, Resp]) failPending(err error) {
+	var pending []outgoing[Req, Resp]
+	if s.ids != nil {
+		pending = s.ids.drain()
+	} else {
+		pending = s.fifo.drain()
+	}
+	var zero Resp
+	for _, item := range pending {
+		item.future.complete(zero, err)
+	}
+	s.failStreams(err)
+}
+
+func (s *SnailClient[Req, Resp]) failStreams(err error) {
+	if s.streams == nil {
+		return
+	}
+	s.streamsLock.Lock()
+	streams := make([]*ResponseStream[Resp], 0, len(s.streams))
+	for id, stream := range s.streams {
+		streams = append(streams, stream)
+		delete(s.streams, id)
+	}
+	s.streamsLock.Unlock()
+	for _, stream := range streams {
+		stream.end(err)
+	}
+}
+
+// hookTcpOpts returns a copy of the given tcp options, with connection hooks
+// that apply the PendingCallPolicy chained before the user's own hooks.
+func (s *SnailClient[Req, Resp]) hookTcpOpts(tcpOpts *snail_tcp.SnailClientOpts) *snail_tcp.SnailClientOpts {
+	res := snail_tcp.SnailClientOpts{}
+	if tcpOpts != nil {
+		res = *tcpOpts
+	}
+
+	userOnDisconnect := res.OnDisconnect
+	res.OnDisconnect = func(err error) {
+		// without reconnects, pending calls are failed when the client stops, see newTcpClientRespHandler
+		if res.Reconnect != nil {
+			disconnectErr := fmt.Errorf("%w: %w", ErrDisconnected, err)
+			if s.opts.PendingCalls == FailPendingCalls {
+				s.failPending(disconnectErr)
+			} else {
+				s.failStreams(disconnectErr) // streams are never resent
+			}
+		}
+		if userOnDisconnect != nil {
+			userOnDisconnect(err)
+		}
+	}
+
+	userOnReconnect := res.OnReconnect
+	res.OnReconnect = func(conn net.Conn, attempt int) {
+		if s.heartbeat != nil {
+			s.heartbeat.reset()
+		}
+		if s.opts.PendingCalls == ResendPendingCalls {
+			s.resendPending(conn)
+		}
+		if userOnReconnect != nil {
+			userOnReconnect(conn, attempt)
+		}
+	}
+
+	return &res
+}
+
+// resendPending writes all calls still waiting for responses to the new connection.
+// It runs before the connection is made available to other writers, so the resent
+// calls keep their place ahead of any new ones.
+func (s *SnailClient[Req, Resp]) resendPending(conn net.Conn) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	defer s.convertBuf.Reset()
+
+	var pending []outgoing[Req, Resp]
+	if s.ids != nil {
+		pending = s.ids.drain()
+		slices.SortFunc(pending, func(a, b outgoing[Req, Resp]) int { return cmp.Compare(a.frame.id, b.frame.id) })
+	} else {
+		pending = s.fifo.drain()
+	}
+
+	var zero Resp
+	resent := 0
+	for _, item := range pending {
+		if item.future.completed.Load() {
+			continue // timed out or cancelled while disconnected
+		}
+		if err := s.writeFunc(s.convertBuf, item.frame); err != nil {
+			item.future.complete(zero, fmt.Errorf("failed to serialize request: %w", err))
+			continue
+		}
+		if s.ids != nil {
+			s.ids.put(item)
+		} else {
+			s.fifo.push(item)
+		}
+		resent++
+	}
+
+	if resent == 0 {
+		return
+	}
+
+	if err := snail_tcp.SendAll(conn, s.convertBuf.UnderlyingReadable()); err != nil {
+		// The read loop will notice the broken connection and we get another try
+		slog.Warn(fmt.Sprintf("Failed to resend %d pending calls: %v", resent, err))
+		return
+	}
+
+	slog.Debug(fmt.Sprintf("Resent %d pending calls after reconnect", resent))
+}
+
+// loopHeartbeats sends a ping every interval until the client stops, and drops the
+// connection when too many pongs in a row have been missed
+func (s *SnailClient[Req, Resp]) loopHeartbeats() {
+	ticker := time.NewTicker(s.heartbeat.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.underlying.Done():
+			return
+		}
+
+		if !s.underlying.IsConnected() {
+			continue
+		}
+
+		seq, dead := s.heartbeat.tick(time.Now())
+		if dead {
+			slog.Warn(fmt.Sprintf("Missed %d pongs in a row, dropping connection", s.heartbeat.opts.MaxMissed))
+			s.heartbeat.reset()
+			s.underlying.Disconnect(fmt.Errorf("%w: missed %d pongs", ErrHeartbeatTimeout, s.heartbeat.opts.MaxMissed))
+			continue
+		}
+
+		if err := s.sendControlFrame(envelope[Req]{kind: frameKindPing, id: seq}); err != nil {
+			slog.Debug(fmt.Sprintf("Failed to send ping: %v", err))
+		}
+	}
+}
+
+// sendControlFrame writes a ping or stream credit right away, past the batcher, so that it
+// isn't held up by the batcher's window
+func (s *SnailClient[Req, Resp]) sendControlFrame(frame envelope[Req]) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	defer s.convertBuf.Reset()
+
+	if err := s.writeFunc(s.convertBuf, frame); err != nil {
+		return fmt.Errorf("failed to serialize control frame: %w", err)
+	}
+	return s.underlying.SendBytes(s.convertBuf.UnderlyingReadable())
+}
+
+// Health returns what the heartbeats have seen of the connection, or the zero
+// value if heartbeats are disabled
+func (s *SnailClient[Req, Resp]) Health() ConnHealth {
+	if s.heartbeat == nil {
+		return ConnHealth{}
+	}
+	return s.heartbeat.snapshot()
+}
+
+// takeCall finds the call waiting for the given response frame, if any
+func (s *SnailClient[Req, Resp]) takeCall(frame *envelope[Resp]) *Future[Resp] {
+	if s.ids != nil {
+		if frame.id == 0 {
+			return nil
+		}
+		return s.ids.remove(frame.id)
+	}
+	return s.fifo.pop()
+}
+
+func (s *SnailClient[Req, Resp]) newTcpClientRespHandler() snail_tcp.ClientRespHandler {
 
 	tcpHandler := func(readBuffer *snail_buffer.Buffer) error {
 
 		if readBuffer == nil {
+			<-s.created // the connection may break before NewClient has returned
+			reason := s.underlying.Err()
+			if errors.Is(reason, snail_tcp.ErrClientClosed) {
+				s.failPending(ErrClientClosed)
+			} else {
+				s.failPending(fmt.Errorf("%w: %w", ErrDisconnected, reason))
+			}
+			if s.respHandler == nil {
+				return nil
+			}
 			var zero Resp
-			return respHandler(zero, ClientStatusDisconnected)
+			return s.respHandler(zero, ClientStatusDisconnected)
 		}
 
-		reqs, err := snail_parser.ParseAll[Resp](readBuffer, parseFunc)
+		resps, err := snail_parser.ParseAll[envelope[Resp]](readBuffer, s.parseFunc)
 		if err != nil {
 			return fmt.Errorf("failed to parse response: %w", err)
 		}
 
-		for _, req := range reqs {
-			if err := respHandler(req, ClientStatusOK); err != nil {
+		for i := range resps {
+			resp := &resps[i]
+			if resp.kind == frameKindPong {
+				if s.heartbeat != nil {
+					s.heartbeat.onPong(resp.id, time.Now())
+				}
+				continue
+			}
+			if resp.kind == frameKindError {
+				if call := s.takeCall(resp); call != nil {
+					var zero Resp
+					call.complete(zero, resp.err)
+				} else if stream := s.takeStream(resp.id); stream != nil {
+					stream.end(resp.err)
+				} else {
+					slog.Debug(fmt.Sprintf("Dropping error response without a waiting call: %v", resp.err))
+				}
+				continue
+			}
+			if resp.kind == frameKindStreamEnd {
+				if stream := s.takeStream(resp.id); stream != nil {
+					stream.end(nil)
+				}
+				continue
+			}
+			if resp.kind != frameKindResponse {
+				return fmt.Errorf("unexpected frame kind from server: %d", resp.kind)
+			}
+			if call := s.takeCall(resp); call != nil {
+				call.complete(resp.value, nil)
+				continue
+			}
+			if stream := s.findStream(resp.id); stream != nil {
+				stream.push(resp.value)
+				continue
+			}
+			if s.respHandler == nil {
+				slog.Debug("Dropping response without a waiting call or response handler")
+				continue
+			}
+			if err := s.respHandler(resp.value, ClientStatusOK); err != nil {
 				return fmt.Errorf("failed to handle response: %w", err)
 			}
 		}
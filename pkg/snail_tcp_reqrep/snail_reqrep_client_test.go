@@ -922,6 +922,10 @@ func TestNewClient_SendAndRespondWithStruct_1s_batched_performance_multiple_goro
 	//goland:noinspection GoVetUnsafePointer
 	respHandler := func(resp *requestTestStruct, status ClientStatus) error {
 
+		if status == ClientStatusDisconnected {
+			return nil
+		}
+
 		// look up the handler function
 		handlerFuncPtr, ok := callbacks[int(resp.Callback)]
 		if !ok {
@@ -0,0 +1,130 @@
+package snail_tcp_reqrep
+
+import (
+	"github.com/GiGurra/snail/pkg/snail_slice"
+	"sync"
+	"sync/atomic"
+)
+
+// Calls waiting for responses are tracked in one of two ways:
+//
+//   - fifoTracker: used without the envelope. The server is expected to reply in the same
+//     order as the requests were received, so we just keep the waiting calls in a queue.
+//     Calls are pushed by the writer, in wire order, and popped by the reader.
+//   - idTracker: used with the envelope. Every call gets a unique id that the server echoes
+//     back in its reply. The map is sharded so that concurrent callers rarely contend.
+//
+// Both keep the outgoing item of each call, so that ResendPendingCalls can write the request
+// again after a reconnect. Without that policy, the request is dropped from the item.
+
+type fifoTracker[Req any, Resp any] struct {
+	lock  sync.Mutex
+	queue []outgoing[Req, Resp]
+	head  int
+}
+
+func (t *fifoTracker[Req, Resp]) push(item outgoing[Req, Resp]) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.queue = append(t.queue, item)
+}
+
+func (t *fifoTracker[Req, Resp]) pop() *Future[Resp] {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.head == len(t.queue) {
+		return nil
+	}
+	res := t.queue[t.head].future
+	t.queue[t.head] = outgoing[Req, Resp]{}
+	t.head++
+	// compact once the consumed head makes up half the queue
+	if t.head > 64 && t.head*2 > len(t.queue) {
+		t.queue = snail_slice.DiscardFirstN(t.queue, t.head)
+		t.head = 0
+	}
+	return res
+}
+
+func (t *fifoTracker[Req, Resp]) len() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.queue) - t.head
+}
+
+func (t *fifoTracker[Req, Resp]) drain() []outgoing[Req, Resp] {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	res := make([]outgoing[Req, Resp], 0, len(t.queue)-t.head)
+	res = append(res, t.queue[t.head:]...)
+	t.queue = t.queue[:0]
+	t.head = 0
+	return res
+}
+
+const idTrackerShards = 64
+
+type idTrackerShard[Req any, Resp any] struct {
+	lock    sync.Mutex
+	pending map[uint64]outgoing[Req, Resp]
+}
+
+type idTracker[Req any, Resp any] struct {
+	shards [idTrackerShards]idTrackerShard[Req, Resp]
+	count  atomic.Int64 // so that len doesn't have to visit every shard
+}
+
+func newIdTracker[Req any, Resp any]() *idTracker[Req, Resp] {
+	res := &idTracker[Req, Resp]{}
+	for i := range res.shards {
+		res.shards[i].pending = make(map[uint64]outgoing[Req, Resp])
+	}
+	return res
+}
+
+func (t *idTracker[Req, Resp]) shard(id uint64) *idTrackerShard[Req, Resp] {
+	return &t.shards[id%idTrackerShards]
+}
+
+func (t *idTracker[Req, Resp]) put(item outgoing[Req, Resp]) {
+	id := item.frame.id
+	s := t.shard(id)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, exists := s.pending[id]; !exists {
+		t.count.Add(1)
+	}
+	s.pending[id] = item
+}
+
+func (t *idTracker[Req, Resp]) remove(id uint64) *Future[Resp] {
+	s := t.shard(id)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res, ok := s.pending[id]
+	if !ok {
+		return nil
+	}
+	delete(s.pending, id)
+	t.count.Add(-1)
+	return res.future
+}
+
+func (t *idTracker[Req, Resp]) len() int {
+	return int(t.count.Load())
+}
+
+func (t *idTracker[Req, Resp]) drain() []outgoing[Req, Resp] {
+	var res []outgoing[Req, Resp]
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.lock.Lock()
+		for id, item := range s.pending {
+			res = append(res, item)
+			delete(s.pending, id)
+			t.count.Add(-1)
+		}
+		s.lock.Unlock()
+	}
+	return res
+}
@@ -0,0 +1,185 @@
+package snail_tcp_reqrep
+
+import (
+	"fmt"
+	"github.com/GiGurra/snail/pkg/snail_buffer"
+	"github.com/GiGurra/snail/pkg/snail_parser"
+)
+
+// The envelope is an optional, small header that the reqrep layer puts in front of
+// every message written by the user codec. It is enabled with the Envelope option,
+// which must be set identically on the client and the server.
+//
+// Wire format (big endian):
+//
+//	[kind: 1 byte][id: 8 bytes][payload: user codec]
+//
+// The payload is not length prefixed. The user codec is expected to be able to find
+// the end of its own messages, exactly like without the envelope. Error frames carry
+// a *ResponseError instead of a payload, see snail_reqrep_error.go. Streaming calls have
+// frame kinds of their own, see snail_reqrep_stream.go. Stream credit frames carry a
+// 32-bit count instead of a payload.
+
+type frameKind int8
+
+const (
+	frameKindRequest  frameKind = 1
+	frameKindResponse frameKind = 2
+	frameKindPing     frameKind = 3 // heartbeat from the client, id is the ping's sequence number
+	frameKindPong     frameKind = 4 // the server's answer to a ping, with the same id
+	frameKindError    frameKind = 5 // a *ResponseError in place of the response to request id
+
+	frameKindStreamRequest frameKind = 6 // a request answered by any number of responses with its id
+	frameKindStreamEnd     frameKind = 7 // the server has sent the last response of stream id
+	frameKindStreamCancel  frameKind = 8 // the client is no longer interested in stream id
+	frameKindStreamCredit  frameKind = 9 // the client has room for credits more responses of stream id
+)
+
+const envelopeHeaderSize = 9
+
+type envelope[T any] struct {
+	kind    frameKind
+	id      uint64
+	value   T
+	err     *ResponseError // only for frameKindError
+	credits uint32         // only for frameKindStreamCredit
+}
+
+func (k frameKind) hasPayload() bool {
+	switch k {
+	case frameKindRequest, frameKindResponse, frameKindStreamRequest:
+		return true
+	default:
+		return false
+	}
+}
+
+func (k frameKind) isKnown() bool {
+	switch k {
+	case frameKindRequest, frameKindResponse, frameKindPing, frameKindPong, frameKindError,
+		frameKindStreamRequest, frameKindStreamEnd, frameKindStreamCancel, frameKindStreamCredit:
+		return true
+	default:
+		return false
+	}
+}
+
+func newEnvelopeParser[T any](inner snail_parser.ParseFunc[T]) snail_parser.ParseFunc[envelope[T]] {
+	return func(buffer *snail_buffer.Buffer) snail_parser.ParseOneResult[envelope[T]] {
+
+		res := snail_parser.ParseOneResult[envelope[T]]{}
+		if buffer.NumBytesReadable() < envelopeHeaderSize {
+			res.Status = snail_parser.ParseOneStatusNEB
+			return res
+		}
+
+		kind, err := buffer.ReadInt8()
+		if err != nil {
+			res.Err = fmt.Errorf("failed to parse envelope kind: %w", err)
+			return res
+		}
+
+		id, err := buffer.ReadInt64()
+		if err != nil {
+			res.Err = fmt.Errorf("failed to parse envelope id: %w", err)
+			return res
+		}
+
+		res.Value.kind = frameKind(kind)
+		res.Value.id = uint64(id)
+
+		if !res.Value.kind.isKnown() {
+			res.Err = fmt.Errorf("unknown envelope kind: %d", kind)
+			return res
+		}
+		if res.Value.kind == frameKindError {
+			res.Value.err, res.Status, res.Err = parseResponseError(buffer)
+			return res
+		}
+		if res.Value.kind == frameKindStreamCredit {
+			if buffer.NumBytesReadable() < 4 {
+				res.Status = snail_parser.ParseOneStatusNEB
+				return res
+			}
+			credits, err := buffer.ReadInt32()
+			if err != nil {
+				res.Err = fmt.Errorf("failed to parse stream credits: %w", err)
+				return res
+			}
+			res.Value.credits = uint32(credits)
+			res.Status = snail_parser.ParseOneStatusOK
+			return res
+		}
+		if !res.Value.kind.hasPayload() {
+			res.Status = snail_parser.ParseOneStatusOK
+			return res
+		}
+
+		inner := inner(buffer)
+		if inner.Err != nil {
+			res.Err = inner.Err
+			return res
+		}
+		if inner.Status == snail_parser.ParseOneStatusNEB {
+			// ParseAll rewinds the buffer to before the header
+			res.Status = snail_parser.ParseOneStatusNEB
+			return res
+		}
+
+		res.Value.value = inner.Value
+		res.Status = snail_parser.ParseOneStatusOK
+		return res
+	}
+}
+
+func newEnvelopeWriter[T any](inner snail_parser.WriteFunc[T]) snail_parser.WriteFunc[envelope[T]] {
+	return func(buffer *snail_buffer.Buffer, e envelope[T]) error {
+		buffer.WriteInt8(int8(e.kind))
+		buffer.WriteInt64(int64(e.id))
+		if e.kind == frameKindError {
+			return writeResponseError(buffer, e.err)
+		}
+		if e.kind == frameKindStreamCredit {
+			buffer.WriteInt32(int32(e.credits))
+			return nil
+		}
+		if e.kind.hasPayload() {
+			return inner(buffer, e.value)
+		}
+		return nil
+	}
+}
+
+// newPlainParser wraps a user parser without reading any envelope header. Everything parsed
+// is treated as the given kind, with id 0.
+func newPlainParser[T any](inner snail_parser.ParseFunc[T], kind frameKind) snail_parser.ParseFunc[envelope[T]] {
+	return func(buffer *snail_buffer.Buffer) snail_parser.ParseOneResult[envelope[T]] {
+		res := inner(buffer)
+		return snail_parser.ParseOneResult[envelope[T]]{
+			Value:  envelope[T]{kind: kind, value: res.Value},
+			Status: res.Status,
+			Err:    res.Err,
+		}
+	}
+}
+
+// newPlainWriter wraps a user writer, ignoring the envelope header.
+func newPlainWriter[T any](inner snail_parser.WriteFunc[T]) snail_parser.WriteFunc[envelope[T]] {
+	return func(buffer *snail_buffer.Buffer, e envelope[T]) error {
+		return inner(buffer, e.value)
+	}
+}
+
+func newFrameParser[T any](inner snail_parser.ParseFunc[T], useEnvelope bool, plainKind frameKind) snail_parser.ParseFunc[envelope[T]] {
+	if useEnvelope {
+		return newEnvelopeParser(inner)
+	}
+	return newPlainParser(inner, plainKind)
+}
+
+func newFrameWriter[T any](inner snail_parser.WriteFunc[T], useEnvelope bool) snail_parser.WriteFunc[envelope[T]] {
+	if useEnvelope {
+		return newEnvelopeWriter(inner)
+	}
+	return newPlainWriter(inner)
+}
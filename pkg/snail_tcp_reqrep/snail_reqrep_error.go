@@ -0,0 +1,101 @@
+package snail_tcp_reqrep
+
+import (
+	"errors"
+	"fmt"
+	"github.com/GiGurra/snail/pkg/snail_buffer"
+	"github.com/GiGurra/snail/pkg/snail_parser"
+	"math"
+)
+
+// HandlerErrorPolicy decides what the server does when a handler returns an error
+type HandlerErrorPolicy int
+
+const (
+	// CloseOnHandlerError closes the connection, failing all calls still waiting on it
+	CloseOnHandlerError HandlerErrorPolicy = iota
+	// ReplyOnHandlerError sends the error to the caller in place of the response, as a
+	// *ResponseError, and keeps the connection open. Requires the envelope. Panics
+	// still close the connection.
+	ReplyOnHandlerError
+)
+
+// ErrorCodeInternal is the code errors returned by handlers are sent with, unless they are
+// a *ResponseError with a code of their own
+const ErrorCodeInternal int32 = 500
+
+// ResponseError is an application error sent to the caller in place of a response. Return one from
+// a handler, with SnailServerOpts.HandlerErrors set to ReplyOnHandlerError, to pick the code and
+// details. Calls on the client fail with it, so it can be inspected with errors.As.
+type ResponseError struct {
+	Code    int32
+	Message string
+	Details []byte // optional, e.g. encoded with a codec of the application's choice
+}
+
+func NewResponseError(code int32, message string) *ResponseError {
+	return &ResponseError{Code: code, Message: message}
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("snail response error %d: %s", e.Code, e.Message)
+}
+
+// Is matches any *ResponseError with the same code, so errors.Is(err, &ResponseError{Code: 404})
+// tells whether a call failed with code 404
+func (e *ResponseError) Is(target error) bool {
+	var other *ResponseError
+	return errors.As(target, &other) && other.Code == e.Code
+}
+
+// toResponseError converts an error returned by a handler to what is sent to the caller
+func toResponseError(err error) *ResponseError {
+	var respErr *ResponseError
+	if errors.As(err, &respErr) {
+		return respErr
+	}
+	return &ResponseError{Code: ErrorCodeInternal, Message: err.Error()}
+}
+
+// Wire format of an error frame's payload (big endian):
+//
+//	[code: 4 bytes][message length: 4 bytes][message][details length: 4 bytes][details]
+
+func writeResponseError(buffer *snail_buffer.Buffer, e *ResponseError) error {
+	if len(e.Message) > math.MaxInt32 || len(e.Details) > math.MaxInt32 {
+		return fmt.Errorf("response error too large")
+	}
+	buffer.WriteInt32(e.Code)
+	buffer.WriteInt32(int32(len(e.Message)))
+	buffer.WriteString(e.Message)
+	buffer.WriteInt32(int32(len(e.Details)))
+	buffer.WriteBytes(e.Details)
+	return nil
+}
+
+func parseResponseError(buffer *snail_buffer.Buffer) (*ResponseError, snail_parser.ParseOneStatus, error) {
+	if !buffer.CanRead(8) {
+		return nil, snail_parser.ParseOneStatusNEB, nil
+	}
+	code, _ := buffer.ReadInt32()
+	messageLength, _ := buffer.ReadInt32()
+	if messageLength < 0 {
+		return nil, snail_parser.ParseOneStatusOK, fmt.Errorf("invalid error message length %d", messageLength)
+	}
+	if !buffer.CanRead(int(messageLength) + 4) {
+		return nil, snail_parser.ParseOneStatusNEB, nil
+	}
+	message, _ := buffer.ReadString(int(messageLength))
+	detailsLength, _ := buffer.ReadInt32()
+	if detailsLength < 0 {
+		return nil, snail_parser.ParseOneStatusOK, fmt.Errorf("invalid error details length %d", detailsLength)
+	}
+	if !buffer.CanRead(int(detailsLength)) {
+		return nil, snail_parser.ParseOneStatusNEB, nil
+	}
+	res := &ResponseError{Code: code, Message: message}
+	if detailsLength > 0 {
+		res.Details, _ = buffer.ReadBytes(int(detailsLength))
+	}
+	return res, snail_parser.ParseOneStatusOK, nil
+}
@@ -0,0 +1,146 @@
+package snail_tcp_reqrep
+
+import (
+	"errors"
+	"fmt"
+	"github.com/GiGurra/snail/pkg/snail_buffer"
+	"github.com/GiGurra/snail/pkg/snail_logging"
+	"github.com/GiGurra/snail/pkg/snail_parser"
+	"testing"
+)
+
+func TestServer_replyOnHandlerError(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	executions := []ExecutionOpts{{}, {Mode: ExecutePerConnPool, Workers: 4}, {Mode: ExecuteSharedPool, Workers: 4}}
+	for _, execution := range executions {
+		t.Run(fmt.Sprintf("mode=%d", execution.Mode), func(t *testing.T) {
+			codec := snail_parser.NewInt32Codec()
+			server, err := NewServer[int32, int32](
+				func() ServerConnHandler[int32, int32] {
+					return func(req int32, repFunc func(resp int32) error) error {
+						switch {
+						case repFunc == nil:
+							return nil
+						case req < 0:
+							return &ResponseError{Code: 404, Message: "not found", Details: []byte{byte(-req)}}
+						case req == 0:
+							return fmt.Errorf("zero is not allowed")
+						default:
+							return repFunc(req * 2)
+						}
+					}
+				},
+				nil,
+				codec.Parser,
+				codec.Writer,
+				&SnailServerOpts[int32, int32]{Envelope: true, HandlerErrors: ReplyOnHandlerError, Execution: execution},
+			)
+			if err != nil {
+				t.Fatalf("error creating server: %v", err)
+			}
+			defer server.Close()
+
+			client, err := NewClientWithOpts[int32, int32]("localhost", server.Port(), nil, nil, codec.Writer, codec.Parser,
+				&SnailClientOpts[int32, int32]{Envelope: true})
+			if err != nil {
+				t.Fatalf("error creating client: %v", err)
+			}
+			defer client.Close()
+
+			_, err = client.Call(t.Context(), -7)
+			var respErr *ResponseError
+			if !errors.As(err, &respErr) {
+				t.Fatalf("expected a *ResponseError, got %v", err)
+			}
+			if respErr.Code != 404 || respErr.Message != "not found" || len(respErr.Details) != 1 || respErr.Details[0] != 7 {
+				t.Fatalf("unexpected response error %+v", respErr)
+			}
+			if !errors.Is(err, &ResponseError{Code: 404}) || errors.Is(err, &ResponseError{Code: 500}) {
+				t.Fatalf("expected the error to match code 404 only")
+			}
+
+			_, err = client.Call(t.Context(), 0)
+			if !errors.As(err, &respErr) || respErr.Code != ErrorCodeInternal || respErr.Message != "zero is not allowed" {
+				t.Fatalf("expected an internal error with the handler's message, got %v", err)
+			}
+
+			// Errors only fail their own calls, and the connection stays open
+			futures := make([]*Future[int32], 20)
+			for i := range futures {
+				futures[i] = client.CallAsync(int32(i - 10))
+			}
+			for i, f := range futures {
+				req := int32(i - 10)
+				resp, err := f.Await(t.Context())
+				switch {
+				case req < 0 && !errors.Is(err, &ResponseError{Code: 404}):
+					t.Fatalf("expected 404 for %d, got %d, %v", req, resp, err)
+				case req == 0 && !errors.Is(err, &ResponseError{Code: ErrorCodeInternal}):
+					t.Fatalf("expected 500 for %d, got %d, %v", req, resp, err)
+				case req > 0 && (err != nil || resp != req*2):
+					t.Fatalf("expected %d for %d, got %d, %v", req*2, req, resp, err)
+				}
+			}
+		})
+	}
+}
+
+func TestServer_replyOnHandlerError_requiresEnvelope(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected ReplyOnHandlerError without the envelope to panic")
+		}
+	}()
+	codec := snail_parser.NewInt32Codec()
+	_, _ = NewServer[int32, int32](
+		func() ServerConnHandler[int32, int32] { return echoHandler },
+		nil,
+		codec.Parser,
+		codec.Writer,
+		&SnailServerOpts[int32, int32]{HandlerErrors: ReplyOnHandlerError},
+	)
+}
+
+func TestEnvelope_errorFrame(t *testing.T) {
+	codec := snail_parser.NewInt32Codec()
+	writer := newEnvelopeWriter(codec.Writer)
+	parser := newEnvelopeParser(codec.Parser)
+
+	frames := []envelope[int32]{
+		{kind: frameKindError, id: 1, err: &ResponseError{Code: 400, Message: "bad", Details: []byte("details")}},
+		{kind: frameKindResponse, id: 2, value: 42},
+		{kind: frameKindError, id: 3, err: &ResponseError{Code: 500}},
+	}
+	written := snail_buffer.New(snail_buffer.BigEndian, 1024)
+	for _, frame := range frames {
+		if err := writer(written, frame); err != nil {
+			t.Fatalf("error writing frame: %v", err)
+		}
+	}
+
+	// Feed the bytes one at a time, so every frame is first seen incomplete
+	readBuffer := snail_buffer.New(snail_buffer.BigEndian, 1024)
+	var parsed []envelope[int32]
+	for _, b := range written.Underlying() {
+		readBuffer.WriteByteNoE(b)
+		res, err := snail_parser.ParseAll(readBuffer, parser)
+		if err != nil {
+			t.Fatalf("error parsing frames: %v", err)
+		}
+		parsed = append(parsed, res...)
+	}
+
+	if len(parsed) != 3 {
+		t.Fatalf("expected 3 frames, got %d", len(parsed))
+	}
+	if e := parsed[0].err; parsed[0].id != 1 || e.Code != 400 || e.Message != "bad" || string(e.Details) != "details" {
+		t.Fatalf("unexpected first frame %+v, %+v", parsed[0], e)
+	}
+	if parsed[1].kind != frameKindResponse || parsed[1].value != 42 {
+		t.Fatalf("unexpected second frame %+v", parsed[1])
+	}
+	if e := parsed[2].err; parsed[2].id != 3 || e.Code != 500 || e.Message != "" || e.Details != nil {
+		t.Fatalf("unexpected third frame %+v, %+v", parsed[2], e)
+	}
+}
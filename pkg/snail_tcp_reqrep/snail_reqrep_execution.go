@@ -0,0 +1,299 @@
+package snail_tcp_reqrep
+
+import (
+	"errors"
+	"fmt"
+	"github.com/GiGurra/snail/pkg/snail_tcp"
+	"log/slog"
+	"net"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+)
+
+// ExecutionMode decides where the server runs handlers
+type ExecutionMode int
+
+const (
+	// ExecuteInline calls the handler on the connection's read goroutine. Reading the next
+	// requests waits for the handler, so a slow handler stalls its whole connection.
+	ExecuteInline ExecutionMode = iota
+	// ExecutePerConnPool runs up to Workers handlers concurrently per connection. Replies sent
+	// before the handler returns are written in request order. A handler that returns without
+	// replying gives up its turn, and anything it sends later is written as it comes.
+	ExecutePerConnPool
+	// ExecuteSharedPool runs up to Workers handlers concurrently across all connections of the
+	// server. Replies are written as they come, so clients need the envelope to correlate them.
+	ExecuteSharedPool
+)
+
+// ExecutionOpts configures how the server runs handlers. With the pools, the handler of a
+// connection is called concurrently and must be safe for that. When all workers are busy,
+// the server stops reading from the connection until one frees up, so TCP flow control
+// pushes back on the client. Stream handlers always run on goroutines of their own, see
+// StreamHandler.
+type ExecutionOpts struct {
+	Mode    ExecutionMode
+	Workers int // max concurrent handlers per connection or per server, see Mode. Default runtime.GOMAXPROCS(0)
+}
+
+func (o ExecutionOpts) WithDefaults() ExecutionOpts {
+	if o.Mode != ExecuteInline && o.Workers == 0 {
+		o.Workers = runtime.GOMAXPROCS(0)
+	}
+	return o
+}
+
+// connExecutor runs the handler of one connection according to the execution mode
+type connExecutor[Req any, Resp any] struct {
+	conn           net.Conn
+	handler        ServerConnHandler[Req, Resp]
+	streamHandler  StreamHandler[Req, Resp] // nil if the server has no NewStreamHandler
+	writeFrame     func(frame envelope[Resp]) error
+	sharedRepFunc  func(resp Resp) error // for requests without id or sequencing, which all reply the same way
+	slots          chan struct{}         // semaphore of the pool, shared with other connections for ExecuteSharedPool. nil for ExecuteInline
+	sequencer      *replySequencer       // orders the replies with OrderedReplies or ExecutePerConnPool, otherwise nil
+	finishOnReply  bool                  // with OrderedReplies, a request's turn ends with its reply rather than when its handler returns
+	replyErrors    bool                  // see ReplyOnHandlerError
+	maxOutstanding int
+	inFlight       sync.WaitGroup
+	failure        atomic.Pointer[error]                            // the first error of a handler run by the pool
+	onPanic        func(conn net.Conn, recovered any, stack []byte) // see snail_tcp.SnailServerOpts.OnPanic, may be nil
+
+	streamsLock sync.Mutex
+	streams     map[uint64]*StreamWriter[Resp] // open streams by id, to cancel them
+}
+
+func newConnExecutor[Req any, Resp any](
+	conn net.Conn,
+	handler ServerConnHandler[Req, Resp],
+	streamHandler StreamHandler[Req, Resp],
+	writeFrame func(frame envelope[Resp]) error,
+	opts SnailServerOpts[Req, Resp],
+	sharedSlots chan struct{},
+	onPanic func(conn net.Conn, recovered any, stack []byte),
+) *connExecutor[Req, Resp] {
+	res := &connExecutor[Req, Resp]{
+		conn:           conn,
+		handler:        handler,
+		streamHandler:  streamHandler,
+		writeFrame:     writeFrame,
+		finishOnReply:  opts.OrderedReplies,
+		replyErrors:    opts.HandlerErrors == ReplyOnHandlerError,
+		maxOutstanding: opts.MaxOutstanding,
+		streams:        make(map[uint64]*StreamWriter[Resp]),
+		onPanic:        onPanic,
+	}
+	res.sharedRepFunc = func(resp Resp) error {
+		return writeFrame(envelope[Resp]{kind: frameKindResponse, value: resp})
+	}
+	switch opts.Execution.Mode {
+	case ExecutePerConnPool:
+		res.slots = make(chan struct{}, opts.Execution.Workers)
+	case ExecuteSharedPool:
+		res.slots = sharedSlots
+	}
+	if opts.OrderedReplies || opts.Execution.Mode == ExecutePerConnPool {
+		res.sequencer = newReplySequencer()
+	}
+	return res
+}
+
+// execute handles one request, with the envelope id its replies are sent with. With a pool, it
+// blocks while all workers are busy. With OrderedReplies, it also blocks while MaxOutstanding
+// requests are waiting for replies.
+func (e *connExecutor[Req, Resp]) execute(req Req, id uint64) error {
+	if err := e.failure.Load(); err != nil {
+		return *err
+	}
+
+	var seq uint64
+	reply := e.writeFrame
+	repFunc := e.sharedRepFunc
+	if id != 0 || e.sequencer != nil {
+		reply = func(frame envelope[Resp]) error {
+			frame.id = id
+			return e.writeFrame(frame)
+		}
+		if e.sequencer != nil {
+			var err error
+			if seq, err = e.sequencer.next(e.maxOutstanding); err != nil {
+				return err
+			}
+			reply = sequenced(e.sequencer, seq, e.finishOnReply, reply)
+		}
+		repFunc = func(resp Resp) error {
+			return reply(envelope[Resp]{kind: frameKindResponse, value: resp})
+		}
+	}
+
+	if e.slots == nil {
+		return e.replyError(e.handler(req, repFunc), reply)
+	}
+
+	e.submit(func() error {
+		err := e.replyError(e.run(func() error { return e.handler(req, repFunc) }), reply)
+		if err == nil && e.sequencer != nil && !e.finishOnReply {
+			err = e.sequencer.finish(seq)
+		}
+		return err
+	})
+
+	return nil
+}
+
+// executeStream handles the request of a streaming call with the stream handler. Streams are
+// never sequenced, their responses are written as they come. Stream handlers run on goroutines
+// of their own in all execution modes, outside the pools, since Send waits for credits, which
+// only arrive while the read goroutine keeps reading.
+func (e *connExecutor[Req, Resp]) executeStream(req Req, id uint64) error {
+	if err := e.failure.Load(); err != nil {
+		return *err
+	}
+
+	if e.streamHandler == nil {
+		return e.writeFrame(envelope[Resp]{kind: frameKindError, id: id, err: &ResponseError{
+			Code:    ErrorCodeNotImplemented,
+			Message: "streaming calls are not supported by the server",
+		}})
+	}
+
+	stream := newStreamWriter(id, e.writeFrame, func() { e.removeStream(id) })
+	e.streamsLock.Lock()
+	e.streams[id] = stream
+	e.streamsLock.Unlock()
+
+	e.inFlight.Add(1)
+	go func() {
+		defer e.inFlight.Done()
+		if err := e.streamError(e.run(func() error { return e.streamHandler(req, stream) }), stream); err != nil {
+			e.fail(err)
+		}
+	}()
+
+	return nil
+}
+
+// cancelStream stops stream id, because the client is no longer interested. Unknown ids
+// belong to streams that have already ended.
+func (e *connExecutor[Req, Resp]) cancelStream(id uint64) {
+	e.streamsLock.Lock()
+	stream := e.streams[id]
+	e.streamsLock.Unlock()
+	if stream != nil {
+		stream.cancel()
+	}
+}
+
+// grantStream gives stream id room for n more responses. Unknown ids belong to streams that
+// have already ended.
+func (e *connExecutor[Req, Resp]) grantStream(id uint64, n uint32) {
+	e.streamsLock.Lock()
+	stream := e.streams[id]
+	e.streamsLock.Unlock()
+	if stream != nil {
+		stream.grant(n)
+	}
+}
+
+func (e *connExecutor[Req, Resp]) removeStream(id uint64) {
+	e.streamsLock.Lock()
+	defer e.streamsLock.Unlock()
+	delete(e.streams, id)
+}
+
+// submit runs handle on the pool, blocking while all workers are busy. An error closes the connection.
+func (e *connExecutor[Req, Resp]) submit(handle func() error) {
+	e.slots <- struct{}{}
+	e.inFlight.Add(1)
+	go func() {
+		defer e.inFlight.Done()
+		defer func() { <-e.slots }()
+
+		if err := handle(); err != nil {
+			e.fail(err)
+		}
+	}()
+}
+
+// replyError sends the error a handler returned to the caller with ReplyOnHandlerError, and
+// otherwise returns it, to close the connection
+func (e *connExecutor[Req, Resp]) replyError(err error, reply func(frame envelope[Resp]) error) error {
+	if err == nil || !e.replyErrors || errors.Is(err, ErrHandlerPanic) {
+		return err
+	}
+	return reply(envelope[Resp]{kind: frameKindError, err: toResponseError(err)})
+}
+
+// streamError is replyError for stream handlers. The error ends the stream, unless the
+// handler has already ended it, or the client has canceled it.
+func (e *connExecutor[Req, Resp]) streamError(err error, stream *StreamWriter[Resp]) error {
+	if err == nil || !e.replyErrors || errors.Is(err, ErrHandlerPanic) {
+		return err
+	}
+	err = stream.CloseWithError(err)
+	if errors.Is(err, ErrStreamClosed) || errors.Is(err, ErrStreamCanceled) {
+		return nil
+	}
+	return err
+}
+
+// run calls a handler on a pool or stream goroutine, recovering any panic, since there is no
+// connection goroutine above to do it. Like there, the panic is reported to OnPanic.
+func (e *connExecutor[Req, Resp]) run(handle func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := debug.Stack()
+			slog.Error(
+				"Recovered from panic in handler, closing connection",
+				slog.String("remote_addr", e.conn.RemoteAddr().String()),
+				slog.Any("panic", r),
+				slog.String("stack", string(stack)),
+			)
+			if e.onPanic != nil {
+				e.onPanic(e.conn, r, stack)
+			}
+			err = fmt.Errorf("%w: %v", snail_tcp.ErrHandlerPanic, r)
+		}
+	}()
+	return handle()
+}
+
+// fail records the first error of a pooled handler, and closes the connection, like
+// an error from an inline handler would
+func (e *connExecutor[Req, Resp]) fail(err error) {
+	err = fmt.Errorf("failed to handle request: %w", err)
+	if e.failure.CompareAndSwap(nil, &err) {
+		slog.Error(fmt.Sprintf("Failed to handle request, closing connection: %v", err))
+		e.stopSequencer()
+		_ = e.conn.Close()
+	}
+}
+
+// stopSequencer drops the replies held for later requests, which can't be written in order
+// anymore, and wakes the read goroutine if it is waiting for MaxOutstanding
+func (e *connExecutor[Req, Resp]) stopSequencer() {
+	if e.sequencer != nil {
+		e.sequencer.close()
+	}
+}
+
+// close cancels the streams left open, waits for the handlers still running, stops the
+// sequencer, and then tells the handler that the connection is closed. The streams go first,
+// since their handlers may be waiting for Done.
+func (e *connExecutor[Req, Resp]) close() error {
+	e.streamsLock.Lock()
+	streams := make([]*StreamWriter[Resp], 0, len(e.streams))
+	for _, stream := range e.streams {
+		streams = append(streams, stream)
+	}
+	e.streamsLock.Unlock()
+	for _, stream := range streams {
+		stream.cancel()
+	}
+	e.inFlight.Wait()
+	e.stopSequencer()
+	var zero Req
+	return e.handler(zero, nil)
+}
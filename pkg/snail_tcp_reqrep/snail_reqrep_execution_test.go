@@ -0,0 +1,453 @@
+package snail_tcp_reqrep
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/GiGurra/snail/pkg/snail_logging"
+	"github.com/GiGurra/snail/pkg/snail_parser"
+	"github.com/GiGurra/snail/pkg/snail_tcp"
+	"io"
+	"net"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newPipelinedServer starts an int32 server without envelope, so replies are only matched
+// to requests by their order
+func newPipelinedServer(t *testing.T, execution ExecutionOpts, handler ServerConnHandler[int32, int32]) *SnailServer[int32, int32] {
+	t.Helper()
+	return newPipelinedServerWithOpts(t, &SnailServerOpts[int32, int32]{Execution: execution}, handler)
+}
+
+func newPipelinedServerWithOpts(t *testing.T, opts *SnailServerOpts[int32, int32], handler ServerConnHandler[int32, int32]) *SnailServer[int32, int32] {
+	t.Helper()
+	codec := snail_parser.NewInt32Codec()
+	server, err := NewServer[int32, int32](
+		func() ServerConnHandler[int32, int32] { return handler },
+		nil,
+		codec.Parser,
+		codec.Writer,
+		opts,
+	)
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+	return server
+}
+
+func dialPipelined(t *testing.T, server *SnailServer[int32, int32]) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", server.Port()))
+	if err != nil {
+		t.Fatalf("error dialing server: %v", err)
+	}
+	return conn
+}
+
+func writeInt32s(t *testing.T, conn net.Conn, values ...int32) {
+	t.Helper()
+	buf := make([]byte, 0, 4*len(values))
+	for _, v := range values {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(v))
+	}
+	if _, err := conn.Write(buf); err != nil {
+		t.Fatalf("error writing: %v", err)
+	}
+}
+
+func readInt32s(t *testing.T, conn net.Conn, n int) []int32 {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 4*n)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("error reading: %v", err)
+	}
+	res := make([]int32, n)
+	for i := range res {
+		res[i] = int32(binary.BigEndian.Uint32(buf[4*i:]))
+	}
+	return res
+}
+
+func TestExecution_perConnPool_ordersReplies(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	server := newPipelinedServer(t, ExecutionOpts{Mode: ExecutePerConnPool, Workers: 5},
+		func(req int32, repFunc func(resp int32) error) error {
+			if repFunc == nil {
+				return nil
+			}
+			time.Sleep(time.Duration(5-req) * 20 * time.Millisecond) // the first request is the slowest
+			return repFunc(req)
+		})
+	defer server.Close()
+
+	conn := dialPipelined(t, server)
+	defer func() { _ = conn.Close() }()
+
+	start := time.Now()
+	writeInt32s(t, conn, 0, 1, 2, 3, 4)
+	if got := readInt32s(t, conn, 5); !slices.Equal(got, []int32{0, 1, 2, 3, 4}) {
+		t.Fatalf("expected replies in request order, got %v", got)
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Fatalf("expected handlers to run concurrently, took %v", elapsed)
+	}
+}
+
+func TestExecution_perConnPool_backpressure(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	release := make(chan struct{})
+	started := atomic.Int32{}
+	server := newPipelinedServer(t, ExecutionOpts{Mode: ExecutePerConnPool, Workers: 2},
+		func(req int32, repFunc func(resp int32) error) error {
+			if repFunc == nil {
+				return nil
+			}
+			started.Add(1)
+			<-release
+			return repFunc(req)
+		})
+	defer server.Close()
+
+	conn := dialPipelined(t, server)
+	defer func() { _ = conn.Close() }()
+
+	writeInt32s(t, conn, 1, 2, 3, 4)
+	time.Sleep(50 * time.Millisecond)
+	if n := started.Load(); n != 2 {
+		t.Fatalf("expected 2 handlers running while the pool is saturated, got %d", n)
+	}
+
+	close(release)
+	if got := readInt32s(t, conn, 4); !slices.Equal(got, []int32{1, 2, 3, 4}) {
+		t.Fatalf("expected replies in request order, got %v", got)
+	}
+}
+
+func TestExecution_sharedPool(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	release := make(chan struct{})
+	running := atomic.Int32{}
+	maxRunning := atomic.Int32{}
+	closed := make(chan struct{}, 2)
+	server := newPipelinedServer(t, ExecutionOpts{Mode: ExecuteSharedPool, Workers: 3},
+		func(req int32, repFunc func(resp int32) error) error {
+			if repFunc == nil {
+				closed <- struct{}{}
+				return nil
+			}
+			n := running.Add(1)
+			for m := maxRunning.Load(); n > m && !maxRunning.CompareAndSwap(m, n); m = maxRunning.Load() {
+			}
+			<-release
+			running.Add(-1)
+			return repFunc(req)
+		})
+	defer server.Close()
+
+	conns := []net.Conn{dialPipelined(t, server), dialPipelined(t, server)}
+	for _, conn := range conns {
+		writeInt32s(t, conn, 1, 2, 3)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := running.Load(); n != 3 {
+		t.Fatalf("expected the shared pool to be saturated with 3 handlers, got %d", n)
+	}
+
+	close(release)
+	for _, conn := range conns {
+		got := readInt32s(t, conn, 3)
+		slices.Sort(got)
+		if !slices.Equal(got, []int32{1, 2, 3}) {
+			t.Fatalf("expected replies to all requests, got %v", got)
+		}
+		_ = conn.Close()
+	}
+	if n := maxRunning.Load(); n != 3 {
+		t.Fatalf("expected at most 3 concurrent handlers, got %d", n)
+	}
+
+	for range conns {
+		select {
+		case <-closed:
+		case <-time.After(1 * time.Second):
+			t.Fatalf("expected handlers to be told about closed connections")
+		}
+	}
+}
+
+func TestExecution_poolPanicsReachOnPanic(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	panics := make(chan any, 1)
+	codec := snail_parser.NewInt32Codec()
+	server, err := NewServer[int32, int32](
+		func() ServerConnHandler[int32, int32] {
+			return func(req int32, repFunc func(resp int32) error) error {
+				if repFunc != nil && req == 13 {
+					panic("unlucky")
+				}
+				return nil
+			}
+		},
+		&snail_tcp.SnailServerOpts{OnPanic: func(_ net.Conn, recovered any, _ []byte) { panics <- recovered }},
+		codec.Parser,
+		codec.Writer,
+		&SnailServerOpts[int32, int32]{Execution: ExecutionOpts{Mode: ExecutePerConnPool, Workers: 2}},
+	)
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+	defer server.Close()
+
+	conn := dialPipelined(t, server)
+	defer conn.Close()
+	writeInt32s(t, conn, 13)
+
+	select {
+	case recovered := <-panics:
+		if recovered != "unlucky" {
+			t.Fatalf("expected the handler's panic, got %v", recovered)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected OnPanic to be called for a pooled handler")
+	}
+}
+
+func TestOrderedReplies_asyncHandlers(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	for _, batching := range []BatcherOpts{{}, NewBatcherOpts(10)} {
+		t.Run(fmt.Sprintf("batchSize=%d", batching.BatchSize), func(t *testing.T) {
+			server := newPipelinedServerWithOpts(t, &SnailServerOpts[int32, int32]{OrderedReplies: true, Batcher: batching},
+				func(req int32, repFunc func(resp int32) error) error {
+					if repFunc == nil {
+						return nil
+					}
+					go func() {
+						time.Sleep(time.Duration(10-req) * 5 * time.Millisecond) // later requests reply first
+						_ = repFunc(req)
+					}()
+					return nil
+				})
+			defer server.Close()
+
+			conn := dialPipelined(t, server)
+			defer func() { _ = conn.Close() }()
+
+			writeInt32s(t, conn, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9)
+			if got := readInt32s(t, conn, 10); !slices.Equal(got, []int32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}) {
+				t.Fatalf("expected replies in request order, got %v", got)
+			}
+		})
+	}
+}
+
+func TestOrderedReplies_maxOutstanding(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	replies := make(chan func() error, 10)
+	server := newPipelinedServerWithOpts(t, &SnailServerOpts[int32, int32]{OrderedReplies: true, MaxOutstanding: 3},
+		func(req int32, repFunc func(resp int32) error) error {
+			if repFunc != nil {
+				replies <- func() error { return repFunc(req) }
+			}
+			return nil
+		})
+	defer server.Close()
+
+	conn := dialPipelined(t, server)
+	defer func() { _ = conn.Close() }()
+
+	writeInt32s(t, conn, 1, 2, 3, 4, 5)
+	time.Sleep(50 * time.Millisecond)
+	if n := len(replies); n != 3 {
+		t.Fatalf("expected reading to pause at 3 unanswered requests, got %d handled", n)
+	}
+
+	for i := 0; i < 5; i++ {
+		select {
+		case reply := <-replies:
+			_ = reply()
+		case <-time.After(1 * time.Second):
+			t.Fatalf("expected request %d to be handled", i+1)
+		}
+	}
+	if got := readInt32s(t, conn, 5); !slices.Equal(got, []int32{1, 2, 3, 4, 5}) {
+		t.Fatalf("expected the replies in order, got %v", got)
+	}
+}
+
+func TestOrderedReplies_failingHandlers(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	t.Run("sent errors end the turn", func(t *testing.T) {
+		codec := snail_parser.NewInt32Codec()
+		server, err := NewServer[int32, int32](
+			func() ServerConnHandler[int32, int32] {
+				return func(req int32, repFunc func(resp int32) error) error {
+					switch {
+					case repFunc == nil:
+						return nil
+					case req < 0:
+						return &ResponseError{Code: 400, Message: "negative"}
+					default:
+						return repFunc(req)
+					}
+				}
+			},
+			nil,
+			codec.Parser,
+			codec.Writer,
+			&SnailServerOpts[int32, int32]{
+				Envelope:       true,
+				OrderedReplies: true,
+				MaxOutstanding: 1,
+				HandlerErrors:  ReplyOnHandlerError,
+				Execution:      ExecutionOpts{Mode: ExecutePerConnPool, Workers: 2},
+			},
+		)
+		if err != nil {
+			t.Fatalf("error creating server: %v", err)
+		}
+		defer server.Close()
+		client, err := NewClientWithOpts[int32, int32]("localhost", server.Port(), nil, nil, codec.Writer, codec.Parser,
+			&SnailClientOpts[int32, int32]{Envelope: true})
+		if err != nil {
+			t.Fatalf("error creating client: %v", err)
+		}
+		defer client.Close()
+
+		// With room for one outstanding request, the next is only read once the error has ended its turn
+		futures := make([]*Future[int32], 6)
+		for i := range futures {
+			futures[i] = client.CallAsync(int32(i%2*2 - 1))
+		}
+		for i, f := range futures {
+			ctx, cancel := context.WithTimeout(t.Context(), 2*time.Second)
+			resp, err := f.Await(ctx)
+			cancel()
+			if i%2 == 0 && !errors.Is(err, &ResponseError{Code: 400}) {
+				t.Fatalf("expected call %d to fail with 400, got %d, %v", i, resp, err)
+			}
+			if i%2 == 1 && (err != nil || resp != 1) {
+				t.Fatalf("expected call %d to return 1, got %d, %v", i, resp, err)
+			}
+		}
+	})
+
+	t.Run("errors closing the connection stop waiting for MaxOutstanding", func(t *testing.T) {
+		release := make(chan struct{})
+		closed := make(chan struct{})
+		server := newPipelinedServerWithOpts(t,
+			&SnailServerOpts[int32, int32]{
+				OrderedReplies: true,
+				MaxOutstanding: 2,
+				Execution:      ExecutionOpts{Mode: ExecutePerConnPool, Workers: 4},
+			},
+			func(req int32, repFunc func(resp int32) error) error {
+				switch {
+				case repFunc == nil:
+					close(closed)
+					return nil
+				case req == 1:
+					<-release
+					return fmt.Errorf("request 1 failed")
+				default:
+					return nil // holds its turn, waiting for a reply that never comes
+				}
+			})
+		defer server.Close()
+
+		conn := dialPipelined(t, server)
+		defer func() { _ = conn.Close() }()
+
+		// Request 3 waits for room behind 1 and 2, until the failure of 1 closes the connection
+		writeInt32s(t, conn, 1, 2, 3)
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+
+		select {
+		case <-closed:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected the connection to be closed after the handler failed")
+		}
+	})
+}
+
+func TestReplySequencer(t *testing.T) {
+
+	var written []string
+	s := newReplySequencer()
+	write := func(v string) func() error {
+		return func() error { written = append(written, v); return nil }
+	}
+	next := func() uint64 {
+		seq, err := s.next(0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return seq
+	}
+
+	a, b, c := next(), next(), next()
+
+	_ = s.reply(c, write("c"))
+	_ = s.reply(b, write("b1"))
+	_ = s.reply(a, write("a")) // a's turn, written right away
+	if !slices.Equal(written, []string{"a"}) {
+		t.Fatalf("expected only a to be written, got %v", written)
+	}
+
+	_ = s.finish(c) // finished, but b is still ahead of it
+	_ = s.finish(a)
+	if !slices.Equal(written, []string{"a", "b1"}) {
+		t.Fatalf("expected b's held reply to follow a, got %v", written)
+	}
+
+	_ = s.reply(b, write("b2")) // b's turn, written right away
+	_ = s.finish(b)
+	_ = s.reply(a, write("late a")) // a is done, written as it comes
+	if want := []string{"a", "b1", "b2", "c", "late a"}; !slices.Equal(written, want) {
+		t.Fatalf("expected %v, got %v", want, written)
+	}
+}
+
+func TestReplySequencer_close(t *testing.T) {
+
+	s := newReplySequencer()
+	a, _ := s.next(1)
+	if err := s.reply(a+1, func() error { t.Fatalf("expected held replies to be dropped"); return nil }); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := s.next(1) // waits for a's turn to end
+		result <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	s.close()
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("expected net.ErrClosed, got %v", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expected next to give up once closed")
+	}
+	if err := s.reply(a, func() error { return nil }); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected replies after close to fail, got %v", err)
+	}
+	if err := s.finish(a); err != nil {
+		t.Fatalf("expected finishing after close to be a no-op, got %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package snail_tcp_reqrep
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Future is the pending result of a call made with SnailClient.CallAsync.
+// It is completed exactly once, either with a response or with an error.
+type Future[T any] struct {
+	done      chan struct{}
+	completed atomic.Bool
+	value     T
+	err       error
+	id        uint64                     // correlation id, if any
+	timer     atomic.Pointer[time.Timer] // timeout timer, if any
+}
+
+func newFuture[T any]() *Future[T] {
+	return &Future[T]{
+		done: make(chan struct{}),
+	}
+}
+
+func newFailedFuture[T any](err error) *Future[T] {
+	f := newFuture[T]()
+	var zero T
+	f.complete(zero, err)
+	return f
+}
+
+// complete sets the result of the future. Only the first call has any effect,
+// and true is returned if this call was the one that completed the future.
+func (f *Future[T]) complete(value T, err error) bool {
+	if !f.completed.CompareAndSwap(false, true) {
+		return false
+	}
+	if t := f.timer.Load(); t != nil {
+		t.Stop()
+	}
+	f.value = value
+	f.err = err
+	close(f.done)
+	return true
+}
+
+// Done returns a channel that is closed once the future has been completed.
+func (f *Future[T]) Done() <-chan struct{} {
+	return f.done
+}
+
+// Get blocks until the future is completed and returns its result.
+func (f *Future[T]) Get() (T, error) {
+	<-f.done
+	return f.value, f.err
+}
+
+// Await blocks until the future is completed or the context is done,
+// whichever happens first.
+func (f *Future[T]) Await(ctx context.Context) (T, error) {
+	select {
+	case <-f.done:
+		return f.value, f.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
@@ -0,0 +1,106 @@
+package snail_tcp_reqrep
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrHeartbeatTimeout is the reason a connection is dropped after too many missed pongs
+var ErrHeartbeatTimeout = errors.New("snail heartbeat timeout")
+
+// HeartbeatOpts configures application level heartbeats. The client sends a ping every Interval,
+// which the server answers with a pong without involving the user handler. Unlike TCP keepalive,
+// this also catches peers that are wedged, or hidden behind a load balancer that keeps the TCP
+// connection alive. Heartbeats are multiplexed with the user's messages, so they require the envelope.
+type HeartbeatOpts struct {
+	Interval  time.Duration // time between pings. Default 1 s
+	MaxMissed int           // pongs missed in a row before the connection is dropped. Default 3
+}
+
+func (o HeartbeatOpts) WithDefaults() HeartbeatOpts {
+	if o.Interval == 0 {
+		o.Interval = 1 * time.Second
+	}
+	if o.MaxMissed == 0 {
+		o.MaxMissed = 3
+	}
+	return o
+}
+
+// ConnHealth is what the heartbeats have seen of the connection so far
+type ConnHealth struct {
+	RTT         time.Duration // round-trip time of the last pong. 0 if none has arrived yet
+	SmoothedRTT time.Duration // moving average of the round-trip time, weighted like TCP's SRTT
+	MissedPongs int           // pings in a row that were not answered before the next one was due
+	LastPong    time.Time     // when the last pong arrived
+}
+
+// heartbeat tracks the pings in flight on one client connection
+type heartbeat struct {
+	opts     HeartbeatOpts
+	lock     sync.Mutex
+	seq      uint64 // of the last ping sent
+	sentAt   time.Time
+	answered bool
+	health   ConnHealth
+}
+
+func newHeartbeat(opts HeartbeatOpts) *heartbeat {
+	return &heartbeat{opts: opts.WithDefaults(), answered: true}
+}
+
+// tick is called once per interval. It returns the sequence number of the next ping
+// to send, or dead = true if too many pongs in a row have been missed.
+func (h *heartbeat) tick(now time.Time) (seq uint64, dead bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if !h.answered {
+		h.health.MissedPongs++
+		if h.health.MissedPongs >= h.opts.MaxMissed {
+			return 0, true
+		}
+	}
+
+	h.seq++
+	h.sentAt = now
+	h.answered = false
+	return h.seq, false
+}
+
+// onPong records the pong for the given ping. Pongs for older pings are ignored,
+// they already count as missed.
+func (h *heartbeat) onPong(seq uint64, now time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if seq != h.seq || h.answered {
+		return
+	}
+
+	rtt := now.Sub(h.sentAt)
+	h.answered = true
+	h.health.RTT = rtt
+	if h.health.SmoothedRTT == 0 {
+		h.health.SmoothedRTT = rtt
+	} else {
+		h.health.SmoothedRTT += (rtt - h.health.SmoothedRTT) / 8
+	}
+	h.health.MissedPongs = 0
+	h.health.LastPong = now
+}
+
+// reset forgets the ping in flight, e.g. after a reconnect
+func (h *heartbeat) reset() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.answered = true
+	h.health.MissedPongs = 0
+}
+
+func (h *heartbeat) snapshot() ConnHealth {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.health
+}
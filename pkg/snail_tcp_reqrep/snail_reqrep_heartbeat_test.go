@@ -0,0 +1,137 @@
+package snail_tcp_reqrep
+
+import (
+	"context"
+	"errors"
+	"github.com/GiGurra/snail/pkg/snail_buffer"
+	"github.com/GiGurra/snail/pkg/snail_logging"
+	"github.com/GiGurra/snail/pkg/snail_parser"
+	"github.com/GiGurra/snail/pkg/snail_tcp"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat_pongs(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	for _, batcher := range []BatcherOpts{{}, NewBatcherOpts(64)} {
+		handled := atomic.Int64{}
+		codec := snail_parser.NewInt32Codec()
+		server, err := NewServer[int32, int32](
+			func() ServerConnHandler[int32, int32] {
+				return func(req int32, repFunc func(resp int32) error) error {
+					if repFunc == nil {
+						return nil
+					}
+					handled.Add(1)
+					return repFunc(req)
+				}
+			},
+			nil,
+			codec.Parser,
+			codec.Writer,
+			&SnailServerOpts[int32, int32]{Envelope: true, Batcher: batcher},
+		)
+		if err != nil {
+			t.Fatalf("error creating server: %v", err)
+		}
+
+		client, err := NewClientWithOpts[int32, int32](
+			"localhost",
+			server.Port(),
+			nil,
+			nil,
+			codec.Writer,
+			codec.Parser,
+			&SnailClientOpts[int32, int32]{Envelope: true, Heartbeat: &HeartbeatOpts{Interval: 10 * time.Millisecond}},
+		)
+		if err != nil {
+			t.Fatalf("error creating client: %v", err)
+		}
+
+		waitFor(t, func() bool { return !client.Health().LastPong.IsZero() })
+
+		health := client.Health()
+		if health.RTT <= 0 || health.SmoothedRTT <= 0 || health.MissedPongs != 0 {
+			t.Fatalf("unexpected health: %+v", health)
+		}
+
+		// Calls work alongside the heartbeats, and pings never reach the user handler
+		resp, err := client.Call(context.Background(), 42)
+		if err != nil || resp != 42 {
+			t.Fatalf("expected 42, got %d, %v", resp, err)
+		}
+		if handled.Load() != 1 {
+			t.Fatalf("expected the user handler to see 1 request, got %d", handled.Load())
+		}
+
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestHeartbeat_missedPongsDropConnection(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	// Accepts connections, but never answers anything. Like a wedged peer.
+	server, err := snail_tcp.NewServer(func(_ net.Conn) snail_tcp.ServerConnHandler {
+		return func(buffer *snail_buffer.Buffer) error {
+			if buffer != nil {
+				buffer.ReadAll()
+			}
+			return nil
+		}
+	}, nil)
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+	defer server.Close()
+
+	codec := snail_parser.NewInt32Codec()
+	client, err := NewClientWithOpts[int32, int32](
+		"localhost",
+		server.Port(),
+		nil,
+		nil,
+		codec.Writer,
+		codec.Parser,
+		&SnailClientOpts[int32, int32]{Envelope: true, Heartbeat: &HeartbeatOpts{Interval: 10 * time.Millisecond, MaxMissed: 3}},
+	)
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	defer client.Close()
+
+	call := client.CallAsync(1)
+
+	select {
+	case <-client.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected the connection to be dropped after missed pongs")
+	}
+
+	if !errors.Is(client.Err(), ErrHeartbeatTimeout) {
+		t.Fatalf("expected ErrHeartbeatTimeout, got %v", client.Err())
+	}
+	if _, err := call.Await(context.Background()); !errors.Is(err, ErrDisconnected) || !errors.Is(err, ErrHeartbeatTimeout) {
+		t.Fatalf("expected pending call to fail with ErrDisconnected and ErrHeartbeatTimeout, got %v", err)
+	}
+}
+
+func TestHeartbeat_requiresEnvelope(t *testing.T) {
+	codec := snail_parser.NewInt32Codec()
+	_, err := NewClientWithOpts[int32, int32](
+		"localhost",
+		1,
+		nil,
+		nil,
+		codec.Writer,
+		codec.Parser,
+		&SnailClientOpts[int32, int32]{Heartbeat: &HeartbeatOpts{}},
+	)
+	if err == nil {
+		t.Fatalf("expected error for heartbeats without envelope")
+	}
+}
@@ -0,0 +1,168 @@
+package snail_tcp_reqrep
+
+import (
+	"fmt"
+	"github.com/GiGurra/snail/pkg/snail_metrics"
+	"github.com/GiGurra/snail/pkg/snail_tcp"
+	"log/slog"
+	"math"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// ErrHandlerPanic is returned by handlers wrapped with RecoverInterceptor when they panic. It is
+// the same error the underlying server closes connections with when it recovers a panic itself.
+var ErrHandlerPanic = snail_tcp.ErrHandlerPanic
+
+// Interceptor wraps the handler of a connection, to add behaviour around every request, such as
+// logging, auth checks or timing. It is called once per connection, so any per connection state
+// can live in the returned handler.
+//
+// The returned handler gets each request with its repFunc, and decides whether and how to call
+// next. Wrapping repFunc before passing it on intercepts the replies as well. Like any
+// ServerConnHandler, it is called with a nil repFunc when the connection closes, which
+// should be passed on to next.
+type Interceptor[Req any, Resp any] func(conn net.Conn, next ServerConnHandler[Req, Resp]) ServerConnHandler[Req, Resp]
+
+// ChainInterceptors combines interceptors into one. The first one is the outermost, i.e. it
+// sees each request first and each reply last.
+func ChainInterceptors[Req any, Resp any](interceptors ...Interceptor[Req, Resp]) Interceptor[Req, Resp] {
+	return func(conn net.Conn, next ServerConnHandler[Req, Resp]) ServerConnHandler[Req, Resp] {
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			next = interceptors[i](conn, next)
+		}
+		return next
+	}
+}
+
+// withInterceptors returns a handler factory applying the interceptors to every new handler
+func withInterceptors[Req any, Resp any](
+	newHandlerFunc func() ServerConnHandler[Req, Resp],
+	conn net.Conn,
+	interceptors []Interceptor[Req, Resp],
+) func() ServerConnHandler[Req, Resp] {
+	if len(interceptors) == 0 {
+		return newHandlerFunc
+	}
+	chain := ChainInterceptors(interceptors...)
+	return func() ServerConnHandler[Req, Resp] {
+		return chain(conn, newHandlerFunc())
+	}
+}
+
+// RecoverInterceptor turns panics in the handler into an error wrapping ErrHandlerPanic,
+// which closes the connection instead of crashing the process. The stack is logged.
+func RecoverInterceptor[Req any, Resp any]() Interceptor[Req, Resp] {
+	return func(conn net.Conn, next ServerConnHandler[Req, Resp]) ServerConnHandler[Req, Resp] {
+		return func(req Req, repFunc func(resp Resp) error) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error(
+						"Handler panicked",
+						slog.String("remote_addr", conn.RemoteAddr().String()),
+						slog.Any("panic", r),
+						slog.String("stack", string(debug.Stack())),
+					)
+					err = fmt.Errorf("%w: %v", ErrHandlerPanic, r)
+				}
+			}()
+			return next(req, repFunc)
+		}
+	}
+}
+
+// SlowRequestInterceptor logs a warning for requests that took longer than threshold from
+// arriving to being replied to. Requests that are never replied to are not logged.
+func SlowRequestInterceptor[Req any, Resp any](threshold time.Duration) Interceptor[Req, Resp] {
+	return func(conn net.Conn, next ServerConnHandler[Req, Resp]) ServerConnHandler[Req, Resp] {
+		return func(req Req, repFunc func(resp Resp) error) error {
+			if repFunc == nil {
+				return next(req, repFunc)
+			}
+			start := time.Now()
+			return next(req, func(resp Resp) error {
+				if elapsed := time.Since(start); elapsed > threshold {
+					slog.Warn(
+						"Slow request",
+						slog.String("remote_addr", conn.RemoteAddr().String()),
+						slog.Duration("elapsed", elapsed),
+						slog.Duration("threshold", threshold),
+					)
+				}
+				return repFunc(resp)
+			})
+		}
+	}
+}
+
+// RateLimitInterceptor limits each connection to perSecond requests on average, with bursts
+// of up to burst requests. Requests over the limit are delayed rather than rejected. Since
+// handlers run on the connection's read loop, that stops reading from the connection,
+// so TCP flow control pushes back on the client.
+func RateLimitInterceptor[Req any, Resp any](perSecond float64, burst int) Interceptor[Req, Resp] {
+	if perSecond <= 0 {
+		panic(fmt.Sprintf("perSecond must be > 0, got %v", perSecond))
+	}
+	if burst <= 0 {
+		panic(fmt.Sprintf("burst must be > 0, got %d", burst))
+	}
+	return func(conn net.Conn, next ServerConnHandler[Req, Resp]) ServerConnHandler[Req, Resp] {
+		bucket := tokenBucket{rate: perSecond, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+		return func(req Req, repFunc func(resp Resp) error) error {
+			if repFunc != nil {
+				time.Sleep(bucket.take())
+			}
+			return next(req, repFunc)
+		}
+	}
+}
+
+// tokenBucket is a plain token bucket, where every request takes one token
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64 // may go negative, which is a debt the next requests wait for
+	last   time.Time
+}
+
+// take takes a token, and returns how long to wait before using it
+func (b *tokenBucket) take() time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// CountingInterceptor counts requests, replies and handler errors in snail_reqrep_requests_total,
+// snail_reqrep_replies_total and snail_reqrep_handler_errors_total
+func CountingInterceptor[Req any, Resp any](metrics snail_metrics.Metrics) Interceptor[Req, Resp] {
+	metrics = snail_metrics.OrDiscard(metrics)
+	requests := metrics.Counter("snail_reqrep_requests_total", "Requests passed to handlers")
+	replies := metrics.Counter("snail_reqrep_replies_total", "Replies sent by handlers")
+	handlerErrors := metrics.Counter("snail_reqrep_handler_errors_total", "Requests whose handler returned an error")
+	return func(conn net.Conn, next ServerConnHandler[Req, Resp]) ServerConnHandler[Req, Resp] {
+		return func(req Req, repFunc func(resp Resp) error) error {
+			if repFunc == nil {
+				return next(req, repFunc)
+			}
+			requests.Add(1)
+			err := next(req, func(resp Resp) error {
+				replies.Add(1)
+				return repFunc(resp)
+			})
+			if err != nil {
+				handlerErrors.Add(1)
+			}
+			return err
+		}
+	}
+}
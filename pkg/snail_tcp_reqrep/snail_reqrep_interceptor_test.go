@@ -0,0 +1,148 @@
+package snail_tcp_reqrep
+
+import (
+	"context"
+	"errors"
+	"github.com/GiGurra/snail/pkg/snail_logging"
+	"github.com/GiGurra/snail/pkg/snail_metrics"
+	"github.com/GiGurra/snail/pkg/snail_parser"
+	"github.com/samber/lo"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func echoHandler(req int32, repFunc func(resp int32) error) error {
+	if repFunc == nil {
+		return nil
+	}
+	return repFunc(req)
+}
+
+func TestInterceptors_order(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	var trace []string
+	tracing := func(name string) Interceptor[int32, int32] {
+		return func(conn net.Conn, next ServerConnHandler[int32, int32]) ServerConnHandler[int32, int32] {
+			return func(req int32, repFunc func(resp int32) error) error {
+				if repFunc == nil {
+					return next(req, repFunc)
+				}
+				trace = append(trace, name+" req")
+				return next(req+1, func(resp int32) error {
+					trace = append(trace, name+" rep")
+					return repFunc(resp * 10)
+				})
+			}
+		}
+	}
+
+	codec := snail_parser.NewInt32Codec()
+	server := newEchoServer(t, codec, echoServerOpts[int32]{
+		Server: lo.ToPtr(SnailServerOpts[int32, int32]{Envelope: true}.WithInterceptors(tracing("a"), tracing("b"))),
+	})
+	defer server.Close()
+	client := newEchoClient(t, codec, server, nil, &SnailClientOpts[int32, int32]{Envelope: true})
+	defer client.Close()
+
+	resp, err := client.Call(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("error calling: %v", err)
+	}
+	if resp != 300 { // (1 + 1 + 1) * 10 * 10
+		t.Fatalf("expected 300, got %d", resp)
+	}
+	if want := []string{"a req", "b req", "b rep", "a rep"}; !slices.Equal(trace, want) {
+		t.Fatalf("expected %v, got %v", want, trace)
+	}
+}
+
+func TestInterceptors_recover(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "error", false)
+
+	codec := snail_parser.NewInt32Codec()
+	server := newEchoServer(t, codec, echoServerOpts[int32]{
+		Handler: func(req int32, repFunc func(resp int32) error) error {
+			if req == 13 {
+				panic("unlucky")
+			}
+			return echoHandler(req, repFunc)
+		},
+		Server: lo.ToPtr(SnailServerOpts[int32, int32]{Envelope: true}.WithInterceptors(RecoverInterceptor[int32, int32]())),
+	})
+	defer server.Close()
+	client := newEchoClient(t, codec, server, nil, &SnailClientOpts[int32, int32]{Envelope: true})
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if _, err := client.Call(ctx, 13); !errors.Is(err, ErrDisconnected) {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+
+	// The server is still up
+	other := newEchoClient(t, codec, server, nil, &SnailClientOpts[int32, int32]{Envelope: true})
+	defer other.Close()
+	if resp, err := other.Call(ctx, 7); err != nil || resp != 7 {
+		t.Fatalf("expected 7, got %d, %v", resp, err)
+	}
+}
+
+func TestInterceptors_rateLimit(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	codec := snail_parser.NewInt32Codec()
+	server := newEchoServer(t, codec, echoServerOpts[int32]{
+		Server: lo.ToPtr(SnailServerOpts[int32, int32]{Envelope: true}.WithInterceptors(RateLimitInterceptor[int32, int32](100, 2))),
+	})
+	defer server.Close()
+	client := newEchoClient(t, codec, server, nil, &SnailClientOpts[int32, int32]{Envelope: true})
+	defer client.Close()
+
+	start := time.Now()
+	for i := int32(0); i < 7; i++ {
+		if _, err := client.Call(context.Background(), i); err != nil {
+			t.Fatalf("error calling: %v", err)
+		}
+	}
+
+	// 2 requests are free, the other 5 wait 10 ms each
+	if elapsed := time.Since(start); elapsed < 45*time.Millisecond {
+		t.Fatalf("expected requests to be delayed, took %v", elapsed)
+	}
+}
+
+func TestInterceptors_counting(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	registry := snail_metrics.NewRegistry()
+	codec := snail_parser.NewInt32Codec()
+	server := newEchoServer(t, codec, echoServerOpts[int32]{
+		Server: lo.ToPtr(SnailServerOpts[int32, int32]{Envelope: true}.WithInterceptors(
+			CountingInterceptor[int32, int32](registry),
+			SlowRequestInterceptor[int32, int32](1*time.Minute),
+		)),
+	})
+	defer server.Close()
+	client := newEchoClient(t, codec, server, nil, &SnailClientOpts[int32, int32]{Envelope: true})
+	defer client.Close()
+
+	for i := int32(0); i < 3; i++ {
+		if _, err := client.Call(context.Background(), i); err != nil {
+			t.Fatalf("error calling: %v", err)
+		}
+	}
+
+	for name, want := range map[string]float64{
+		"snail_reqrep_requests_total":       3,
+		"snail_reqrep_replies_total":        3,
+		"snail_reqrep_handler_errors_total": 0,
+	} {
+		if got, _ := registry.Value(name); got != want {
+			t.Fatalf("expected %s = %v, got %v", name, want, got)
+		}
+	}
+}
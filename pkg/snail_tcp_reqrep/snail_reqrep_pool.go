@@ -0,0 +1,341 @@
+package snail_tcp_reqrep
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/GiGurra/snail/pkg/snail_parser"
+	"github.com/GiGurra/snail/pkg/snail_tcp"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoHealthyConnections is returned by Pool when all of its connections are ejected
+var ErrNoHealthyConnections = errors.New("snail pool has no healthy connections")
+
+// Endpoint is a server address that a Pool connects to
+type Endpoint struct {
+	Host string
+	Port int
+}
+
+func (e Endpoint) String() string {
+	return net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+}
+
+// BalanceStrategy decides which of the pool's connections a request is sent on
+type BalanceStrategy int
+
+const (
+	// BalanceRoundRobin cycles through the healthy connections
+	BalanceRoundRobin BalanceStrategy = iota
+	// BalanceLeastOutstanding picks the connection with the fewest calls waiting for responses
+	BalanceLeastOutstanding
+	// BalancePowerOfTwo picks two connections at random and uses the one with the fewest calls
+	// waiting for responses. Almost as good as BalanceLeastOutstanding, without scanning every connection.
+	BalancePowerOfTwo
+)
+
+type PoolOpts[Req any, Resp any] struct {
+	ConnsPerEndpoint int             // default 1
+	Strategy         BalanceStrategy // default BalanceRoundRobin
+	// RetryInterval is how long to wait between attempts to re-add an ejected connection. Default 1 s.
+	RetryInterval time.Duration
+	TcpOpts       *snail_tcp.SnailClientOpts
+	ClientOpts    *SnailClientOpts[Req, Resp]
+}
+
+func (o PoolOpts[Req, Resp]) WithDefaults() PoolOpts[Req, Resp] {
+	if o.ConnsPerEndpoint == 0 {
+		o.ConnsPerEndpoint = 1
+	}
+	if o.RetryInterval == 0 {
+		o.RetryInterval = 1 * time.Second
+	}
+	return o
+}
+
+type poolConn[Req any, Resp any] struct {
+	endpoint Endpoint
+	client   atomic.Pointer[SnailClient[Req, Resp]] // nil while ejected
+}
+
+// Pool keeps a number of connections to one or more endpoints, and balances requests
+// over them. A connection whose client stops, or fails to send, is ejected from the pool
+// and redialed in the background until it can be re-added.
+//
+// The response handler is shared by all connections. Individual connections going away
+// are handled by the pool and not passed on as ClientStatusDisconnected; that status is
+// delivered once, when the pool is closed.
+type Pool[Req any, Resp any] struct {
+	conns       []*poolConn[Req, Resp]
+	opts        PoolOpts[Req, Resp]
+	respHandler ClientRespHandler[Resp]
+	writeFunc   snail_parser.WriteFunc[Req]
+	parseFunc   snail_parser.ParseFunc[Resp]
+	next        atomic.Uint64
+	closed      chan struct{}
+	closeOnce   sync.Once
+	supervisors sync.WaitGroup
+}
+
+func NewPool[Req any, Resp any](
+	endpoints []Endpoint,
+	handlerFunc ClientRespHandler[Resp],
+	writeFunc snail_parser.WriteFunc[Req],
+	parseFunc snail_parser.ParseFunc[Resp],
+	opts *PoolOpts[Req, Resp],
+) (*Pool[Req, Resp], error) {
+
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no endpoints given")
+	}
+
+	if opts == nil {
+		opts = &PoolOpts[Req, Resp]{}
+	}
+
+	res := &Pool[Req, Resp]{
+		opts:        opts.WithDefaults(),
+		respHandler: handlerFunc,
+		writeFunc:   writeFunc,
+		parseFunc:   parseFunc,
+		closed:      make(chan struct{}),
+	}
+
+	clients := make([]*SnailClient[Req, Resp], 0, len(endpoints)*res.opts.ConnsPerEndpoint)
+	var lastErr error
+	for _, endpoint := range endpoints {
+		for i := 0; i < res.opts.ConnsPerEndpoint; i++ {
+			conn := &poolConn[Req, Resp]{endpoint: endpoint}
+			client, err := res.newClient(endpoint)
+			if err != nil {
+				// leave it ejected, the supervisor will keep trying
+				slog.Warn(fmt.Sprintf("Failed to connect to %v: %v", endpoint, err))
+				lastErr = err
+			} else {
+				conn.client.Store(client)
+				clients = append(clients, client)
+			}
+			res.conns = append(res.conns, conn)
+		}
+	}
+
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("failed to connect to any endpoint: %w", lastErr)
+	}
+
+	for _, conn := range res.conns {
+		res.supervisors.Add(1)
+		go res.supervise(conn, conn.client.Load())
+	}
+
+	return res, nil
+}
+
+func (p *Pool[Req, Resp]) newClient(endpoint Endpoint) (*SnailClient[Req, Resp], error) {
+	return NewClientWithOpts[Req, Resp](
+		endpoint.Host,
+		endpoint.Port,
+		p.opts.TcpOpts,
+		p.connRespHandler,
+		p.writeFunc,
+		p.parseFunc,
+		p.opts.ClientOpts,
+	)
+}
+
+func (p *Pool[Req, Resp]) connRespHandler(resp Resp, status ClientStatus) error {
+	if status == ClientStatusDisconnected || p.respHandler == nil {
+		return nil // the supervisor takes care of the connection
+	}
+	return p.respHandler(resp, status)
+}
+
+// supervise ejects the connection when its client stops, and redials until it can be re-added.
+// The client is nil if the connection starts out ejected.
+func (p *Pool[Req, Resp]) supervise(conn *poolConn[Req, Resp], client *SnailClient[Req, Resp]) {
+	defer p.supervisors.Done()
+
+	for {
+		if client != nil {
+			select {
+			case <-client.Done():
+				slog.Warn(fmt.Sprintf("Ejecting connection to %v: %v", conn.endpoint, client.Err()))
+				conn.client.Store(nil)
+			case <-p.closed:
+				conn.client.Store(nil)
+				client.Close()
+				<-client.Done()
+				return
+			}
+		}
+
+		select {
+		case <-time.After(p.opts.RetryInterval):
+		case <-p.closed:
+			return
+		}
+
+		var err error
+		client, err = p.newClient(conn.endpoint)
+		if err != nil {
+			slog.Debug(fmt.Sprintf("Failed to reconnect to %v: %v", conn.endpoint, err))
+			continue
+		}
+
+		slog.Info(fmt.Sprintf("Re-adding connection to %v", conn.endpoint))
+		conn.client.Store(client)
+	}
+}
+
+// eject takes a connection out of rotation right away. Closing the client makes
+// its supervisor redial it.
+func (p *Pool[Req, Resp]) eject(conn *poolConn[Req, Resp], client *SnailClient[Req, Resp]) {
+	if conn.client.CompareAndSwap(client, nil) {
+		client.Close()
+	}
+}
+
+// pick selects a healthy connection according to the balance strategy
+func (p *Pool[Req, Resp]) pick() (*poolConn[Req, Resp], *SnailClient[Req, Resp], error) {
+	n := len(p.conns)
+	start := int(p.next.Add(1) % uint64(n))
+
+	switch p.opts.Strategy {
+	case BalanceLeastOutstanding:
+		var bestConn *poolConn[Req, Resp]
+		var bestClient *SnailClient[Req, Resp]
+		bestOutstanding := math.MaxInt
+		for i := 0; i < n; i++ { // scan from a moving start, so that ties are round-robin
+			conn := p.conns[(start+i)%n]
+			client := conn.client.Load()
+			if client == nil {
+				continue
+			}
+			if outstanding := client.Outstanding(); outstanding < bestOutstanding {
+				bestConn, bestClient, bestOutstanding = conn, client, outstanding
+			}
+		}
+		if bestClient != nil {
+			return bestConn, bestClient, nil
+		}
+		return nil, nil, ErrNoHealthyConnections
+
+	case BalancePowerOfTwo:
+		if n > 1 {
+			i := rand.IntN(n)
+			j := rand.IntN(n - 1)
+			if j >= i {
+				j++
+			}
+			a, b := p.conns[i], p.conns[j]
+			ca, cb := a.client.Load(), b.client.Load()
+			switch {
+			case ca != nil && cb != nil:
+				if cb.Outstanding() < ca.Outstanding() {
+					return b, cb, nil
+				}
+				return a, ca, nil
+			case ca != nil:
+				return a, ca, nil
+			case cb != nil:
+				return b, cb, nil
+			}
+		}
+		// both choices were ejected, fall back to round-robin
+	}
+
+	for i := 0; i < n; i++ {
+		conn := p.conns[(start+i)%n]
+		if client := conn.client.Load(); client != nil {
+			return conn, client, nil
+		}
+	}
+	return nil, nil, ErrNoHealthyConnections
+}
+
+// Send sends a request on one of the pool's connections. If sending fails, the
+// connection is ejected and the error returned. The request is not retried.
+func (p *Pool[Req, Resp]) Send(r Req) error {
+	conn, client, err := p.pick()
+	if err != nil {
+		return err
+	}
+	if err := client.Send(r); err != nil {
+		p.eject(conn, client)
+		return err
+	}
+	return nil
+}
+
+// SendBatch sends all requests on the same connection, see Send.
+func (p *Pool[Req, Resp]) SendBatch(rs []Req) error {
+	conn, client, err := p.pick()
+	if err != nil {
+		return err
+	}
+	if err := client.SendBatch(rs); err != nil {
+		p.eject(conn, client)
+		return err
+	}
+	return nil
+}
+
+// CallAsync is SnailClient.CallAsync on one of the pool's connections
+func (p *Pool[Req, Resp]) CallAsync(r Req) *Future[Resp] {
+	_, client, err := p.pick()
+	if err != nil {
+		return newFailedFuture[Resp](err)
+	}
+	return client.CallAsync(r)
+}
+
+// Call is SnailClient.Call on one of the pool's connections
+func (p *Pool[Req, Resp]) Call(ctx context.Context, r Req) (Resp, error) {
+	_, client, err := p.pick()
+	if err != nil {
+		var zero Resp
+		return zero, err
+	}
+	return client.Call(ctx, r)
+}
+
+// Size returns the total number of connections in the pool, healthy or not
+func (p *Pool[Req, Resp]) Size() int {
+	return len(p.conns)
+}
+
+// Healthy returns the number of connections currently in rotation
+func (p *Pool[Req, Resp]) Healthy() int {
+	n := 0
+	for _, conn := range p.conns {
+		if conn.client.Load() != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Close closes all connections and waits for them to stop. The response handler
+// is then called with ClientStatusDisconnected.
+func (p *Pool[Req, Resp]) Close() {
+	first := false
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		first = true
+	})
+	p.supervisors.Wait()
+	if first && p.respHandler != nil {
+		var zero Resp
+		if err := p.respHandler(zero, ClientStatusDisconnected); err != nil {
+			slog.Error(fmt.Sprintf("Failed to handle pool close: %v", err))
+		}
+	}
+}
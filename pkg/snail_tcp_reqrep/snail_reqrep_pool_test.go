@@ -0,0 +1,164 @@
+package snail_tcp_reqrep
+
+import (
+	"context"
+	"fmt"
+	"github.com/GiGurra/snail/pkg/snail_logging"
+	"github.com/GiGurra/snail/pkg/snail_parser"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingEcho echoes requests, and counts them
+func countingEcho(count *atomic.Int64) ServerConnHandler[int32, int32] {
+	return func(req int32, repFunc func(resp int32) error) error {
+		if repFunc == nil {
+			return nil
+		}
+		count.Add(1)
+		return repFunc(req)
+	}
+}
+
+func TestPool_roundRobin(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	codec := snail_parser.NewInt32Codec()
+	counts := make([]atomic.Int64, 2)
+	endpoints := make([]Endpoint, len(counts))
+	for i := range counts {
+		server := newEchoServer(t, codec, echoServerOpts[int32]{Handler: countingEcho(&counts[i])})
+		defer server.Close()
+		endpoints[i] = Endpoint{Host: "localhost", Port: server.Port()}
+	}
+
+	pool, err := NewPool[int32, int32](endpoints, nil, codec.Writer, codec.Parser, &PoolOpts[int32, int32]{
+		ConnsPerEndpoint: 2,
+	})
+	if err != nil {
+		t.Fatalf("error creating pool: %v", err)
+	}
+	defer pool.Close()
+
+	if pool.Size() != 4 || pool.Healthy() != 4 {
+		t.Fatalf("expected 4 healthy connections, got %d of %d", pool.Healthy(), pool.Size())
+	}
+
+	for i := 0; i < 100; i++ {
+		resp, err := pool.Call(context.Background(), int32(i))
+		if err != nil {
+			t.Fatalf("error calling: %v", err)
+		}
+		if resp != int32(i) {
+			t.Fatalf("expected %d, got %d", i, resp)
+		}
+	}
+
+	for i := range counts {
+		if counts[i].Load() != 50 {
+			t.Fatalf("expected 50 requests on endpoint %d, got %d", i, counts[i].Load())
+		}
+	}
+}
+
+func TestPool_leastOutstanding(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	for _, strategy := range []BalanceStrategy{BalanceLeastOutstanding, BalancePowerOfTwo} {
+		t.Run(fmt.Sprintf("strategy=%d", strategy), func(t *testing.T) {
+			codec := snail_parser.NewInt32Codec()
+			silent := newSilentServer(t, nil)
+			defer silent.Close()
+			echo := newEchoServer(t, codec, echoServerOpts[int32]{})
+			defer echo.Close()
+
+			pool, err := NewPool[int32, int32](
+				[]Endpoint{{Host: "localhost", Port: silent.Port()}, {Host: "localhost", Port: echo.Port()}},
+				nil,
+				codec.Writer,
+				codec.Parser,
+				&PoolOpts[int32, int32]{Strategy: strategy},
+			)
+			if err != nil {
+				t.Fatalf("error creating pool: %v", err)
+			}
+			defer pool.Close()
+
+			// The first call that lands on the silent server stays outstanding forever,
+			// so every following call should go to the echo server.
+			nFailed := 0
+			for i := 0; i < 20; i++ {
+				ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+				_, err := pool.Call(ctx, int32(i))
+				cancel()
+				if err != nil {
+					nFailed++
+				}
+			}
+
+			if nFailed > 1 {
+				t.Fatalf("expected at most 1 call to the silent server, got %d", nFailed)
+			}
+		})
+	}
+}
+
+func TestPool_ejectAndReAdd(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	codec := snail_parser.NewInt32Codec()
+	countA, countB := atomic.Int64{}, atomic.Int64{}
+	serverA := newEchoServer(t, codec, echoServerOpts[int32]{Handler: countingEcho(&countA)})
+	defer serverA.Close()
+	serverB := newEchoServer(t, codec, echoServerOpts[int32]{Handler: countingEcho(&countB)})
+	portB := serverB.Port()
+
+	pool, err := NewPool[int32, int32](
+		[]Endpoint{{Host: "localhost", Port: serverA.Port()}, {Host: "localhost", Port: portB}},
+		nil,
+		codec.Writer,
+		codec.Parser,
+		&PoolOpts[int32, int32]{RetryInterval: 10 * time.Millisecond},
+	)
+	if err != nil {
+		t.Fatalf("error creating pool: %v", err)
+	}
+	defer pool.Close()
+
+	killServer(serverB)
+	waitFor(t, func() bool { return pool.Healthy() == 1 })
+
+	for i := 0; i < 10; i++ {
+		if _, err := pool.Call(context.Background(), int32(i)); err != nil {
+			t.Fatalf("expected calls to succeed on the remaining connection, got %v", err)
+		}
+	}
+	if countA.Load() != 10 {
+		t.Fatalf("expected all calls on endpoint A, got %d", countA.Load())
+	}
+
+	serverB = newEchoServer(t, codec, echoServerOpts[int32]{Port: portB, Handler: countingEcho(&countB)})
+	defer serverB.Close()
+	waitFor(t, func() bool { return pool.Healthy() == 2 })
+
+	for i := 0; i < 10; i++ {
+		if _, err := pool.Call(context.Background(), int32(i)); err != nil {
+			t.Fatalf("error calling: %v", err)
+		}
+	}
+	if countB.Load() == 0 {
+		t.Fatalf("expected calls on endpoint B after it was re-added")
+	}
+}
+
+func TestEndpoint_String(t *testing.T) {
+	for endpoint, expected := range map[Endpoint]string{
+		{Host: "localhost", Port: 9000}: "localhost:9000",
+		{Host: "::1", Port: 9000}:       "[::1]:9000",
+	} {
+		if endpoint.String() != expected {
+			t.Fatalf("expected %s, got %s", expected, endpoint.String())
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package snail_tcp_reqrep
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// errSequencerClosed is returned by the sequencer once its connection is closing
+var errSequencerClosed = fmt.Errorf("reply sequencer stopped: %w", net.ErrClosed)
+
+// replySequencer writes replies in request order. Every request gets a sequence number when it is
+// parsed. Replies for the request whose turn it is are written right away, while replies for later
+// requests are held until all earlier requests have finished, i.e. given up their turn.
+type replySequencer struct {
+	lock     sync.Mutex
+	room     *sync.Cond                // signalled when requests finish, see next
+	nextSeq  uint64                    // handed out to the next request
+	head     uint64                    // the request whose turn it is
+	held     map[uint64][]func() error // replies waiting for their turn
+	finished map[uint64]struct{}       // requests that finished before their turn
+	closed   bool                      // see close
+}
+
+func newReplySequencer() *replySequencer {
+	res := &replySequencer{
+		held:     make(map[uint64][]func() error),
+		finished: make(map[uint64]struct{}),
+	}
+	res.room = sync.NewCond(&res.lock)
+	return res
+}
+
+// next assigns the next sequence number. It must be called in request order. If maxOutstanding
+// requests are already waiting for their turn to end, it blocks until one of them has, or the
+// sequencer is closed. 0 = no limit
+func (s *replySequencer) next(maxOutstanding int) (uint64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for !s.closed && maxOutstanding > 0 && s.nextSeq-s.head >= uint64(maxOutstanding) {
+		s.room.Wait()
+	}
+	if s.closed {
+		return 0, errSequencerClosed
+	}
+	seq := s.nextSeq
+	s.nextSeq++
+	return seq, nil
+}
+
+// close stops the sequencer when its connection is closing. Held replies are dropped, since
+// writing them out of turn would answer the wrong requests, and next stops waiting.
+func (s *replySequencer) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	clear(s.held)
+	s.room.Broadcast()
+}
+
+// reply writes a reply for request seq, now if it is its turn, otherwise once it is
+func (s *replySequencer) reply(seq uint64, write func() error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return errSequencerClosed
+	}
+	if seq <= s.head {
+		return write()
+	}
+	s.held[seq] = append(s.held[seq], write)
+	return nil
+}
+
+// finish ends the turn of request seq. If it was the head, the held replies of the following
+// requests are written, up to the first request that hasn't finished yet.
+func (s *replySequencer) finish(seq uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.finishLocked(seq)
+}
+
+// replyAndFinish writes the reply that ends the turn of request seq, see reply and finish
+func (s *replySequencer) replyAndFinish(seq uint64, write func() error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return errSequencerClosed
+	}
+	var err error
+	if seq <= s.head {
+		err = write()
+	} else {
+		s.held[seq] = append(s.held[seq], write)
+	}
+	if finishErr := s.finishLocked(seq); err == nil {
+		err = finishErr
+	}
+	return err
+}
+
+func (s *replySequencer) finishLocked(seq uint64) error {
+	if s.closed || seq < s.head {
+		return nil
+	}
+	s.finished[seq] = struct{}{}
+
+	var firstErr error
+	for {
+		if _, ok := s.finished[s.head]; !ok {
+			return firstErr
+		}
+		delete(s.finished, s.head)
+		s.head++
+		s.room.Signal() // only the read goroutine waits
+		for _, write := range s.held[s.head] {
+			if err := write(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		delete(s.held, s.head)
+	}
+}
+
+// sequenced returns a repFunc that writes through the sequencer as request seq. With
+// finishOnReply, the first reply ends the request's turn.
+func sequenced[Resp any](s *replySequencer, seq uint64, finishOnReply bool, repFunc func(resp Resp) error) func(resp Resp) error {
+	if finishOnReply {
+		return func(resp Resp) error {
+			return s.replyAndFinish(seq, func() error { return repFunc(resp) })
+		}
+	}
+	return func(resp Resp) error {
+		return s.reply(seq, func() error { return repFunc(resp) })
+	}
+}
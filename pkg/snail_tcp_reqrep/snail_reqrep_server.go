@@ -1,12 +1,16 @@
 package snail_tcp_reqrep
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/GiGurra/snail/pkg/snail_batcher"
 	"github.com/GiGurra/snail/pkg/snail_buffer"
+	"github.com/GiGurra/snail/pkg/snail_metrics"
 	"github.com/GiGurra/snail/pkg/snail_parser"
 	"github.com/GiGurra/snail/pkg/snail_tcp"
 	"github.com/samber/lo"
+	"log/slog"
 	"net"
 	"sync"
 	"time"
@@ -24,12 +28,21 @@ type SnailServer[Req any, Resp any] struct {
 	parseFunc      snail_parser.ParseFunc[Req]
 	writeFunc      snail_parser.WriteFunc[Resp]
 	opts           SnailServerOpts[Req, Resp]
+
+	sessionsLock sync.Mutex
+	sessions     map[*Session[Resp]]struct{}
+
+	sharedSlots chan struct{}                                    // semaphore of ExecuteSharedPool, otherwise nil
+	onPanic     func(conn net.Conn, recovered any, stack []byte) // snail_tcp.SnailServerOpts.OnPanic, for handlers run by a pool
 }
 
 type BatcherOpts struct {
 	WindowSize time.Duration
 	BatchSize  int
 	QueueSize  int
+	// Metrics, if set, receives the batch sizes, flush reasons and queue wait times of the
+	// batchers, labeled batcher="server" or batcher="client". Server connections share them.
+	Metrics snail_metrics.Metrics
 }
 
 func NewBatcherOpts(batchSize int) BatcherOpts {
@@ -55,13 +68,59 @@ func (b BatcherOpts) IsEnabled() bool {
 	return b.BatchSize > 0
 }
 
+// DefaultMaxOutstanding is the default of SnailServerOpts.MaxOutstanding
+const DefaultMaxOutstanding = 1024
+
 type SnailServerOpts[Req any, Resp any] struct {
 	Batcher      BatcherOpts // will be created per conn by the server implementation
 	PerConnCodec func() PerConnCodec[Req, Resp]
+	// Envelope prefixes every message with a small header carrying a correlation id,
+	// see snail_reqrep_envelope.go. Clients must be configured with the same setting.
+	Envelope bool
+	// ShutdownNotice, if set, is called once per connection when Shutdown starts, and the
+	// returned message is sent to the client as an unsolicited response. With the envelope
+	// enabled it arrives with correlation id 0, so clients pass it to their ClientRespHandler.
+	ShutdownNotice func() Resp
+	// NewConnHandler, if set, is used instead of the newHandlerFunc passed to NewServer. It gets
+	// the connection the handler is for, e.g. to check the client certificate with
+	// snail_tcp.PeerCertificates when using mutual TLS.
+	NewConnHandler func(conn net.Conn) ServerConnHandler[Req, Resp]
+	// NewSessionHandler, if set, is used instead of both NewConnHandler and the newHandlerFunc
+	// passed to NewServer. It gets the connection's Session, e.g. to push messages to the client.
+	NewSessionHandler func(session *Session[Resp]) ServerConnHandler[Req, Resp]
+	// NewStreamHandler, if set, creates the handler of streaming calls for each connection, see
+	// StreamHandler. Requires the envelope. Without it, streaming calls fail with ErrorCodeNotImplemented.
+	NewStreamHandler func(session *Session[Resp]) StreamHandler[Req, Resp]
+	// Interceptors wrap the handler of every connection, the first one outermost. See Interceptor.
+	Interceptors []Interceptor[Req, Resp]
+	// Execution decides where handlers run. Default ExecuteInline, on the connection's read goroutine.
+	Execution ExecutionOpts
+	// OrderedReplies writes replies in request order, as pipelined protocols like HTTP/1.1 and RESP
+	// need, even when handlers reply later from other goroutines. Replies that are ready early are
+	// held until all earlier requests have been replied to, so every request must get a reply.
+	// The first reply to a request ends its turn. Any further replies to it are written as they come.
+	// A handler error that closes the connection drops the held replies, see HandlerErrors.
+	OrderedReplies bool
+	// MaxOutstanding bounds the requests waiting for replies with OrderedReplies, or for their handlers
+	// with ExecutePerConnPool. Reading from the connection pauses while it is reached. Default 1024
+	MaxOutstanding int
+	// HandlerErrors decides whether a handler error closes the connection, which is the default,
+	// or is sent to the caller as a *ResponseError. Sending it requires the envelope.
+	HandlerErrors HandlerErrorPolicy
+	// Metrics, if set, counts the frames parsed and written, and the parse errors that close
+	// connections, labeled codec="server". Default Batcher.Metrics
+	Metrics snail_metrics.Metrics
 }
 
 func (s SnailServerOpts[Req, Resp]) WithDefaults() SnailServerOpts[Req, Resp] {
 	s.Batcher = s.Batcher.WithDefaults()
+	s.Execution = s.Execution.WithDefaults()
+	if s.MaxOutstanding == 0 {
+		s.MaxOutstanding = DefaultMaxOutstanding
+	}
+	if s.Metrics == nil {
+		s.Metrics = s.Batcher.Metrics
+	}
 	return s
 }
 
@@ -75,6 +134,16 @@ func (s SnailServerOpts[Req, Resp]) WithPerConnCodec(codecFunc func() PerConnCod
 	return s
 }
 
+func (s SnailServerOpts[Req, Resp]) WithInterceptors(interceptors ...Interceptor[Req, Resp]) SnailServerOpts[Req, Resp] {
+	s.Interceptors = append(append([]Interceptor[Req, Resp]{}, s.Interceptors...), interceptors...)
+	return s
+}
+
+func (s SnailServerOpts[Req, Resp]) WithEnvelope() SnailServerOpts[Req, Resp] {
+	s.Envelope = true
+	return s
+}
+
 func (s SnailServerOpts[Req, Resp]) validate() {
 	if s.Batcher.IsEnabled() {
 		if s.Batcher.BatchSize <= 0 {
@@ -91,6 +160,18 @@ func (s SnailServerOpts[Req, Resp]) validate() {
 			panic(fmt.Sprintf("QueueSize must be a multiple of BatchSize, got %d", s.Batcher.QueueSize))
 		}
 	}
+	if s.HandlerErrors == ReplyOnHandlerError && !s.Envelope {
+		panic("HandlerErrors ReplyOnHandlerError requires the envelope")
+	}
+	if s.NewStreamHandler != nil && !s.Envelope {
+		panic("NewStreamHandler requires the envelope")
+	}
+	if s.MaxOutstanding < 0 {
+		panic(fmt.Sprintf("MaxOutstanding must be >= 0, got %d", s.MaxOutstanding))
+	}
+	if s.Execution.Mode != ExecuteInline && s.Execution.Workers <= 0 {
+		panic(fmt.Sprintf("Workers must be > 0, got %d", s.Execution.Workers))
+	}
 }
 
 type PerConnCodec[Req any, Resp any] struct {
@@ -105,6 +186,34 @@ func NewServer[Req any, Resp any](
 	writeFunc snail_parser.WriteFunc[Resp],
 	opts *SnailServerOpts[Req, Resp],
 ) (*SnailServer[Req, Resp], error) {
+	return newServer(func(handler func(conn net.Conn) snail_tcp.ServerConnHandler) (*snail_tcp.SnailServer, error) {
+		return snail_tcp.NewServer(handler, tcpOpts)
+	}, tcpOpts, newHandlerFunc, parseFunc, writeFunc, opts)
+}
+
+// NewServerWithListener is NewServer on connections accepted from an existing listener,
+// e.g. a Unix socket. See snail_tcp.NewServerWithListener.
+func NewServerWithListener[Req any, Resp any](
+	listener net.Listener,
+	newHandlerFunc func() ServerConnHandler[Req, Resp],
+	tcpOpts *snail_tcp.SnailServerOpts,
+	parseFunc snail_parser.ParseFunc[Req],
+	writeFunc snail_parser.WriteFunc[Resp],
+	opts *SnailServerOpts[Req, Resp],
+) (*SnailServer[Req, Resp], error) {
+	return newServer(func(handler func(conn net.Conn) snail_tcp.ServerConnHandler) (*snail_tcp.SnailServer, error) {
+		return snail_tcp.NewServerWithListener(listener, handler, tcpOpts)
+	}, tcpOpts, newHandlerFunc, parseFunc, writeFunc, opts)
+}
+
+func newServer[Req any, Resp any](
+	newUnderlying func(handler func(conn net.Conn) snail_tcp.ServerConnHandler) (*snail_tcp.SnailServer, error),
+	tcpOpts *snail_tcp.SnailServerOpts,
+	newHandlerFunc func() ServerConnHandler[Req, Resp],
+	parseFunc snail_parser.ParseFunc[Req],
+	writeFunc snail_parser.WriteFunc[Resp],
+	opts *SnailServerOpts[Req, Resp],
+) (*SnailServer[Req, Resp], error) {
 
 	if opts == nil {
 		opts = &SnailServerOpts[Req, Resp]{}
@@ -112,12 +221,32 @@ func NewServer[Req any, Resp any](
 	opts = lo.ToPtr(opts.WithDefaults())
 	opts.validate()
 
+	if newHandlerFunc == nil && opts.NewConnHandler == nil && opts.NewSessionHandler == nil {
+		return nil, fmt.Errorf("newHandlerFunc must be provided if opts.NewConnHandler and opts.NewSessionHandler are nil")
+	}
+
 	if parseFunc == nil || writeFunc == nil {
 		if opts.PerConnCodec == nil {
 			return nil, fmt.Errorf("parseFunc and writeFunc must be provided if opts.PerConnCodec is nil")
 		}
 	}
 
+	res := &SnailServer[Req, Resp]{
+		newHandlerFunc: newHandlerFunc,
+		parseFunc:      parseFunc,
+		writeFunc:      writeFunc,
+		opts:           *opts,
+		sessions:       make(map[*Session[Resp]]struct{}),
+	}
+
+	if tcpOpts != nil {
+		res.onPanic = tcpOpts.OnPanic
+	}
+
+	if opts.Execution.Mode == ExecuteSharedPool {
+		res.sharedSlots = make(chan struct{}, opts.Execution.Workers)
+	}
+
 	newTcpHandlerFunc := func(conn net.Conn) snail_tcp.ServerConnHandler {
 		ownParseFunc := parseFunc
 		ownWriteFunc := writeFunc
@@ -126,21 +255,26 @@ func NewServer[Req any, Resp any](
 			ownParseFunc = codec.ParseFunc
 			ownWriteFunc = codec.WriteFunc
 		}
-		return newTcpServerConnHandler[Req, Resp](newHandlerFunc, ownParseFunc, ownWriteFunc, opts.Batcher, conn)
+		ownHandlerFunc := func(session *Session[Resp]) ServerConnHandler[Req, Resp] {
+			switch {
+			case opts.NewSessionHandler != nil:
+				return opts.NewSessionHandler(session)
+			case opts.NewConnHandler != nil:
+				return opts.NewConnHandler(conn)
+			default:
+				return newHandlerFunc()
+			}
+		}
+		return newTcpServerConnHandler[Req, Resp](res, ownHandlerFunc, ownParseFunc, ownWriteFunc, conn)
 	}
 
-	underlying, err := snail_tcp.NewServer(newTcpHandlerFunc, tcpOpts)
+	underlying, err := newUnderlying(newTcpHandlerFunc)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create underlying server: %w", err)
 	}
+	res.underlying = underlying
 
-	return &SnailServer[Req, Resp]{
-		underlying:     underlying,
-		newHandlerFunc: newHandlerFunc,
-		parseFunc:      parseFunc,
-		writeFunc:      writeFunc,
-		opts:           *opts,
-	}, nil
+	return res, nil
 }
 
 func (s *SnailServer[Req, Resp]) Underlying() *snail_tcp.SnailServer {
@@ -151,26 +285,91 @@ func (s *SnailServer[Req, Resp]) Port() int {
 	return s.underlying.Port()
 }
 
+func (s *SnailServer[Req, Resp]) Addr() net.Addr {
+	return s.underlying.Addr()
+}
+
 func (s *SnailServer[Req, Resp]) Close() {
 	s.underlying.Close()
 }
 
+// Shutdown gracefully shuts down the server. It stops accepting new connections, sends the
+// ShutdownNotice (if configured) to every connected client, stops reading requests, waits for
+// the handlers to finish and for all batched replies to be written, and then closes the
+// connections. See snail_tcp.SnailServer.Shutdown for how the context is used.
+func (s *SnailServer[Req, Resp]) Shutdown(ctx context.Context) error {
+	if s.opts.ShutdownNotice != nil {
+		for _, session := range s.Sessions() {
+			if err := session.Push(s.opts.ShutdownNotice()); err != nil {
+				slog.Debug(fmt.Sprintf("Failed to send shutdown notice: %v", err))
+			}
+		}
+	}
+	return s.underlying.Shutdown(ctx)
+}
+
+// Sessions returns the sessions of all currently connected clients, in no particular order
+func (s *SnailServer[Req, Resp]) Sessions() []*Session[Resp] {
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+	res := make([]*Session[Resp], 0, len(s.sessions))
+	for session := range s.sessions {
+		res = append(res, session)
+	}
+	return res
+}
+
+// Broadcast pushes resp to every connected client, see Session.Push. Clients that disconnect
+// meanwhile are skipped. The returned error joins the errors of all other failed pushes.
+func (s *SnailServer[Req, Resp]) Broadcast(resp Resp) error {
+	var errs []error
+	for _, session := range s.Sessions() {
+		if err := session.Push(resp); err != nil && !errors.Is(err, ErrSessionClosed) {
+			errs = append(errs, fmt.Errorf("%s: %w", session.RemoteAddr(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *SnailServer[Req, Resp]) addSession(session *Session[Resp]) {
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+	s.sessions[session] = struct{}{}
+}
+
+func (s *SnailServer[Req, Resp]) removeSession(session *Session[Resp]) {
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+	delete(s.sessions, session)
+	session.closed.Store(true)
+}
+
 func newTcpServerConnHandler[Req any, Resp any](
-	userHandlerFunc func() ServerConnHandler[Req, Resp],
-	parseFunc snail_parser.ParseFunc[Req],
-	writeFunc snail_parser.WriteFunc[Resp],
-	batcherOpts BatcherOpts,
+	server *SnailServer[Req, Resp],
+	userHandlerFunc func(session *Session[Resp]) ServerConnHandler[Req, Resp],
+	userParseFunc snail_parser.ParseFunc[Req],
+	userWriteFunc snail_parser.WriteFunc[Resp],
 	conn net.Conn,
 ) snail_tcp.ServerConnHandler {
 
-	var batcher *snail_batcher.SnailBatcher[Resp]
+	batcherOpts := server.opts.Batcher
+	useEnvelope := server.opts.Envelope
+
+	parseFunc := newFrameParser(userParseFunc, useEnvelope, frameKindRequest)
+	writeFunc := newFrameWriter(userWriteFunc, useEnvelope)
+	if server.opts.Metrics != nil {
+		parseFunc = snail_parser.InstrumentParser(parseFunc, "server", server.opts.Metrics)
+		writeFunc = snail_parser.InstrumentWriter(writeFunc, "server", server.opts.Metrics)
+	}
+
+	var batcher *snail_batcher.SnailBatcher[envelope[Resp]]
 	if batcherOpts.IsEnabled() {
 		writeBuffer := snail_buffer.New(snail_buffer.BigEndian, 64*1024)
-		batcher = snail_batcher.NewSnailBatcher[Resp](
+		batcher = snail_batcher.NewSnailBatcherWithOpts[envelope[Resp]](
 			batcherOpts.BatchSize,
 			batcherOpts.QueueSize,
 			batcherOpts.WindowSize,
-			func(resps []Resp) error {
+			func(resps []envelope[Resp]) error {
 
 				// We don't need a mutex to protect the writeBuffer here, since
 				// the batcher will only call this function from a single thread.
@@ -191,15 +390,36 @@ func newTcpServerConnHandler[Req any, Resp any](
 
 				return nil
 			},
+			&snail_batcher.SnailBatcherOpts[envelope[Resp]]{
+				// Replies that can't be written are lost, so the connection is done for.
+				// Closing it makes the client notice, and later replies fail fast.
+				ErrorPolicy: snail_batcher.ErrorPolicyPoison,
+				Metrics:     batcherOpts.Metrics,
+				Name:        "server",
+				OnError: func(_ []envelope[Resp], err error) {
+					slog.Warn(fmt.Sprintf("Failed to write replies, closing connection: %v", err))
+					_ = conn.Close()
+				},
+			},
 		)
 	}
 
-	var writeRespFunc func(resp Resp) error
+	if batcher != nil {
+		// The handler factory, interceptors and NewStreamHandler run below. If one of them panics,
+		// snail_tcp recovers, but never calls the handler with nil, which would close the batcher.
+		defer func() {
+			if r := recover(); r != nil {
+				batcher.Close()
+				panic(r)
+			}
+		}()
+	}
+
+	var writeFrameFunc func(frame envelope[Resp]) error
 
 	if batcher != nil {
-		writeRespFunc = func(resp Resp) error {
-			batcher.Add(resp) // TODO: Propagate errors?
-			return nil
+		writeFrameFunc = func(frame envelope[Resp]) error {
+			return batcher.Submit(frame)
 		}
 	} else {
 
@@ -207,7 +427,7 @@ func newTcpServerConnHandler[Req any, Resp any](
 
 		writeBuffer := snail_buffer.New(snail_buffer.BigEndian, 64*1024)
 		writeMutex := sync.Mutex{}
-		writeRespFunc = func(resp Resp) error {
+		writeFrameFunc = func(frame envelope[Resp]) error {
 
 			// A mutex is likely to be faster than a channel here, since we are
 			// dealing with n multiplexed requests over a single connection.
@@ -221,7 +441,7 @@ func newTcpServerConnHandler[Req any, Resp any](
 			defer writeBuffer.Reset()
 
 			// Prepare the response
-			if err := writeFunc(writeBuffer, resp); err != nil {
+			if err := writeFunc(writeBuffer, frame); err != nil {
 				return fmt.Errorf("failed to write response: %w", err)
 			}
 
@@ -236,26 +456,60 @@ func newTcpServerConnHandler[Req any, Resp any](
 
 	}
 
-	userHandler := userHandlerFunc()
+	session := newSession(conn, writeFrameFunc)
+
+	handlerFunc := func() ServerConnHandler[Req, Resp] { return userHandlerFunc(session) }
+	var streamHandler StreamHandler[Req, Resp]
+	if server.opts.NewStreamHandler != nil {
+		streamHandler = server.opts.NewStreamHandler(session)
+	}
+	executor := newConnExecutor(
+		conn,
+		withInterceptors(handlerFunc, conn, server.opts.Interceptors)(),
+		streamHandler,
+		writeFrameFunc,
+		server.opts,
+		server.sharedSlots,
+		server.onPanic,
+	)
+	server.addSession(session) // after creating the handler, which may panic
 	tcpHandler := func(readBuffer *snail_buffer.Buffer) error {
 
 		if readBuffer == nil {
-			var zero Req
-			err := userHandler(zero, nil)
+			server.removeSession(session)
+			err := executor.close()
 			if batcher != nil {
+				// wait for the last replies to be written, before the socket is closed
 				batcher.Close()
 			}
 			return err
 		}
 
-		reqs, err := snail_parser.ParseAll[Req](readBuffer, parseFunc)
+		reqs, err := snail_parser.ParseAll[envelope[Req]](readBuffer, parseFunc)
 		if err != nil {
 			return fmt.Errorf("failed to parse requests: %w", err)
 		}
 
 		for _, req := range reqs {
-			if err := userHandler(req, writeRespFunc); err != nil {
-				return fmt.Errorf("failed to handle request: %w", err)
+			switch req.kind {
+			case frameKindPing:
+				if err := writeFrameFunc(envelope[Resp]{kind: frameKindPong, id: req.id}); err != nil {
+					return fmt.Errorf("failed to answer ping: %w", err)
+				}
+			case frameKindRequest:
+				if err := executor.execute(req.value, req.id); err != nil {
+					return fmt.Errorf("failed to handle request: %w", err)
+				}
+			case frameKindStreamRequest:
+				if err := executor.executeStream(req.value, req.id); err != nil {
+					return fmt.Errorf("failed to handle stream request: %w", err)
+				}
+			case frameKindStreamCancel:
+				executor.cancelStream(req.id)
+			case frameKindStreamCredit:
+				executor.grantStream(req.id, req.credits)
+			default:
+				return fmt.Errorf("unexpected frame kind from client: %d", req.kind)
 			}
 		}
 
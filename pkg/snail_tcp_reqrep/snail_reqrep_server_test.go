@@ -1,13 +1,23 @@
 package snail_tcp_reqrep
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/GiGurra/snail/pkg/snail_buffer"
 	"github.com/GiGurra/snail/pkg/snail_logging"
+	"github.com/GiGurra/snail/pkg/snail_metrics"
 	"github.com/GiGurra/snail/pkg/snail_parser"
+	"github.com/GiGurra/snail/pkg/snail_tcp"
+	"github.com/GiGurra/snail/pkg/snail_test_util/snail_tls"
 	"log/slog"
 	"net"
+	"path/filepath"
+	"runtime"
+	"sync"
 	"testing"
+	"time"
 )
 
 type requestStruct struct {
@@ -86,3 +96,398 @@ func TestNewServer_SendAndRespondWithJson(t *testing.T) {
 
 	slog.Info("Received response", slog.String("msg", resp.Msg))
 }
+
+func TestServer_Shutdown_flushesBatchedReplies(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	codec := snail_parser.NewInt32Codec()
+	nRequests := 100
+	handled := sync.WaitGroup{}
+	handled.Add(nRequests)
+
+	server, err := NewServer[int32, int32](
+		func() ServerConnHandler[int32, int32] {
+			return func(req int32, repFunc func(resp int32) error) error {
+				if repFunc == nil {
+					return nil
+				}
+				defer handled.Done()
+				return repFunc(req)
+			}
+		},
+		nil,
+		codec.Parser,
+		codec.Writer,
+		&SnailServerOpts[int32, int32]{
+			// Long window and large batches, so that replies stay in the batcher until shutdown
+			Batcher:        BatcherOpts{BatchSize: 1024, QueueSize: 2048, WindowSize: 1 * time.Minute},
+			Envelope:       true,
+			ShutdownNotice: func() int32 { return -1 },
+		},
+	)
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+
+	notices := make(chan int32, 1)
+	client, err := NewClientWithOpts[int32, int32](
+		"localhost",
+		server.Port(),
+		nil,
+		func(resp int32, status ClientStatus) error {
+			if status == ClientStatusOK {
+				notices <- resp
+			}
+			return nil
+		},
+		codec.Writer,
+		codec.Parser,
+		&SnailClientOpts[int32, int32]{Envelope: true},
+	)
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	defer client.Close()
+
+	futures := make([]*Future[int32], nRequests)
+	for i := range futures {
+		futures[i] = client.CallAsync(int32(i))
+	}
+	handled.Wait()
+
+	select {
+	case <-futures[0].Done():
+		t.Fatalf("expected replies to still be batched")
+	default:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("error shutting down server: %v", err)
+	}
+
+	for i, f := range futures {
+		resp, err := f.Await(ctx)
+		if err != nil {
+			t.Fatalf("error awaiting response %d: %v", i, err)
+		}
+		if resp != int32(i) {
+			t.Fatalf("expected response %d, got %d", i, resp)
+		}
+	}
+
+	select {
+	case notice := <-notices:
+		if notice != -1 {
+			t.Fatalf("expected shutdown notice -1, got %d", notice)
+		}
+	case <-ctx.Done():
+		t.Fatalf("timeout waiting for shutdown notice")
+	}
+
+	// No new connections are accepted
+	_, err = net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", server.Port()), 100*time.Millisecond)
+	if err == nil {
+		t.Fatalf("expected dialing a shut down server to fail")
+	}
+}
+
+func TestServer_batchedWriteFailure_closesConnection(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	codec := snail_parser.NewInt32Codec()
+	failingWriter := func(buffer *snail_buffer.Buffer, resp int32) error {
+		if resp < 0 {
+			return fmt.Errorf("cannot write negative responses")
+		}
+		return codec.Writer(buffer, resp)
+	}
+
+	server, err := NewServer[int32, int32](
+		func() ServerConnHandler[int32, int32] {
+			return func(req int32, repFunc func(resp int32) error) error {
+				if repFunc == nil {
+					return nil
+				}
+				return repFunc(req)
+			}
+		},
+		nil,
+		codec.Parser,
+		failingWriter,
+		&SnailServerOpts[int32, int32]{
+			Batcher: BatcherOpts{BatchSize: 1, QueueSize: 1, WindowSize: 1 * time.Millisecond},
+		},
+	)
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+	defer server.Close()
+
+	client, err := NewClient[int32, int32]("localhost", server.Port(), nil, nil, codec.Writer, codec.Parser)
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	defer client.Close()
+
+	if resp, err := client.Call(context.Background(), 1); err != nil || resp != 1 {
+		t.Fatalf("expected 1, got %d, %v", resp, err)
+	}
+
+	future := client.CallAsync(-1)
+
+	select {
+	case <-client.Done():
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expected server to close the connection")
+	}
+
+	if _, err := future.Get(); !errors.Is(err, ErrDisconnected) {
+		t.Fatalf("expected ErrDisconnected, got %v", err)
+	}
+}
+
+func TestServer_panickingHandlerFactory_closesBatcher(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	codec := snail_parser.NewInt32Codec()
+	server, err := NewServer[int32, int32](
+		func() ServerConnHandler[int32, int32] { panic("unlucky") },
+		nil,
+		codec.Parser,
+		codec.Writer,
+		&SnailServerOpts[int32, int32]{Batcher: NewBatcherOpts(16)},
+	)
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+	defer server.Close()
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", server.Port()))
+		if err != nil {
+			t.Fatalf("error dialing server: %v", err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("expected the server to close the connection")
+		}
+		_ = conn.Close()
+	}
+
+	// Each connection's batcher would leave a worker and a ticker goroutine behind
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before+5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the batchers to be closed, got %d goroutines, started with %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+}
+
+func TestServer_mutualTLS_connHandler(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	pki, err := snail_tls.NewTestPKI("snail-client")
+	if err != nil {
+		t.Fatalf("error creating pki: %v", err)
+	}
+
+	codec := snail_parser.NewJsonLinesCodec[responseStruct]()
+
+	// Replies with the common name of the client certificate
+	server, err := NewServer[responseStruct, responseStruct](
+		nil,
+		&snail_tcp.SnailServerOpts{TLSConfig: pki.ServerConfig(true)},
+		codec.Parser,
+		codec.Writer,
+		&SnailServerOpts[responseStruct, responseStruct]{
+			Batcher: NewBatcherOpts(64),
+			NewConnHandler: func(conn net.Conn) ServerConnHandler[responseStruct, responseStruct] {
+				peer := snail_tcp.PeerCertificates(conn)[0].Subject.CommonName
+				return func(req responseStruct, repFunc func(resp responseStruct) error) error {
+					if repFunc == nil {
+						return nil
+					}
+					return repFunc(responseStruct{Msg: req.Msg + " " + peer})
+				}
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+	defer server.Close()
+
+	client, err := NewClientWithOpts[responseStruct, responseStruct](
+		"localhost",
+		server.Port(),
+		&snail_tcp.SnailClientOpts{TLSConfig: pki.ClientConfig(true)},
+		nil,
+		codec.Writer,
+		codec.Parser,
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := client.Call(ctx, responseStruct{Msg: "hello"})
+	if err != nil {
+		t.Fatalf("error calling: %v", err)
+	}
+	if resp.Msg != "hello snail-client" {
+		t.Fatalf("expected 'hello snail-client', got '%s'", resp.Msg)
+	}
+}
+
+func TestServer_unixSocket(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	path := filepath.Join(t.TempDir(), "snail.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+
+	codec := snail_parser.NewInt32Codec()
+	server, err := NewServerWithListener[int32, int32](
+		listener,
+		func() ServerConnHandler[int32, int32] {
+			return func(req int32, repFunc func(resp int32) error) error {
+				if repFunc == nil {
+					return nil
+				}
+				return repFunc(req * 2)
+			}
+		},
+		nil,
+		codec.Parser,
+		codec.Writer,
+		&SnailServerOpts[int32, int32]{Envelope: true},
+	)
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+	defer server.Close()
+
+	client, err := NewClientWithDialer[int32, int32](
+		func() (net.Conn, error) { return net.Dial(server.Addr().Network(), server.Addr().String()) },
+		nil,
+		nil,
+		codec.Writer,
+		codec.Parser,
+		&SnailClientOpts[int32, int32]{Envelope: true},
+	)
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := int32(0); i < 10; i++ {
+		resp, err := client.Call(ctx, i)
+		if err != nil {
+			t.Fatalf("error calling: %v", err)
+		}
+		if resp != i*2 {
+			t.Fatalf("expected %d, got %d", i*2, resp)
+		}
+	}
+}
+
+func TestServer_metrics(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	registry := snail_metrics.NewRegistry()
+	codec := snail_parser.InstrumentCodec(snail_parser.NewInt32Codec(), "int32", registry)
+	batching := BatcherOpts{BatchSize: 10, WindowSize: 1 * time.Millisecond, Metrics: registry}
+
+	server, err := NewServer[int32, int32](
+		func() ServerConnHandler[int32, int32] {
+			return func(req int32, repFunc func(resp int32) error) error {
+				if repFunc == nil {
+					return nil
+				}
+				return repFunc(req)
+			}
+		},
+		&snail_tcp.SnailServerOpts{Metrics: registry},
+		codec.Parser,
+		codec.Writer,
+		&SnailServerOpts[int32, int32]{Envelope: true, Batcher: batching},
+	)
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+	defer server.Close()
+
+	client, err := NewClientWithOpts[int32, int32](
+		"localhost",
+		server.Port(),
+		nil,
+		nil,
+		codec.Writer,
+		codec.Parser,
+		&SnailClientOpts[int32, int32]{Envelope: true, Batcher: batching},
+	)
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := int32(0); i < 5; i++ {
+		if _, err := client.Call(ctx, i); err != nil {
+			t.Fatalf("error calling: %v", err)
+		}
+	}
+
+	value := func(name string, labels ...snail_metrics.Label) float64 {
+		v, _ := registry.Value(name, labels...)
+		return v
+	}
+	int32Label := snail_metrics.Label{Name: "codec", Value: "int32"}
+	if v := value("snail_codec_messages_parsed_total", int32Label); v != 10 {
+		t.Fatalf("expected 5 requests and 5 responses parsed, got %v", v)
+	}
+	if v := value("snail_codec_messages_written_total", int32Label); v != 10 {
+		t.Fatalf("expected 5 requests and 5 responses written, got %v", v)
+	}
+	for _, side := range []string{"server", "client"} {
+		if v := value("snail_batcher_batch_size_sum", snail_metrics.Label{Name: "batcher", Value: side}); v != 5 {
+			t.Fatalf("expected 5 items batched by the %s, got %v", side, v)
+		}
+	}
+	if v := value("snail_server_connections_active"); v != 1 {
+		t.Fatalf("expected 1 active connection, got %v", v)
+	}
+
+	// The reqrep layer counts frames and parse errors with the batcher's metrics
+	for _, side := range []string{"server", "client"} {
+		label := snail_metrics.Label{Name: "codec", Value: side}
+		if v := value("snail_codec_messages_parsed_total", label); v != 5 {
+			t.Fatalf("expected 5 frames parsed by the %s, got %v", side, v)
+		}
+		if v := value("snail_codec_messages_written_total", label); v != 5 {
+			t.Fatalf("expected 5 frames written by the %s, got %v", side, v)
+		}
+	}
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", server.Port()))
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{99, 0, 0, 0, 0, 0, 0, 0, 1}); err != nil { // unknown envelope kind
+		t.Fatalf("error writing: %v", err)
+	}
+	serverLabel := snail_metrics.Label{Name: "codec", Value: "server"}
+	waitFor(t, func() bool { return value("snail_codec_parse_errors_total", serverLabel) == 1 })
+}
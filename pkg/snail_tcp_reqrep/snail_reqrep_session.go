@@ -0,0 +1,89 @@
+package snail_tcp_reqrep
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrSessionClosed is returned when pushing to a session whose connection has closed
+var ErrSessionClosed = errors.New("snail session closed")
+
+// Session is the server side of one client connection. It is created before the connection's
+// handler, and passed to SnailServerOpts.NewSessionHandler if set. It lets the server send
+// messages the client didn't ask for, and keeps per connection attributes, such as the
+// authenticated user.
+type Session[Resp any] struct {
+	conn       net.Conn
+	writeFrame func(frame envelope[Resp]) error
+	closed     atomic.Bool
+
+	attrsLock sync.Mutex
+	attrs     map[string]any
+}
+
+func newSession[Resp any](conn net.Conn, writeFrame func(frame envelope[Resp]) error) *Session[Resp] {
+	return &Session[Resp]{
+		conn:       conn,
+		writeFrame: writeFrame,
+		attrs:      make(map[string]any),
+	}
+}
+
+// Conn returns the underlying connection
+func (s *Session[Resp]) Conn() net.Conn {
+	return s.conn
+}
+
+// RemoteAddr returns the address of the client
+func (s *Session[Resp]) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// Push sends an unsolicited message to the client. It goes through the same batcher as the
+// replies, but is not part of any request, so it is not held back by OrderedReplies. With the
+// envelope it arrives with correlation id 0, and clients pass it to their ClientRespHandler.
+// Without the envelope, the client can't tell it apart from a reply.
+func (s *Session[Resp]) Push(resp Resp) error {
+	if s.closed.Load() {
+		return ErrSessionClosed
+	}
+	if err := s.writeFrame(envelope[Resp]{kind: frameKindResponse, value: resp}); err != nil {
+		return fmt.Errorf("failed to push message: %w", err)
+	}
+	return nil
+}
+
+// Close closes the connection, e.g. to kick a client
+func (s *Session[Resp]) Close() error {
+	return s.conn.Close()
+}
+
+// Closed returns true once the connection has closed
+func (s *Session[Resp]) Closed() bool {
+	return s.closed.Load()
+}
+
+// Get returns the attribute stored under key
+func (s *Session[Resp]) Get(key string) (any, bool) {
+	s.attrsLock.Lock()
+	defer s.attrsLock.Unlock()
+	value, ok := s.attrs[key]
+	return value, ok
+}
+
+// Set stores an attribute under key, replacing any previous value
+func (s *Session[Resp]) Set(key string, value any) {
+	s.attrsLock.Lock()
+	defer s.attrsLock.Unlock()
+	s.attrs[key] = value
+}
+
+// Delete removes the attribute stored under key
+func (s *Session[Resp]) Delete(key string) {
+	s.attrsLock.Lock()
+	defer s.attrsLock.Unlock()
+	delete(s.attrs, key)
+}
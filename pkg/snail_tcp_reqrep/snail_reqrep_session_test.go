@@ -0,0 +1,103 @@
+package snail_tcp_reqrep
+
+import (
+	"errors"
+	"github.com/GiGurra/snail/pkg/snail_logging"
+	"github.com/GiGurra/snail/pkg/snail_parser"
+	"testing"
+	"time"
+)
+
+// pushTo is a client response handler, forwarding responses to pushed
+func pushTo(pushed chan int32) func(resp int32, status ClientStatus) error {
+	return func(resp int32, status ClientStatus) error {
+		if status == ClientStatusOK {
+			pushed <- resp
+		}
+		return nil
+	}
+}
+
+func awaitPushed(t *testing.T, pushed chan int32, expected int32) {
+	t.Helper()
+	select {
+	case resp := <-pushed:
+		if resp != expected {
+			t.Fatalf("expected pushed message %d, got %d", expected, resp)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for pushed message %d", expected)
+	}
+}
+
+func TestServer_sessions_pushAndBroadcast(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	for _, batching := range []BatcherOpts{{}, NewBatcherOpts(10)} {
+		codec := snail_parser.NewInt32Codec()
+		server := newEchoServer(t, codec, echoServerOpts[int32]{
+			Server: &SnailServerOpts[int32, int32]{
+				Envelope: true,
+				Batcher:  batching,
+				NewSessionHandler: func(session *Session[int32]) ServerConnHandler[int32, int32] {
+					return func(req int32, repFunc func(resp int32) error) error {
+						if repFunc == nil {
+							return nil
+						}
+						// Requests subscribe the client to pushes of req + 1000
+						session.Set("topic", req)
+						if err := repFunc(req); err != nil {
+							return err
+						}
+						return session.Push(req + 1000)
+					}
+				},
+			},
+		})
+
+		pushedA, pushedB := make(chan int32, 10), make(chan int32, 10)
+		clientA := newEchoClient(t, codec, server, pushTo(pushedA), &SnailClientOpts[int32, int32]{Envelope: true})
+		clientB := newEchoClient(t, codec, server, pushTo(pushedB), &SnailClientOpts[int32, int32]{Envelope: true})
+
+		for i, client := range []*SnailClient[int32, int32]{clientA, clientB} {
+			if resp, err := client.Call(t.Context(), int32(i)); err != nil || resp != int32(i) {
+				t.Fatalf("expected reply %d, got %d, %v", i, resp, err)
+			}
+		}
+		awaitPushed(t, pushedA, 1000)
+		awaitPushed(t, pushedB, 1001)
+
+		sessions := server.Sessions()
+		if len(sessions) != 2 {
+			t.Fatalf("expected 2 sessions, got %d", len(sessions))
+		}
+		for _, session := range sessions {
+			if session.RemoteAddr() == nil {
+				t.Fatalf("expected session to have a remote address")
+			}
+			if _, ok := session.Get("topic"); !ok {
+				t.Fatalf("expected session attribute to be set by the handler")
+			}
+		}
+
+		if err := server.Broadcast(42); err != nil {
+			t.Fatalf("error broadcasting: %v", err)
+		}
+		awaitPushed(t, pushedA, 42)
+		awaitPushed(t, pushedB, 42)
+
+		// Sessions of disconnected clients are gone, and can no longer be pushed to
+		clientA.Close()
+		waitFor(t, func() bool { return len(server.Sessions()) == 1 })
+		closed := sessions[0]
+		if !closed.Closed() {
+			closed = sessions[1]
+		}
+		if err := closed.Push(1); !errors.Is(err, ErrSessionClosed) {
+			t.Fatalf("expected ErrSessionClosed, got %v", err)
+		}
+
+		clientB.Close()
+		server.Close()
+	}
+}
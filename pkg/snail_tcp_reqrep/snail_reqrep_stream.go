@@ -0,0 +1,358 @@
+package snail_tcp_reqrep
+
+import (
+	"context"
+	"errors"
+	"io"
+	"iter"
+	"sync"
+)
+
+// Streaming calls are calls with many responses. The client starts one with SnailClient.Stream,
+// which sends a stream request frame. The server passes it to the StreamHandler, which sends
+// any number of responses with the request's id through a StreamWriter, followed by a stream
+// end frame, or an error frame. The client can cancel the stream with a stream cancel frame.
+// All of this requires the envelope.
+//
+// Streams are flow controlled with credits. The client grants the server room for as many
+// responses as its buffer holds, with a stream credit frame after the request, and grants more
+// as they are read. The server's Send waits while it has no credits left, so a slow reader
+// slows down its own stream, without ever holding up the client's reads of the connection.
+
+var (
+	// ErrStreamClosed is returned when sending on a stream that has already been closed
+	ErrStreamClosed = errors.New("snail stream closed")
+	// ErrStreamCanceled is returned when sending on a stream the client has canceled, and by
+	// the client's ResponseStream after canceling it
+	ErrStreamCanceled = errors.New("snail stream canceled")
+	// ErrStreamOverflow ends a client's ResponseStream when the server sends more responses
+	// than it was given credits for
+	ErrStreamOverflow = errors.New("snail stream buffer overflow")
+)
+
+// ErrorCodeNotImplemented is the code streaming calls fail with on servers without a StreamHandler
+const ErrorCodeNotImplemented int32 = 501
+
+// StreamHandler handles the requests of streaming calls. It sends responses with stream.Send,
+// and must end the stream with stream.Close or stream.CloseWithError, either before returning
+// or later from another goroutine. It runs on a goroutine of its own, whatever the execution
+// mode, and doesn't take up one of the pool's Workers, since Send may wait for the client. A returned error is handled like the errors of
+// ServerConnHandler, see SnailServerOpts.HandlerErrors. With ReplyOnHandlerError, it closes
+// the stream with the error, unless the stream is already closed.
+type StreamHandler[Req any, Resp any] func(req Req, stream *StreamWriter[Resp]) error
+
+// StreamWriter sends the responses of one streaming call. It is safe for concurrent use.
+type StreamWriter[Resp any] struct {
+	id         uint64
+	writeFrame func(frame envelope[Resp]) error
+	onClose    func() // called once, when the stream is closed or canceled
+	done       chan struct{}
+
+	lock     sync.Mutex
+	closed   bool
+	canceled bool
+
+	creditLock sync.Mutex
+	creditCond *sync.Cond // signalled when credits are granted, or the stream ends
+	credits    uint64     // responses the client has room for
+	ended      bool       // set with closed, under creditLock, to stop waiting for credits
+}
+
+func newStreamWriter[Resp any](id uint64, writeFrame func(frame envelope[Resp]) error, onClose func()) *StreamWriter[Resp] {
+	res := &StreamWriter[Resp]{id: id, writeFrame: writeFrame, onClose: onClose, done: make(chan struct{})}
+	res.creditCond = sync.NewCond(&res.creditLock)
+	return res
+}
+
+// Send sends one response. It goes through the connection's batcher, if there is one. While
+// the client has no room for more responses, see SnailClientOpts.StreamBuffer, it waits until
+// the client has read some, or the stream ends.
+func (w *StreamWriter[Resp]) Send(resp Resp) error {
+	w.takeCredit()
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if err := w.errLocked(); err != nil {
+		return err
+	}
+	return w.writeFrame(envelope[Resp]{kind: frameKindResponse, id: w.id, value: resp})
+}
+
+// Close ends the stream successfully
+func (w *StreamWriter[Resp]) Close() error {
+	return w.closeWith(envelope[Resp]{kind: frameKindStreamEnd, id: w.id})
+}
+
+// CloseWithError ends the stream with an error, which the client gets as a *ResponseError.
+// Errors that aren't one are sent with ErrorCodeInternal and their message.
+func (w *StreamWriter[Resp]) CloseWithError(err error) error {
+	return w.closeWith(envelope[Resp]{kind: frameKindError, id: w.id, err: toResponseError(err)})
+}
+
+// Done returns a channel that is closed once the stream is closed, canceled by the client,
+// or its connection has closed. Handlers streaming from a loop can select on it to stop early.
+func (w *StreamWriter[Resp]) Done() <-chan struct{} {
+	return w.done
+}
+
+func (w *StreamWriter[Resp]) closeWith(frame envelope[Resp]) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if err := w.errLocked(); err != nil {
+		return err
+	}
+	w.endLocked(false)
+	return w.writeFrame(frame)
+}
+
+// cancel ends the stream without sending anything, because the client is no longer interested
+func (w *StreamWriter[Resp]) cancel() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !w.closed {
+		w.endLocked(true)
+	}
+}
+
+func (w *StreamWriter[Resp]) endLocked(canceled bool) {
+	w.closed = true
+	w.canceled = canceled
+	close(w.done)
+	w.onClose()
+
+	w.creditLock.Lock()
+	w.ended = true
+	w.creditCond.Broadcast()
+	w.creditLock.Unlock()
+}
+
+// grant gives the stream room for n more responses
+func (w *StreamWriter[Resp]) grant(n uint32) {
+	w.creditLock.Lock()
+	defer w.creditLock.Unlock()
+	w.credits += uint64(n)
+	w.creditCond.Broadcast()
+}
+
+// takeCredit waits for room for one response. Once the stream has ended it returns right
+// away, for Send to fail with the reason.
+func (w *StreamWriter[Resp]) takeCredit() {
+	w.creditLock.Lock()
+	defer w.creditLock.Unlock()
+	for w.credits == 0 && !w.ended {
+		w.creditCond.Wait()
+	}
+	if w.credits > 0 {
+		w.credits--
+	}
+}
+
+func (w *StreamWriter[Resp]) errLocked() error {
+	switch {
+	case w.canceled:
+		return ErrStreamCanceled
+	case w.closed:
+		return ErrStreamClosed
+	default:
+		return nil
+	}
+}
+
+// ResponseStream is the client side of a streaming call, started with SnailClient.Stream.
+// Read the responses with Recv, All or C.
+type ResponseStream[Resp any] struct {
+	items       chan Resp
+	canceled    chan struct{}  // closed by cancel, to stop the goroutine of C
+	cancelFn    func()         // tells the server, and forgets the stream. nil if never sent
+	creditFn    func(n uint32) // grants the server room for n more responses. nil if never sent
+	creditBatch int            // responses read before granting their room back in one frame
+	stopCtx     func() bool    // stops watching the context, guarded by lock
+
+	lock  sync.Mutex
+	ended bool
+	err   error
+	read  int       // responses read since the last grant
+	out   chan Resp // see C, nil until it is called
+}
+
+func newResponseStream[Resp any](bufferSize int) *ResponseStream[Resp] {
+	return &ResponseStream[Resp]{
+		items:       make(chan Resp, bufferSize),
+		canceled:    make(chan struct{}),
+		creditBatch: max(1, bufferSize/2),
+	}
+}
+
+func newFailedResponseStream[Resp any](err error) *ResponseStream[Resp] {
+	res := newResponseStream[Resp](0)
+	res.end(err)
+	return res
+}
+
+// Recv returns the next response. It returns io.EOF once the server has closed the stream,
+// and the error the stream ended with otherwise, e.g. a *ResponseError from CloseWithError.
+func (s *ResponseStream[Resp]) Recv() (Resp, error) {
+	if resp, ok := <-s.items; ok {
+		s.onRead()
+		return resp, nil
+	}
+	var zero Resp
+	if err := s.Err(); err != nil {
+		return zero, err
+	}
+	return zero, io.EOF
+}
+
+// RecvContext is Recv, also giving up when ctx is done. The stream keeps going.
+func (s *ResponseStream[Resp]) RecvContext(ctx context.Context) (Resp, error) {
+	select {
+	case resp, ok := <-s.items:
+		if ok {
+			s.onRead()
+			return resp, nil
+		}
+		return s.Recv()
+	case <-ctx.Done():
+		var zero Resp
+		return zero, ctx.Err()
+	}
+}
+
+// All returns an iterator over the responses. If the stream ends with an error, it is
+// yielded last, with a zero response. Breaking out of the loop cancels the stream.
+func (s *ResponseStream[Resp]) All() iter.Seq2[Resp, error] {
+	return func(yield func(Resp, error) bool) {
+		for {
+			resp, err := s.Recv()
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err != nil {
+				yield(resp, err)
+				return
+			}
+			if !yield(resp, nil) {
+				s.Close()
+				return
+			}
+		}
+	}
+}
+
+// C returns a channel the responses arrive on. It is closed when the stream ends, after which
+// Err tells why. A goroutine moves the responses onto it, until the stream ends or is canceled,
+// so don't mix it with Recv, and Close the stream when no longer reading.
+func (s *ResponseStream[Resp]) C() <-chan Resp {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.out == nil {
+		s.out = make(chan Resp)
+		go s.forward(s.out)
+	}
+	return s.out
+}
+
+func (s *ResponseStream[Resp]) forward(out chan Resp) {
+	defer close(out)
+	for {
+		resp, err := s.Recv()
+		if err != nil {
+			return
+		}
+		select {
+		case out <- resp:
+		case <-s.canceled:
+			return
+		}
+	}
+}
+
+// Err returns the error the stream ended with, or nil while it is running or if the server
+// closed it successfully
+func (s *ResponseStream[Resp]) Err() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+// Close cancels the stream, unless it has already ended. The server is told to stop, and
+// responses still on their way are dropped.
+func (s *ResponseStream[Resp]) Close() {
+	s.cancel(ErrStreamCanceled)
+}
+
+func (s *ResponseStream[Resp]) cancel(err error) {
+	if !s.end(err) {
+		return
+	}
+	close(s.canceled)
+	if s.cancelFn != nil {
+		s.cancelFn()
+	}
+}
+
+// watch cancels the stream when ctx is done
+func (s *ResponseStream[Resp]) watch(ctx context.Context) {
+	stop := context.AfterFunc(ctx, func() { s.cancel(ctx.Err()) })
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.ended {
+		stop()
+		return
+	}
+	s.stopCtx = stop
+}
+
+// onRead counts a response taken from the buffer, and grants the server room for more once
+// creditBatch of them have been read
+func (s *ResponseStream[Resp]) onRead() {
+	s.lock.Lock()
+	s.read++
+	n := s.read
+	if s.ended || s.creditFn == nil || n < s.creditBatch {
+		s.lock.Unlock()
+		return
+	}
+	s.read = 0
+	s.lock.Unlock()
+	s.creditFn(uint32(n))
+}
+
+// push delivers a response. It never blocks, since it runs on the connection's read goroutine.
+// The server only sends what it has credits for, so the buffer only overflows if it doesn't,
+// which ends the stream with ErrStreamOverflow. The server is told from another goroutine.
+func (s *ResponseStream[Resp]) push(resp Resp) {
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	select {
+	case s.items <- resp:
+		s.lock.Unlock()
+		return
+	default:
+		s.lock.Unlock()
+	}
+	if s.end(ErrStreamOverflow) && s.cancelFn != nil {
+		go s.cancelFn()
+	}
+}
+
+// end ends the stream with err, nil meaning success. Returns true if this call ended it.
+func (s *ResponseStream[Resp]) end(err error) bool {
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return false
+	}
+	s.ended = true
+	s.err = err
+	stopCtx := s.stopCtx
+	s.lock.Unlock()
+
+	if stopCtx != nil {
+		stopCtx()
+	}
+	close(s.items) // no push can follow, now that ended is set
+	return true
+}
@@ -0,0 +1,339 @@
+package snail_tcp_reqrep
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/GiGurra/snail/pkg/snail_logging"
+	"github.com/GiGurra/snail/pkg/snail_parser"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingStreamHandler streams 0 until req for positive requests. Negative requests send one
+// response and then fail. Request 0 streams until the client cancels, and then signals stopped.
+func countingStreamHandler(stopped chan struct{}) StreamHandler[int32, int32] {
+	return func(req int32, stream *StreamWriter[int32]) error {
+		switch {
+		case req < 0:
+			if err := stream.Send(1); err != nil {
+				return err
+			}
+			return &ResponseError{Code: 409, Message: "conflict"}
+		case req == 0:
+			go func() {
+				defer close(stopped)
+				for i := int32(0); ; i++ {
+					select {
+					case <-stream.Done():
+						return
+					default:
+					}
+					if err := stream.Send(i); err != nil {
+						return
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}()
+			return nil
+		default:
+			for i := int32(0); i < req; i++ {
+				if err := stream.Send(i); err != nil {
+					return err
+				}
+			}
+			return stream.Close()
+		}
+	}
+}
+
+func TestStream_multiplexedWithCalls(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	executions := []ExecutionOpts{{}, {Mode: ExecutePerConnPool, Workers: 4}, {Mode: ExecuteSharedPool, Workers: 4}}
+	for _, execution := range executions {
+		t.Run(fmt.Sprintf("mode=%d", execution.Mode), func(t *testing.T) {
+			codec := snail_parser.NewInt32Codec()
+			server := newEchoServer(t, codec, echoServerOpts[int32]{
+				Server: &SnailServerOpts[int32, int32]{
+					Envelope:         true,
+					Batcher:          NewBatcherOpts(16),
+					Execution:        execution,
+					NewStreamHandler: func(*Session[int32]) StreamHandler[int32, int32] { return countingStreamHandler(nil) },
+				},
+			})
+			defer server.Close()
+			client := newEchoClient(t, codec, server, nil, &SnailClientOpts[int32, int32]{Envelope: true, Batcher: NewBatcherOpts(16), StreamBuffer: 4})
+			defer client.Close()
+
+			// Concurrent streams of different lengths, interleaved with plain calls
+			wg := sync.WaitGroup{}
+			errs := make(chan error, 40)
+			for i := 1; i <= 20; i++ {
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					expected := int32(0)
+					for resp, err := range client.Stream(t.Context(), int32(i*10)).All() {
+						if err != nil || resp != expected {
+							errs <- fmt.Errorf("stream %d: expected %d, got %d, %v", i, expected, resp, err)
+							return
+						}
+						expected++
+					}
+					if expected != int32(i*10) {
+						errs <- fmt.Errorf("stream %d: ended after %d responses", i, expected)
+					}
+				}()
+				go func() {
+					defer wg.Done()
+					if resp, err := client.Call(t.Context(), int32(i)); err != nil || resp != int32(i) {
+						errs <- fmt.Errorf("call %d: got %d, %v", i, resp, err)
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+			if client.OpenStreams() != 0 {
+				t.Fatalf("expected no open streams, got %d", client.OpenStreams())
+			}
+		})
+	}
+}
+
+func TestStream_endsWithError(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	codec := snail_parser.NewInt32Codec()
+	server := newEchoServer(t, codec, echoServerOpts[int32]{
+		Server: &SnailServerOpts[int32, int32]{
+			Envelope:         true,
+			HandlerErrors:    ReplyOnHandlerError,
+			NewStreamHandler: func(*Session[int32]) StreamHandler[int32, int32] { return countingStreamHandler(nil) },
+		},
+	})
+	defer server.Close()
+	client := newEchoClient(t, codec, server, nil, &SnailClientOpts[int32, int32]{Envelope: true})
+	defer client.Close()
+
+	stream := client.Stream(t.Context(), -1)
+	if resp, err := stream.Recv(); err != nil || resp != 1 {
+		t.Fatalf("expected 1, got %d, %v", resp, err)
+	}
+	_, err := stream.Recv()
+	if !errors.Is(err, &ResponseError{Code: 409}) {
+		t.Fatalf("expected the handler's error, got %v", err)
+	}
+	if _, ok := <-stream.C(); ok || !errors.Is(stream.Err(), &ResponseError{Code: 409}) {
+		t.Fatalf("expected a closed channel and the handler's error, got %v", stream.Err())
+	}
+
+	// A successful end is io.EOF from Recv, and no error from Err
+	stream = client.Stream(t.Context(), 1)
+	if resp, err := stream.Recv(); err != nil || resp != 0 {
+		t.Fatalf("expected 0, got %d, %v", resp, err)
+	}
+	if _, err := stream.Recv(); !errors.Is(err, io.EOF) || stream.Err() != nil {
+		t.Fatalf("expected io.EOF, got %v, %v", err, stream.Err())
+	}
+}
+
+func TestStream_cancel(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	stopped := make(chan struct{})
+	codec := snail_parser.NewInt32Codec()
+	server := newEchoServer(t, codec, echoServerOpts[int32]{
+		Server: &SnailServerOpts[int32, int32]{
+			Envelope:         true,
+			NewStreamHandler: func(*Session[int32]) StreamHandler[int32, int32] { return countingStreamHandler(stopped) },
+		},
+	})
+	defer server.Close()
+	client := newEchoClient(t, codec, server, nil, &SnailClientOpts[int32, int32]{Envelope: true, StreamBuffer: 1})
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	stream := client.Stream(ctx, 0)
+	for i := int32(0); i < 3; i++ {
+		if resp, err := stream.Recv(); err != nil || resp != i {
+			t.Fatalf("expected %d, got %d, %v", i, resp, err)
+		}
+	}
+	cancel()
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for the server to stop streaming")
+	}
+	for {
+		if _, err := stream.Recv(); err != nil {
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("expected context.Canceled, got %v", err)
+			}
+			break
+		}
+	}
+	waitFor(t, func() bool { return client.OpenStreams() == 0 })
+
+	// The connection is still usable
+	if resp, err := client.Call(t.Context(), 5); err != nil || resp != 5 {
+		t.Fatalf("expected 5, got %d, %v", resp, err)
+	}
+}
+
+func TestStream_clientDisconnectEndsPooledHandlers(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	started := make(chan struct{})
+	closed := make(chan struct{})
+	codec := snail_parser.NewInt32Codec()
+	server := newEchoServer(t, codec, echoServerOpts[int32]{
+		Handler: func(req int32, repFunc func(resp int32) error) error {
+			if repFunc == nil {
+				close(closed)
+			}
+			return nil
+		},
+		Server: &SnailServerOpts[int32, int32]{
+			Envelope:  true,
+			Execution: ExecutionOpts{Mode: ExecutePerConnPool, Workers: 2},
+			NewStreamHandler: func(*Session[int32]) StreamHandler[int32, int32] {
+				return func(req int32, stream *StreamWriter[int32]) error {
+					close(started)
+					<-stream.Done()
+					return nil
+				}
+			},
+		},
+	})
+	defer server.Close()
+
+	client := newEchoClient(t, codec, server, nil, &SnailClientOpts[int32, int32]{Envelope: true})
+	client.Stream(t.Context(), 1)
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for the stream handler to start")
+	}
+	client.Close()
+
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected the connection to close, with the stream handler still waiting for Done")
+	}
+}
+
+func TestStream_flowControl(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	sent := atomic.Int32{}
+	codec := snail_parser.NewInt32Codec()
+	server := newEchoServer(t, codec, echoServerOpts[int32]{
+		Server: &SnailServerOpts[int32, int32]{
+			Envelope: true,
+			NewStreamHandler: func(*Session[int32]) StreamHandler[int32, int32] {
+				return func(req int32, stream *StreamWriter[int32]) error {
+					for i := int32(0); i < req; i++ {
+						if err := stream.Send(i); err != nil {
+							return err
+						}
+						sent.Add(1)
+					}
+					return stream.Close()
+				}
+			},
+		},
+	})
+	defer server.Close()
+	client := newEchoClient(t, codec, server, nil, &SnailClientOpts[int32, int32]{
+		Envelope:     true,
+		StreamBuffer: 4,
+		Heartbeat:    &HeartbeatOpts{Interval: 10 * time.Millisecond, MaxMissed: 3},
+	})
+	defer client.Close()
+
+	// Nobody reads the stream yet, so the server runs out of credits once the buffer is full
+	stream := client.Stream(t.Context(), 100)
+	time.Sleep(100 * time.Millisecond)
+	if n := sent.Load(); n != 4 {
+		t.Fatalf("expected the server to wait after filling the buffer of 4, got %d sent", n)
+	}
+
+	// Meanwhile pongs keep coming in, and other calls go through
+	if err := client.Err(); err != nil {
+		t.Fatalf("expected the connection to stay up, got %v", err)
+	}
+	if resp, err := client.Call(t.Context(), 5); err != nil || resp != 5 {
+		t.Fatalf("expected 5, got %d, %v", resp, err)
+	}
+
+	// A slow reader gets the whole stream, many times the buffer
+	expected := int32(0)
+	for resp, err := range stream.All() {
+		if err != nil || resp != expected {
+			t.Fatalf("expected %d, got %d, %v", expected, resp, err)
+		}
+		expected++
+		time.Sleep(time.Millisecond)
+	}
+	if expected != 100 {
+		t.Fatalf("expected 100 responses, got %d", expected)
+	}
+}
+
+func TestStream_failures(t *testing.T) {
+	snail_logging.ConfigureDefaultLogger("text", "info", false)
+
+	// Servers without a stream handler
+	codec := snail_parser.NewInt32Codec()
+	server := newEchoServer(t, codec, echoServerOpts[int32]{Server: &SnailServerOpts[int32, int32]{Envelope: true}})
+	defer server.Close()
+	client := newEchoClient(t, codec, server, nil, &SnailClientOpts[int32, int32]{Envelope: true})
+	defer client.Close()
+	if _, err := client.Stream(t.Context(), 1).Recv(); !errors.Is(err, &ResponseError{Code: ErrorCodeNotImplemented}) {
+		t.Fatalf("expected a not implemented error, got %v", err)
+	}
+
+	// Lost connections
+	stopped := make(chan struct{})
+	server = newEchoServer(t, codec, echoServerOpts[int32]{
+		Server: &SnailServerOpts[int32, int32]{
+			Envelope:         true,
+			NewStreamHandler: func(*Session[int32]) StreamHandler[int32, int32] { return countingStreamHandler(stopped) },
+		},
+	})
+	defer server.Close()
+	client = newEchoClient(t, codec, server, nil, &SnailClientOpts[int32, int32]{Envelope: true})
+	defer client.Close()
+	stream := client.Stream(t.Context(), 0)
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("expected a response, got %v", err)
+	}
+	killServer(server)
+	for {
+		if _, err := stream.Recv(); err != nil {
+			if !errors.Is(err, ErrDisconnected) {
+				t.Fatalf("expected ErrDisconnected, got %v", err)
+			}
+			break
+		}
+	}
+
+	// Clients without the envelope
+	plainServer := newEchoServer(t, codec, echoServerOpts[int32]{})
+	defer plainServer.Close()
+	plainClient := newEchoClient(t, codec, plainServer, nil, nil)
+	defer plainClient.Close()
+	if _, err := plainClient.Stream(t.Context(), 1).Recv(); err == nil || errors.Is(err, io.EOF) {
+		t.Fatalf("expected streaming without the envelope to fail, got %v", err)
+	}
+}
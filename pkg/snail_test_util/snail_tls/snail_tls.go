@@ -0,0 +1,107 @@
+package snail_tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+)
+
+// TestPKI is a throwaway CA with one server and one client certificate, for tests only.
+// The server certificate is valid for localhost, 127.0.0.1 and ::1.
+type TestPKI struct {
+	CAs    *x509.CertPool
+	Server tls.Certificate
+	Client tls.Certificate
+}
+
+// NewTestPKI creates a new CA and signs a server certificate, and a client certificate
+// with the given common name.
+func NewTestPKI(clientName string) (*TestPKI, error) {
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ca key: %w", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "snail test ca"},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ca certificate: %w", err)
+	}
+	ca, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ca certificate: %w", err)
+	}
+
+	issue := func(serial int64, template *x509.Certificate) (tls.Certificate, error) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to generate key: %w", err)
+		}
+		template.SerialNumber = big.NewInt(serial)
+		template.NotBefore = caTemplate.NotBefore
+		template.NotAfter = caTemplate.NotAfter
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to create certificate: %w", err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+	}
+
+	server, err := issue(2, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := issue(3, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: clientName},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cas := x509.NewCertPool()
+	cas.AddCert(ca)
+
+	return &TestPKI{CAs: cas, Server: server, Client: client}, nil
+}
+
+// ServerConfig returns a server config. If mutual is set, clients must present a certificate signed by the CA.
+func (p *TestPKI) ServerConfig(mutual bool) *tls.Config {
+	res := &tls.Config{Certificates: []tls.Certificate{p.Server}}
+	if mutual {
+		res.ClientAuth = tls.RequireAndVerifyClientCert
+		res.ClientCAs = p.CAs
+	}
+	return res
+}
+
+// ClientConfig returns a client config trusting the CA. If withCert is set, the client certificate is presented.
+func (p *TestPKI) ClientConfig(withCert bool) *tls.Config {
+	res := &tls.Config{RootCAs: p.CAs}
+	if withCert {
+		res.Certificates = []tls.Certificate{p.Client}
+	}
+	return res
+}